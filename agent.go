@@ -0,0 +1,220 @@
+package khan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"khan.rip/rio"
+)
+
+// Push agent mode: instead of doing every file op over its own SSH session,
+// the binary copies itself to the remote host and runs there with --local
+// --agent. The agent sends its results back on stdout, one JSON object per
+// line. Everything it would normally print goes to stderr, which the
+// controller shows as it comes.
+
+// agentevent is one line of what an agent sends back
+type agentevent struct {
+	Type     string        `json:"type,omitempty"`
+	Item     string        `json:"item,omitempty"`
+	Status   string        `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// The last line has the totals
+	Done    bool `json:"done,omitempty"`
+	Failed  int  `json:"failed,omitempty"`
+	Skipped int  `json:"skipped,omitempty"`
+}
+
+// agentfailures is how a whole agent's failures get counted with the rest
+type agentfailures struct {
+	failed  int
+	skipped int
+	errs    []error
+}
+
+func (af *agentfailures) Error() string {
+	return fmt.Sprintf("%d items failed (%d items skipped)", af.failed, af.skipped)
+}
+
+// agentbinary finds the binary to push to a host: this one, or one built for
+// the host's OS and architecture by khan build --target, sitting next to it.
+func agentbinary(rh rio.Host) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	info, err := rh.Info()
+	if err != nil {
+		return "", err
+	}
+	if info.OS == runtime.GOOS && info.Arch == runtime.GOARCH {
+		return exe, nil
+	}
+	variant := exe + "-" + info.OS + "-" + info.Arch
+	if _, err := os.Stat(variant); err != nil {
+		return "", fmt.Errorf("No %s/%s build to push (khan build --target %s/%s makes %s): %w", info.OS, info.Arch, info.OS, info.Arch, variant, err)
+	}
+	return variant, nil
+}
+
+// pushagent copies the agent to the host's temp dir, which goes away with
+// the host's Cleanup.
+func pushagent(rh rio.Host, exe string) (string, error) {
+	src, err := os.Open(exe)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	fpath, err := rh.TmpFile()
+	if err != nil {
+		return "", err
+	}
+	dst, err := rh.Create(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+	if err := rh.Chmod(fpath, 0700); err != nil {
+		return "", err
+	}
+	return fpath, nil
+}
+
+// runagent runs the whole configuration on a host through a push agent. It
+// returns *agentfailures if any items failed.
+func (r *Run) runagent(host *Host) error {
+	exe, err := agentbinary(host.rh)
+	if err != nil {
+		return err
+	}
+	fpath, err := pushagent(host.rh, exe)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"--local", "--agent", host.Name}
+	if r.Dry {
+		args = append(args, "--dry")
+	}
+	if r.Diff {
+		args = append(args, "--diff")
+	}
+	if r.Verbose {
+		args = append(args, "--verbose")
+	}
+	sel := r.Selection
+	if len(sel.Tags) > 0 {
+		args = append(args, "--tags", strings.Join(sel.Tags, ","))
+	}
+	if len(sel.SkipTags) > 0 {
+		args = append(args, "--skip-tags", strings.Join(sel.SkipTags, ","))
+	}
+	if len(sel.Only) > 0 {
+		args = append(args, "--only", strings.Join(sel.Only, ","))
+	}
+	if sel.NoDeps {
+		args = append(args, "--no-deps")
+	}
+
+	pr, pw := io.Pipe()
+	stderr := &linewriter{prefix: host.String() + " "}
+	cmd := rio.Command(context.Background(), fpath, args...)
+	cmd.Stdout = pw
+	cmd.Stderr = stderr
+	go func() {
+		pw.CloseWithError(host.rh.Exec(cmd))
+	}()
+
+	af := &agentfailures{}
+	done := false
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		ev := &agentevent{}
+		if err := json.Unmarshal(scanner.Bytes(), ev); err != nil {
+			// not from the agent itself, so just show it
+			fmt.Println(host, scanner.Text())
+			continue
+		}
+		if ev.Done {
+			done = true
+			af.failed, af.skipped = ev.Failed, ev.Skipped
+			continue
+		}
+		var itemerr error
+		if ev.Error != "" {
+			itemerr = errors.New(ev.Error)
+			af.errs = append(af.errs, itemerr)
+		}
+		r.out.finish(ev.Duration, r, ev.Type, ev.Item, ev.Status, itemerr)
+	}
+	err = scanner.Err()
+	// drain whatever is left, so the command can finish
+	_, _ = io.Copy(ioutil.Discard, pr)
+	stderr.flush()
+
+	if !done {
+		if err == nil {
+			err = fmt.Errorf("Exited without finishing")
+		}
+		return fmt.Errorf("Push agent on %s: %w", host.Name, err)
+	}
+	if af.failed > 0 || af.skipped > 0 {
+		return af
+	}
+	return nil
+}
+
+// linewriter prints whole lines as they come, each with a prefix
+type linewriter struct {
+	prefix string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (lw *linewriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lw.buf = append(lw.buf, p...)
+	for {
+		nl := bytes.IndexByte(lw.buf, '\n')
+		if nl == -1 {
+			break
+		}
+		fmt.Println(lw.prefix + strings.TrimRight(string(lw.buf[:nl]), "\r"))
+		lw.buf = lw.buf[nl+1:]
+	}
+	return len(p), nil
+}
+
+func (lw *linewriter) flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if len(lw.buf) > 0 {
+		fmt.Println(lw.prefix + string(lw.buf))
+		lw.buf = nil
+	}
+}
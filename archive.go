@@ -0,0 +1,690 @@
+package khan
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"khan.rip/rio"
+	"khan.rip/rio/util"
+)
+
+// Archive extracts a tar or zip file into a directory with tar on the host.
+// Bundled archives are sent over already stripped and checked, so that's all
+// they need. Local ones are extracted where they are, and need unzip if
+// they're zip files. A marker file in the directory records a checksum of
+// what was extracted, so it only happens again when the archive changes.
+type Archive struct {
+	Path string `khan:"path,shortkey"`
+
+	// Src is a path on the configurer for the archive. It will be bundled
+	// into your khan build output.
+	Src string `khan:"src,shortvalue"`
+
+	// Local is a path on the configuree for the archive
+	Local string
+
+	// Format is "tar", "tar.gz", "tar.bz2" or "zip". If blank, it is
+	// guessed from the archive's file name.
+	Format string
+
+	// Strip removes this many leading directories from the paths in the
+	// archive, like tar --strip-components.
+	Strip int
+
+	// Ownership of everything extracted. Modes come from the archive.
+	User  string
+	Group string
+
+	Meta
+
+	id int
+}
+
+func (a *Archive) String() string {
+	return a.Path
+}
+
+func (a *Archive) SetID(id int) {
+	a.id = id
+}
+func (a *Archive) ID() int {
+	return a.id
+}
+func (a *Archive) Clone() Item {
+	r := *a
+	r.id = 0
+	return &r
+}
+
+func (a *Archive) Validate() error {
+	if a.Path == "" {
+		return errors.New("Archive path is required")
+	}
+	if !path.IsAbs(a.Path) {
+		return fmt.Errorf("Archive path %#v must be absolute", a.Path)
+	}
+	if (a.Src == "") == (a.Local == "") {
+		return fmt.Errorf("Archive %#v needs exactly one of src or local", a.Path)
+	}
+	if a.Strip < 0 {
+		return fmt.Errorf("Archive %#v strip must not be negative", a.Path)
+	}
+	format, err := a.format()
+	if err != nil {
+		return err
+	}
+	if a.Local != "" && format == "zip" && a.Strip > 0 {
+		return fmt.Errorf("Archive %#v can't strip a local zip file, unzip has no way to", a.Path)
+	}
+	return nil
+}
+
+func (a *Archive) StaticFiles() []string {
+	if a.Src != "" {
+		return []string{a.Src}
+	}
+	return nil
+}
+
+func (a *Archive) source() string {
+	if a.Src != "" {
+		return a.Src
+	}
+	return a.Local
+}
+
+func (a *Archive) format() (string, error) {
+	format := a.Format
+	if format == "" {
+		name := strings.ToLower(a.source())
+		switch {
+		case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+			format = "tar.gz"
+		case strings.HasSuffix(name, ".tar.bz2"), strings.HasSuffix(name, ".tbz2"):
+			format = "tar.bz2"
+		case strings.HasSuffix(name, ".tar"):
+			format = "tar"
+		case strings.HasSuffix(name, ".zip"):
+			format = "zip"
+		default:
+			return "", fmt.Errorf("Archive %#v needs a format (tar, tar.gz, tar.bz2 or zip)", a.Path)
+		}
+	}
+	switch format {
+	case "tar", "tar.gz", "tar.bz2", "zip":
+		return format, nil
+	case "tgz":
+		return "tar.gz", nil
+	}
+	return "", fmt.Errorf("Archive %#v has unknown format %#v", a.Path, a.Format)
+}
+
+// marker is where the checksum of the extracted archive is kept
+func (a *Archive) marker() string {
+	return path.Join(a.Path, ".khan-archive-"+path.Base(a.source()))
+}
+
+func (a *Archive) After() []string {
+	afters := parentpaths(a.Path)
+	afters = append(afters, "path:"+path.Clean(a.Path))
+	if a.Local != "" {
+		afters = append(afters, "path:"+a.Local)
+	}
+	if a.User != "" {
+		afters = append(afters, "user:"+a.User)
+	}
+	if a.Group != "" {
+		afters = append(afters, "group:"+a.Group)
+	}
+	return afters
+}
+func (a *Archive) Before() []string {
+	return nil
+}
+func (a *Archive) Provides() []string {
+	return []string{"archive:" + path.Clean(a.Path) + ":" + a.source()}
+}
+
+func (a *Archive) editpath() string {
+	return a.Path
+}
+
+func (a *Archive) Apply(host *Host) (itemStatus, error) {
+	format, err := a.format()
+	if err != nil {
+		return 0, err
+	}
+
+	var hash string
+	if a.Local != "" {
+		hash, err = host.rh.Hash(a.Local)
+	} else {
+		var fh io.ReadCloser
+		if fh, err = host.Run.assetfn(a.Src); err == nil {
+			hash, err = util.HashReader(fh)
+			fh.Close()
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sum := fmt.Sprintf("%s strip %d\n", hash, a.Strip)
+
+	dst := path.Clean(a.Path)
+	status := itemModified
+
+	if _, err := host.rh.Stat(dst); err != nil {
+		if !iserrnotfound(err) {
+			return 0, err
+		}
+		status = itemCreated
+	} else {
+		old, err := host.rh.ReadFile(a.marker())
+		if err == nil && string(old) == sum {
+			return itemUnchanged, nil
+		}
+		if err != nil && !iserrnotfound(err) {
+			return 0, err
+		}
+	}
+
+	uid, gid, err := resolveowner(host, a, a.User, a.Group)
+	if err != nil {
+		return 0, err
+	}
+
+	x := &extraction{
+		dst:   dst,
+		strip: a.Strip,
+		uid:   uid,
+		gid:   gid,
+
+		old:   map[string]bool{},
+		links: map[string]bool{},
+		seen:  map[string]bool{},
+	}
+
+	if status == itemCreated {
+		if err := host.rh.Mkdir(dst, 0755); err != nil {
+			return 0, err
+		}
+		if _, err := applyperms(host, dst, uid, gid, 0755); err != nil {
+			return 0, err
+		}
+	} else if err := x.oldlinks(host); err != nil {
+		return 0, err
+	}
+
+	if a.Src != "" {
+		err = a.upload(host, x, format)
+	} else {
+		err = a.extractlocal(host, x, format)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := x.chown(host); err != nil {
+		return 0, err
+	}
+
+	err = writefile(host, a.marker(), strings.NewReader(sum), func(tmpfile string) error {
+		_, err := applyperms(host, tmpfile, uid, gid, 0644)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return status, nil
+}
+
+// upload sends a bundled archive to tar on the host in one go. khan reads it
+// first to strip and check the entries, and sends them on as a tar.gz, so
+// the host only needs tar whatever the archive's format is. The archive is
+// read twice, so nothing gets extracted if any of it is bad.
+func (a *Archive) upload(host *Host, x *extraction, format string) error {
+	if err := a.walk(host, x, format, nil); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		zw := gzip.NewWriter(pw)
+		tw := tar.NewWriter(zw)
+		y := &extraction{dst: x.dst, strip: x.strip, old: x.old, links: map[string]bool{}, seen: map[string]bool{}}
+		err := a.walk(host, y, format, func(hdr *tar.Header, r io.Reader) error {
+			hdr.Uid = int(x.uid)
+			hdr.Gid = int(x.gid)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				return nil
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	cmd := rio.Command(context.Background(), "tar", "-x", "-z", "-p", "-f", "-", "-C", x.dst)
+	cmd.Stdin = pr
+	errbuf := &bytes.Buffer{}
+	cmd.Stderr = errbuf
+	err := host.rh.Exec(cmd)
+
+	// a dry run never reads it
+	pr.Close()
+	if werr := <-done; werr != nil && werr != io.ErrClosedPipe {
+		return werr
+	}
+	if err != nil {
+		return &rio.CmdErr{Cmd: cmd, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+	}
+	return nil
+}
+
+// walk goes through a bundled archive, calling fn (if there is one) with
+// every entry that gets extracted. The headers fn gets are named relative to
+// the destination.
+func (a *Archive) walk(host *Host, x *extraction, format string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	if fn == nil {
+		fn = func(*tar.Header, io.Reader) error { return nil }
+	}
+
+	fh, err := host.Run.assetfn(a.Src)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	switch format {
+	case "zip":
+		return unzip(x, fh, fn)
+	case "tar.gz":
+		zr, err := gzip.NewReader(fh)
+		if err != nil {
+			return err
+		}
+		return untar(x, zr, fn)
+	case "tar.bz2":
+		return untar(x, bzip2.NewReader(fh), fn)
+	}
+	return untar(x, fh, fn)
+}
+
+func untar(x *extraction, r io.Reader, fn func(hdr *tar.Header, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+		default:
+			// devices, fifos, etc. have no business in a release tarball
+			continue
+		}
+
+		fpath, ok, err := x.entrypath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		out := &tar.Header{
+			Typeflag: hdr.Typeflag,
+			Name:     x.rel(fpath),
+			Mode:     hdr.Mode & int64(util.S_justmode),
+			ModTime:  hdr.ModTime,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			out.Name += "/"
+		case tar.TypeReg:
+			out.Size = hdr.Size
+		case tar.TypeSymlink:
+			out.Linkname = hdr.Linkname
+		case tar.TypeLink:
+			target, ok, err := x.entrypath(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			out.Linkname = x.rel(target)
+		}
+
+		if err := x.add(fpath, out.Typeflag); err != nil {
+			return err
+		}
+		if err := fn(out, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// zipfile is what zip needs to read an archive
+type zipfile interface {
+	io.ReaderAt
+	Size() int64
+}
+
+func unzip(x *extraction, r io.Reader, fn func(hdr *tar.Header, r io.Reader) error) error {
+	// Zip needs random access. Bundled archives have it, anything else
+	// gets spooled to a temp file here first.
+	ra, ok := r.(zipfile)
+	if !ok {
+		tmp, err := ioutil.TempFile("", "khan_zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		size, err := io.Copy(tmp, r)
+		if err != nil {
+			return err
+		}
+		ra = io.NewSectionReader(tmp, 0, size)
+	}
+
+	zr, err := zip.NewReader(ra, ra.Size())
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		fpath, ok, err := x.entrypath(zf.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		mode := zf.Mode()
+		out := &tar.Header{
+			Name:    x.rel(fpath),
+			Mode:    int64(mode & util.S_justmode),
+			ModTime: zf.Modified,
+		}
+		switch {
+		case mode.IsDir():
+			out.Typeflag = tar.TypeDir
+			out.Name += "/"
+		case mode&os.ModeSymlink != 0:
+			target, err := readzip(zf)
+			if err != nil {
+				return err
+			}
+			out.Typeflag = tar.TypeSymlink
+			out.Linkname = string(target)
+		case mode.IsRegular():
+			out.Typeflag = tar.TypeReg
+			out.Size = int64(zf.UncompressedSize64)
+		default:
+			continue
+		}
+
+		if err := x.add(fpath, out.Typeflag); err != nil {
+			return err
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(out, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readzip(zf *zip.File) ([]byte, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// extractlocal has tar or unzip on the host extract an archive that's
+// already there. It gets listed first, to check where everything goes.
+func (a *Archive) extractlocal(host *Host, x *extraction, format string) error {
+	info, err := host.rh.Info()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	list := rio.ReadOnlyCommand(ctx, "tar", "-t", "-f", a.Local)
+	extract := rio.Command(ctx, "tar", "-x", "-p", "-f", a.Local, "-C", x.dst)
+	switch format {
+	case "zip":
+		list = rio.ReadOnlyCommand(ctx, "unzip", "-Z1", a.Local)
+		extract = rio.Command(ctx, "unzip", "-o", "-q", a.Local, "-d", x.dst)
+	case "tar.gz":
+		list.Args = append(list.Args, "-z")
+		extract.Args = append(extract.Args, "-z")
+	case "tar.bz2":
+		list.Args = append(list.Args, "-j")
+		extract.Args = append(extract.Args, "-j")
+	}
+	if a.Strip > 0 && format != "zip" {
+		if info.OS == "openbsd" {
+			// OpenBSD's tar has no --strip-components, but it can rename
+			// entries, and skips the ones renamed to nothing
+			extract.Args = append(extract.Args, "-s", fmt.Sprintf(`,^\([^/]*/\)\{%d\},,`, a.Strip), "-s", ",.*,,")
+		} else {
+			extract.Args = append(extract.Args, "--strip-components", strconv.Itoa(a.Strip))
+		}
+	}
+
+	outbuf := &bytes.Buffer{}
+	errbuf := &bytes.Buffer{}
+	list.Stdout = outbuf
+	list.Stderr = errbuf
+	if err := host.rh.Exec(list); err != nil {
+		return &rio.CmdErr{Cmd: list, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+	}
+
+	// Only the names get checked here. Keeping an archive from writing
+	// through a symlink it makes itself is left to tar.
+	for _, name := range strings.Split(outbuf.String(), "\n") {
+		if name == "" {
+			continue
+		}
+		if format != "zip" {
+			name = untarname(name)
+		}
+		fpath, ok, err := x.entrypath(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		var typ byte = tar.TypeReg
+		if strings.HasSuffix(name, "/") {
+			typ = tar.TypeDir
+		}
+		if err := x.add(fpath, typ); err != nil {
+			return err
+		}
+	}
+
+	errbuf.Reset()
+	extract.Stderr = errbuf
+	if err := host.rh.Exec(extract); err != nil {
+		return &rio.CmdErr{Cmd: extract, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+	}
+	return nil
+}
+
+// untarname undoes the escaping GNU tar does to unusual characters in the
+// names it lists
+func untarname(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = s[i]; c {
+		case 'a':
+			c = '\a'
+		case 'b':
+			c = '\b'
+		case 'f':
+			c = '\f'
+		case 'n':
+			c = '\n'
+		case 'r':
+			c = '\r'
+		case 't':
+			c = '\t'
+		case 'v':
+			c = '\v'
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			c -= '0'
+			for j := 0; j < 2 && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '7'; j++ {
+				i++
+				c = c*8 + s[i] - '0'
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// extraction keeps track of where an archive's entries go
+type extraction struct {
+	dst   string
+	strip int
+	uid   uint32
+	gid   uint32
+
+	old   map[string]bool // symlinks in dst before extracting
+	links map[string]bool // symlinks from the archive
+	seen  map[string]bool
+	paths []string // everything extracted, and the directories it needs
+}
+
+// oldlinks finds the symlinks already in the destination, like ones left by
+// extracting an earlier version, since they could point anywhere
+func (x *extraction) oldlinks(host *Host) error {
+	outbuf := &bytes.Buffer{}
+	errbuf := &bytes.Buffer{}
+	cmd := rio.ReadOnlyCommand(context.Background(), "find", x.dst, "-type", "l")
+	cmd.Stdout = outbuf
+	cmd.Stderr = errbuf
+	if err := host.rh.Exec(cmd); err != nil {
+		return &rio.CmdErr{Cmd: cmd, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+	}
+	for _, line := range strings.Split(outbuf.String(), "\n") {
+		if line != "" {
+			x.old[path.Clean(line)] = true
+		}
+	}
+	return nil
+}
+
+// entrypath works out where an archive entry goes. Entries that end up empty
+// after stripping are skipped, and entries that would land outside of the
+// destination are an error.
+func (x *extraction) entrypath(name string) (string, bool, error) {
+	clean := path.Clean("/" + name)
+	if strings.Contains("/"+name+"/", "/../") {
+		return "", false, fmt.Errorf("Archive entry %#v is outside of the destination", name)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(clean, "/"), "/")
+	if len(parts) <= x.strip || clean == "/" {
+		return "", false, nil
+	}
+	fpath := path.Join(x.dst, strings.Join(parts[x.strip:], "/"))
+
+	// Don't let an archive write through a symlink
+	for dir := path.Dir(fpath); dir != x.dst && dir != "/"; dir = path.Dir(dir) {
+		if x.old[dir] || x.links[dir] {
+			return "", false, fmt.Errorf("Archive entry %#v is inside of symlink %#v", name, dir)
+		}
+	}
+	return fpath, true, nil
+}
+
+// add records an entry that's going to be extracted to fpath
+func (x *extraction) add(fpath string, typ byte) error {
+	switch typ {
+	case tar.TypeDir:
+		// tar would set the permissions of wherever the link points
+		if x.old[fpath] || x.links[fpath] {
+			return fmt.Errorf("%#v is a symlink, so nothing is extracted through it", fpath)
+		}
+	case tar.TypeSymlink:
+		x.links[fpath] = true
+	}
+	for p := fpath; p != x.dst && p != "/" && !x.seen[p]; p = path.Dir(p) {
+		x.seen[p] = true
+		x.paths = append(x.paths, p)
+	}
+	return nil
+}
+
+// rel is fpath relative to the destination
+func (x *extraction) rel(fpath string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(fpath, x.dst), "/")
+}
+
+// chown gives everything extracted to the archive's owner, along with the
+// directories tar made for it
+func (x *extraction) chown(host *Host) error {
+	if len(x.paths) == 0 {
+		return nil
+	}
+	cmd := rio.Command(context.Background(), "xargs", "-0", "chown", "-h", fmt.Sprintf("%d:%d", x.uid, x.gid))
+	cmd.Stdin = strings.NewReader(strings.Join(x.paths, "\x00"))
+	errbuf := &bytes.Buffer{}
+	cmd.Stderr = errbuf
+	if err := host.rh.Exec(cmd); err != nil {
+		return &rio.CmdErr{Cmd: cmd, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+	}
+	return nil
+}
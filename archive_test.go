@@ -0,0 +1,275 @@
+package khan
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"khan.rip/rio/local"
+)
+
+func TestArchiveEntrypath(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip int
+		links []string
+		want  string // blank to skip it
+		err   bool
+	}{
+		{"a/b", 0, nil, "/dst/a/b", false},
+		{"./a/b/", 0, nil, "/dst/a/b", false},
+		{"/a/b", 0, nil, "/dst/a/b", false},
+		{"a//b", 0, nil, "/dst/a/b", false},
+		{".", 0, nil, "", false},
+		{"app-1.0/bin/app", 1, nil, "/dst/bin/app", false},
+		{"app-1.0/", 1, nil, "", false},
+		{"app-1.0/bin/app", 2, nil, "/dst/app", false},
+		{"app-1.0/bin/app", 3, nil, "", false},
+		{"../etc/passwd", 0, nil, "", true},
+		{"a/../../etc/passwd", 0, nil, "", true},
+		{"a/../b", 0, nil, "", true},
+		{"app-1.0/../etc/passwd", 1, nil, "", true},
+		{"a..b/c", 0, nil, "/dst/a..b/c", false},
+		{"link/passwd", 0, []string{"/dst/link"}, "", true},
+		{"a/link/b/c", 0, []string{"/dst/a/link"}, "", true},
+		{"link", 0, []string{"/dst/link"}, "/dst/link", false},
+		{"linked/x", 0, []string{"/dst/link"}, "/dst/linked/x", false},
+	}
+	for _, test := range tests {
+		x := &extraction{dst: "/dst", strip: test.strip, old: map[string]bool{}, links: map[string]bool{}}
+		for _, l := range test.links {
+			x.links[l] = true
+		}
+		got, ok, err := x.entrypath(test.name)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%#v (strip %d): no error, got %#v", test.name, test.strip, got)
+		case !test.err && err != nil:
+			t.Errorf("%#v (strip %d): %v", test.name, test.strip, err)
+		case !test.err && (got != test.want || ok != (test.want != "")):
+			t.Errorf("%#v (strip %d): got %#v %v, want %#v", test.name, test.strip, got, ok, test.want)
+		}
+	}
+}
+
+func TestUntarname(t *testing.T) {
+	for name, want := range map[string]string{
+		`a/b`:              "a/b",
+		`caf\303\251`:      "café",
+		`new\nline\ttab`:   "new\nline\ttab",
+		`back\\slash`:      `back\slash`,
+		`trailing\`:        `trailing\`,
+		`\0010`:            "\x010",
+		`"quoted" name\?`:  `"quoted" name?`,
+		`dir/with space/x`: "dir/with space/x",
+	} {
+		if got := untarname(name); got != want {
+			t.Errorf("%#v: got %#v, want %#v", name, got, want)
+		}
+	}
+}
+
+// testentry is a file for writetar and writezip to put in an archive
+type testentry struct {
+	name string
+	typ  byte
+	body string // or what a link points to
+}
+
+var testentries = []testentry{
+	{"app-1.0/", tar.TypeDir, ""},
+	{"app-1.0/bin/app", tar.TypeReg, "#!/bin/sh\n"},
+	{"app-1.0/README", tar.TypeReg, "hi\n"},
+	{"app-1.0/bin/current", tar.TypeSymlink, "app"},
+}
+
+func writetar(t *testing.T, fpath string, entries []testentry) {
+	t.Helper()
+	fh, err := os.Create(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	zw := gzip.NewWriter(fh)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Mode: 0644, ModTime: time.Now()}
+		switch e.typ {
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		case tar.TypeReg:
+			hdr.Mode = 0755
+			hdr.Size = int64(len(e.body))
+		default:
+			hdr.Linkname = e.body
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typ == tar.TypeReg {
+			if _, err := io.WriteString(tw, e.body); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writezip(t *testing.T, fpath string, entries []testentry) {
+	t.Helper()
+	fh, err := os.Create(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	zw := zip.NewWriter(fh)
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		switch e.typ {
+		case tar.TypeDir:
+			fh.SetMode(os.ModeDir | 0755)
+		case tar.TypeReg:
+			fh.SetMode(0755)
+		default:
+			fh.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archivetest applies an Archive made by setup on the local host, in a temp
+// dir that it's given
+func archivetest(t *testing.T, setup func(tmp string) *Archive) (string, itemStatus, itemStatus, error) {
+	t.Helper()
+	tmp, err := ioutil.TempDir("", "khan_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := setup(tmp)
+
+	defer quiet(t)()
+	rh := local.New()
+	defer rh.Cleanup()
+	r := newtestrun(rh)
+	r.assetfn = func(name string) (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+
+	first, err := a.Apply(r.Hosts[0])
+	if err != nil {
+		return tmp, first, 0, err
+	}
+	again, err := a.Apply(r.Hosts[0])
+	return tmp, first, again, err
+}
+
+func TestArchiveApply(t *testing.T) {
+	tests := map[string]func(tmp string) *Archive{
+		"src tar.gz": func(tmp string) *Archive {
+			writetar(t, filepath.Join(tmp, "app.tar.gz"), testentries)
+			return &Archive{Path: filepath.Join(tmp, "dst"), Src: filepath.Join(tmp, "app.tar.gz"), Strip: 1}
+		},
+		"src zip": func(tmp string) *Archive {
+			writezip(t, filepath.Join(tmp, "app.zip"), testentries)
+			return &Archive{Path: filepath.Join(tmp, "dst"), Src: filepath.Join(tmp, "app.zip"), Strip: 1}
+		},
+		"local tar.gz": func(tmp string) *Archive {
+			writetar(t, filepath.Join(tmp, "app.tar.gz"), testentries)
+			return &Archive{Path: filepath.Join(tmp, "dst"), Local: filepath.Join(tmp, "app.tar.gz"), Strip: 1}
+		},
+	}
+	for name, setup := range tests {
+		tmp, first, again, err := archivetest(t, setup)
+		defer os.RemoveAll(tmp)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if first != itemCreated || again != itemUnchanged {
+			t.Errorf("%s: %v then %v", name, first, again)
+		}
+
+		dst := filepath.Join(tmp, "dst")
+		if b, err := ioutil.ReadFile(filepath.Join(dst, "README")); err != nil || string(b) != "hi\n" {
+			t.Errorf("%s: README is %#v (%v)", name, string(b), err)
+		}
+		if fi, err := os.Stat(filepath.Join(dst, "bin", "app")); err != nil || fi.Mode().Perm() != 0755 {
+			t.Errorf("%s: bin/app is %v (%v)", name, fi, err)
+		}
+		if target, err := os.Readlink(filepath.Join(dst, "bin", "current")); err != nil || target != "app" {
+			t.Errorf("%s: bin/current points to %#v (%v)", name, target, err)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "app-1.0")); err == nil {
+			t.Errorf("%s: didn't strip app-1.0", name)
+		}
+	}
+}
+
+// An old symlink in the destination could point anywhere, so nothing can be
+// extracted through it
+func TestArchiveThroughOldSymlink(t *testing.T) {
+	for _, local := range []bool{false, true} {
+		for _, entry := range []testentry{
+			{"dir/passwd", tar.TypeReg, "x"},
+			{"dir/sub/", tar.TypeDir, ""},
+			{"dir/", tar.TypeDir, ""},
+		} {
+			var outside string
+			tmp, _, _, err := archivetest(t, func(tmp string) *Archive {
+				dst := filepath.Join(tmp, "dst")
+				outside = filepath.Join(tmp, "outside")
+				for _, dir := range []string{dst, outside} {
+					if err := os.Mkdir(dir, 0755); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// left by extracting the previous version
+				if err := os.Symlink(outside, filepath.Join(dst, "dir")); err != nil {
+					t.Fatal(err)
+				}
+
+				fpath := filepath.Join(tmp, "app.tar.gz")
+				writetar(t, fpath, []testentry{entry})
+				if local {
+					return &Archive{Path: dst, Local: fpath}
+				}
+				return &Archive{Path: dst, Src: fpath}
+			})
+			defer os.RemoveAll(tmp)
+			if err == nil {
+				t.Errorf("%s (local %v): no error", entry.name, local)
+			}
+
+			fis, err := ioutil.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fis) != 0 {
+				t.Errorf("%s (local %v): extracted %d files outside of the destination", entry.name, local, len(fis))
+			}
+			if fi, err := os.Stat(outside); err != nil || fi.Mode().Perm() != 0755 {
+				t.Errorf("%s (local %v): directory outside of the destination changed to %v (%v)", entry.name, local, fi.Mode(), err)
+			}
+		}
+	}
+}
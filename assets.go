@@ -14,6 +14,19 @@ func SetAssetLoader(fn func(string) (io.ReadCloser, error)) {
 	mainassetfn = fn
 }
 
+// Directories of files (File with a Src that is a directory) need these too,
+// to find out what is in the directory and what modes the files have.
+var mainassetdirfn func(string) ([]string, error)
+var mainassetinfofn func(string) (os.FileInfo, error)
+
+func SetAssetDirLoader(fn func(string) ([]string, error)) {
+	mainassetdirfn = fn
+}
+
+func SetAssetInfoLoader(fn func(string) (os.FileInfo, error)) {
+	mainassetinfofn = fn
+}
+
 func dummyassetfn(_ string) (io.ReadCloser, error) {
 	_ = bytes.NewReader
 	return nil, os.ErrNotExist
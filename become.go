@@ -0,0 +1,67 @@
+package khan
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"khan.rip/rio"
+)
+
+// The sudo password can come from the environment too
+const becomePasswordEnv = "KHAN_BECOME_PASSWORD"
+
+// Only one host at a time gets to ask for a password
+var becomepromptmu sync.Mutex
+
+// newbecome makes the become settings for one host. name is only used to
+// say which host is asking for a password.
+func newbecome(method, user, name string) *rio.Become {
+	b := &rio.Become{
+		Method: method,
+		User:   user,
+	}
+	b.Password = func() (string, error) {
+		if v, ok := os.LookupEnv(becomePasswordEnv); ok {
+			return v, nil
+		}
+		becomepromptmu.Lock()
+		defer becomepromptmu.Unlock()
+		password, err := readtty(fmt.Sprintf("[sudo] password on %s: ", name), false)
+		if err != nil {
+			return "", fmt.Errorf("Can't ask for the sudo password on %s (set %s): %w", name, becomePasswordEnv, err)
+		}
+		return password, nil
+	}
+	return b
+}
+
+// dryids guesses the uid and gid that files would end up owned by, for the
+// dry run host. user is who commands actually run as.
+func dryids(rh rio.Host, user string, become bool) (uint32, uint32, error) {
+	if user == "root" {
+		return 0, 0, nil
+	}
+	if !become {
+		// This uid/gid guess is incorrect. TODO: Concurrently SSH to all the hosts and
+		// get this info correctly. This could double-serve as a pool warmup :)
+		return uint32(os.Geteuid()), uint32(os.Getegid()), nil
+	}
+
+	// Somebody else entirely, so ask the host
+	u, err := rh.User(user)
+	if err != nil {
+		return 0, 0, err
+	}
+	if u == nil {
+		return 0, 0, fmt.Errorf("Can't become %#v: No such user", user)
+	}
+	g, err := rh.Group(u.Group)
+	if err != nil {
+		return 0, 0, err
+	}
+	if g == nil {
+		return 0, 0, fmt.Errorf("Can't become %#v: No group %#v", user, u.Group)
+	}
+	return u.Uid, g.Gid, nil
+}
@@ -0,0 +1,139 @@
+package khan
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const defaultBlockMarker = "# {mark} KHAN MANAGED BLOCK"
+
+// BlockInFile makes sure a block of lines is in a file, between a pair of
+// marker lines, without managing the rest of it. Other BlockInFile and
+// LineInFile items can edit the same file.
+type BlockInFile struct {
+	Path  string `khan:"path,shortkey"`
+	Block string `khan:"block,shortvalue"`
+
+	// Marker is the line put before and after the block, with "{mark}"
+	// replaced by BEGIN and END. Each block in a file needs its own marker.
+	// Defaults to "# {mark} KHAN MANAGED BLOCK".
+	Marker string
+
+	// Delete removes the block and its markers.
+	Delete bool
+
+	// Create the file if it doesn't exist, with this ownership and mode.
+	// Existing files keep theirs.
+	Create bool
+	User   string
+	Group  string
+	Mode   os.FileMode
+
+	Meta
+
+	id int
+}
+
+func (b *BlockInFile) String() string {
+	return b.Path + ": " + b.marker()
+}
+
+func (b *BlockInFile) SetID(id int) {
+	b.id = id
+}
+func (b *BlockInFile) ID() int {
+	return b.id
+}
+func (b *BlockInFile) Clone() Item {
+	r := *b
+	r.id = 0
+	return &r
+}
+
+func (b *BlockInFile) Validate() error {
+	if b.Path == "" {
+		return errors.New("BlockInFile path is required")
+	}
+	if !strings.Contains(b.marker(), "{mark}") {
+		return fmt.Errorf("BlockInFile %#v marker %#v must contain {mark}", b.Path, b.Marker)
+	}
+	return nil
+}
+
+func (b *BlockInFile) marker() string {
+	if b.Marker == "" {
+		return defaultBlockMarker
+	}
+	return b.Marker
+}
+
+func (b *BlockInFile) After() []string {
+	afters := parentpaths(b.Path)
+	afters = append(afters, "path:"+path.Clean(b.Path))
+	if b.Create && b.User != "" {
+		afters = append(afters, "user:"+b.User)
+	}
+	if b.Create && b.Group != "" {
+		afters = append(afters, "group:"+b.Group)
+	}
+	return afters
+}
+func (b *BlockInFile) Before() []string {
+	return nil
+}
+func (b *BlockInFile) editpath() string {
+	return b.Path
+}
+func (b *BlockInFile) Provides() []string {
+	return []string{"blockinfile:" + path.Clean(b.Path) + ":" + b.marker()}
+}
+
+func (b *BlockInFile) Apply(host *Host) (itemStatus, error) {
+	begin := strings.Replace(b.marker(), "{mark}", "BEGIN", -1)
+	end := strings.Replace(b.marker(), "{mark}", "END", -1)
+
+	var block []string
+	if !b.Delete {
+		block = append(block, begin)
+		if b.Block != "" {
+			block = append(block, strings.Split(strings.TrimSuffix(b.Block, "\n"), "\n")...)
+		}
+		block = append(block, end)
+	}
+
+	return editfile(host, b, path.Clean(b.Path), b.Create, b.User, b.Group, b.Mode, editlines(func(lines []string) ([]string, error) {
+		first, last := -1, -1
+		for i, line := range lines {
+			switch line {
+			case begin:
+				if first != -1 {
+					return nil, fmt.Errorf("%#v has more than one %#v", b.Path, begin)
+				}
+				first = i
+			case end:
+				if last != -1 {
+					return nil, fmt.Errorf("%#v has more than one %#v", b.Path, end)
+				}
+				last = i
+			}
+		}
+
+		if first == -1 && last == -1 {
+			return append(lines, block...), nil
+		}
+		// Guessing where the block ends could eat what's after it
+		if last == -1 {
+			return nil, fmt.Errorf("%#v has %#v without %#v after it", b.Path, begin, end)
+		}
+		if first == -1 || last < first {
+			return nil, fmt.Errorf("%#v has %#v without %#v before it", b.Path, end, begin)
+		}
+
+		edited := append([]string{}, lines[:first]...)
+		edited = append(edited, block...)
+		return append(edited, lines[last+1:]...), nil
+	}))
+}
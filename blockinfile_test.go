@@ -0,0 +1,56 @@
+package khan
+
+import (
+	"testing"
+)
+
+const (
+	testbegin = "# BEGIN KHAN MANAGED BLOCK\n"
+	testend   = "# END KHAN MANAGED BLOCK\n"
+)
+
+func TestBlockInFile(t *testing.T) {
+	tests := map[string]struct {
+		item    BlockInFile
+		content string
+		want    string
+	}{
+		"add":          {BlockInFile{Block: "x\ny"}, "a\n", "a\n" + testbegin + "x\ny\n" + testend},
+		"add to empty": {BlockInFile{Block: "x\n"}, "", testbegin + "x\n" + testend},
+		"replace":      {BlockInFile{Block: "x"}, "a\n" + testbegin + "old\nold\n" + testend + "b\n", "a\n" + testbegin + "x\n" + testend + "b\n"},
+		"empty block":  {BlockInFile{}, "a\n" + testbegin + "old\n" + testend, "a\n" + testbegin + testend},
+		"delete":       {BlockInFile{Delete: true}, "a\n" + testbegin + "old\n" + testend + "b\n", "a\nb\n"},
+		"marker":       {BlockInFile{Block: "x", Marker: "// {mark} mine"}, "a\n", "a\n// BEGIN mine\nx\n// END mine\n"},
+		"other marker": {BlockInFile{Block: "x", Marker: "# {mark} mine"}, testbegin + "old\n" + testend, testbegin + "old\n" + testend + "# BEGIN mine\nx\n# END mine\n"},
+	}
+	for name, test := range tests {
+		b := test.item
+		got, _, err := edittest(t, &b, &b.Path, test.content)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %#v, want %#v", name, got, test.want)
+		}
+	}
+}
+
+// Files where the markers don't pair up are left alone, since there's no
+// telling which part is the block
+func TestBlockInFileBadMarkers(t *testing.T) {
+	for _, content := range []string{
+		testbegin + "a\n",
+		"a\n" + testend,
+		testend + testbegin,
+		testbegin + testbegin + testend,
+		testbegin + testend + testend,
+	} {
+		b := &BlockInFile{Block: "x"}
+		got, _, err := edittest(t, b, &b.Path, content)
+		if err == nil {
+			t.Errorf("%#v: no error", content)
+		}
+		if got != content {
+			t.Errorf("%#v: changed to %#v", content, got)
+		}
+	}
+}
@@ -11,16 +11,56 @@ import (
 	"sort"
 	"strings"
 
+	"khan.rip"
+
 	"github.com/go-bindata/go-bindata/v3"
+	"github.com/spf13/pflag"
 )
 
 type buildrun struct {
 	staticfiles []string
 	wd          string
 	cwd         string
+
+	// inventory is empty if there is no inventory file
+	inventory *khan.Inventory
+}
+
+// target is a platform to cross compile for, like linux/arm64
+type target struct {
+	goos   string
+	goarch string
+}
+
+// suffix goes on the end of the binary's name. Push mode looks for the
+// same names.
+func (t target) suffix() string {
+	return "-" + t.goos + "-" + t.goarch
+}
+
+func parsetargets(list []string) ([]target, error) {
+	var targets []target
+	for _, t := range list {
+		parts := strings.Split(t, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Bad target %#v (use os/arch, like linux/arm64)", t)
+		}
+		targets = append(targets, target{goos: parts[0], goarch: parts[1]})
+	}
+	return targets, nil
 }
 
 func build() error {
+	fs := pflag.NewFlagSet("build", pflag.ContinueOnError)
+	var targetlist []string
+	fs.StringSliceVar(&targetlist, "target", nil, "Also build for these platforms (os/arch, comma separated or repeated), for pushing to hosts")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+	targets, err := parsetargets(targetlist)
+	if err != nil {
+		return err
+	}
 
 	describe := "unknown"
 
@@ -92,9 +132,25 @@ func build() error {
 	matches = append(matches, matches2...)
 	sort.Strings(matches)
 
+	// The inventory isn't items, but it's read first so items can be
+	// checked against it.
+	inventory := ""
+	br.inventory = &khan.Inventory{}
+	if buf, err := ioutil.ReadFile(khan.InventoryFile); err == nil {
+		inventory = string(buf)
+		if br.inventory, err = khan.ParseInventory(buf); err != nil {
+			return fmt.Errorf("%s: %w", khan.InventoryFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
 	assetfs := false
 
 	for _, match := range matches {
+		if match == khan.InventoryFile {
+			continue
+		}
 		base := filepath.Base(match)
 		goname := base + ".go"
 		if err := br.yaml2go(wd, match, wd+"/"+goname, &assetfs); err != nil {
@@ -105,6 +161,11 @@ func build() error {
 	bc := bindata.NewConfig()
 	bc.Output = br.wd + "/go_bindata_static_files.go"
 	bc.Package = "main"
+	// Uncompressed assets can be read straight out of the binary, instead
+	// of being unpacked into memory. Big artifacts are usually compressed
+	// already anyway.
+	bc.NoCompress = true
+	bc.NoMemCopy = true
 	staticfiledups := map[string]bool{}
 	if len(br.staticfiles) > 0 {
 		for _, file := range br.staticfiles {
@@ -113,9 +174,13 @@ func build() error {
 				continue
 			}
 			staticfiledups[file] = true
+			info, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
 			bc.Input = append(bc.Input, bindata.InputConfig{
 				Path:      file,
-				Recursive: false,
+				Recursive: info.IsDir(),
 			})
 		}
 		fmt.Println("Bundling", len(br.staticfiles), "static files ...")
@@ -132,6 +197,18 @@ func build() error {
 		}
 	}
 
+	// Host keys in a known_hosts file next to the yaml, and the inventory,
+	// are pinned into the binary.
+	pinned := ""
+	if buf, err := ioutil.ReadFile("known_hosts"); err == nil {
+		pinned = fmt.Sprintf("\t%s.SetKnownHosts(%#v)\n", khanpkgalias, string(buf))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if inventory != "" {
+		pinned += fmt.Sprintf("\t%s.SetInventory(%#v)\n", khanpkgalias, inventory)
+	}
+
 	if _, err := os.Stat(wd + "/main.go"); err != nil {
 		if err := ioutil.WriteFile(wd+"/main.go", []byte(fmt.Sprintf(`package main
 import (
@@ -144,7 +221,7 @@ import (
 )
 
 type fakecloser struct {
-	io.Reader
+	*bytes.Reader
 }
 func (fc fakecloser) Close() error {
 	return nil
@@ -162,13 +239,15 @@ func main() {
 	%s.SetSourcePrefix(%#v)
 	%s.SetDescribe(%#v)
 	%s.SetAssetLoader(assetfn)
-
+	%s.SetAssetDirLoader(AssetDir)
+	%s.SetAssetInfoLoader(AssetInfo)
+%s
 	if err := %s.Apply(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
-`, khanpkgalias, khanpkgname, khanpkgalias, title, khanpkgalias, wd, khanpkgalias, strings.TrimSpace(describe), khanpkgalias, khanpkgalias)), 0644); err != nil {
+`, khanpkgalias, khanpkgname, khanpkgalias, title, khanpkgalias, wd, khanpkgalias, strings.TrimSpace(describe), khanpkgalias, khanpkgalias, khanpkgalias, pinned, khanpkgalias)), 0644); err != nil {
 			return err
 		}
 	}
@@ -183,6 +262,20 @@ func main() {
 		return err
 	}
 
+	// Every target shares the workspace, and go's build cache keeps each
+	// one's compiled packages, so only the first build for a target is slow.
+	for _, t := range targets {
+		fmt.Println("Cross compiling", outfile+t.suffix())
+		cmd := exec.Command("go", "build", "-o", cwd+"/"+outfile+t.suffix())
+		cmd.Env = append(os.Environ(), "GOOS="+t.goos, "GOARCH="+t.goarch, "CGO_ENABLED=0")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Dir = wd
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Building for %s/%s: %w", t.goos, t.goarch, err)
+		}
+	}
+
 	// Copy back out files that go often changes, but only if you had them in your original
 	// working directory. If you didn't have the file originally, you probably don't care.
 	for _, p := range copybacklist {
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -29,5 +30,19 @@ func clean() error {
 		}
 	}
 
+	// and anything from build --target
+	targets, err := filepath.Glob(outfile + "-*-*")
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if strings.Count(strings.TrimPrefix(t, outfile+"-"), "-") != 1 {
+			continue
+		}
+		if err := os.Remove(t); err != nil {
+			return err
+		}
+	}
+
 	return os.RemoveAll(wd)
 }
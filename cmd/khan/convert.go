@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"khan.rip"
 
@@ -45,9 +46,18 @@ func (err yamlerror) Error() string {
 type yamlhandler func(w *yamlwalker, v *yaml.Node) error
 
 var yamlhandlers = map[string]yamlhandler{
-	"file":  yamlsimplehandler(&khan.File{}),
-	"group": yamlsimplehandler(&khan.Group{}),
-	"user":  yamlsimplehandler(&khan.User{}),
+	"archive":     yamlsimplehandler(&khan.Archive{}),
+	"blockinfile": yamlsimplehandler(&khan.BlockInFile{}),
+	"configkey":   yamlsimplehandler(&khan.ConfigKey{}),
+	"directory":   yamlsimplehandler(&khan.Directory{}),
+	"exec":        yamlsimplehandler(&khan.Exec{}),
+	"file":        yamlsimplehandler(&khan.File{}),
+	"group":       yamlsimplehandler(&khan.Group{}),
+	"lineinfile":  yamlsimplehandler(&khan.LineInFile{}),
+	"link":        yamlsimplehandler(&khan.Link{}),
+	"package":     yamlsimplehandler(&khan.Package{}),
+	"service":     yamlsimplehandler(&khan.Service{}),
+	"user":        yamlsimplehandler(&khan.User{}),
 }
 
 func yamlkind(kind yaml.Kind) string {
@@ -252,10 +262,39 @@ func (br *buildrun) yaml2struct(w *yamlwalker, v *yaml.Node, si interface{}) err
 		shortvaluet reflect.StructField
 	)
 
+	// Fields of embedded structs (like khan.Meta) are promoted, so they are
+	// set in yaml just like the item's own fields. They can't be set that way
+	// in a Go composite literal though, so remember where they came from.
+	type structfield struct {
+		field reflect.Value
+		ft    reflect.StructField
+	}
+	var allfields []structfield
+	embedded := map[string]reflect.StructField{}
+	embeddedvals := map[string]reflect.Value{}
+
 	for i := 0; i < typ.NumField(); i++ {
 		field := val.Field(i)
 		ft := typ.Field(i)
 
+		if ft.Anonymous && ft.Type.Kind() == reflect.Struct {
+			for j := 0; j < ft.Type.NumField(); j++ {
+				eft := ft.Type.Field(j)
+				allfields = append(allfields, structfield{field.Field(j), eft})
+				embedded[eft.Name] = ft
+				embeddedvals[ft.Name] = field
+			}
+			continue
+		}
+		allfields = append(allfields, structfield{field, ft})
+	}
+
+	embeddedset := map[string]bool{}
+
+	for _, sf := range allfields {
+		field := sf.field
+		ft := sf.ft
+
 		key := strings.ToLower(ft.Name)
 
 		if tv, ok := ft.Tag.Lookup("khan"); ok {
@@ -384,6 +423,11 @@ func (br *buildrun) yaml2struct(w *yamlwalker, v *yaml.Node, si interface{}) err
 				return err
 			}
 
+			if e, ok := embedded[ft.Name]; ok {
+				embeddedset[e.Name] = true
+				continue
+			}
+
 			*w.gobuf += fmt.Sprintf("\t\t%s: %#v,\n", ft.Name, f.Interface())
 		}
 
@@ -395,6 +439,17 @@ func (br *buildrun) yaml2struct(w *yamlwalker, v *yaml.Node, si interface{}) err
 		}
 	}
 
+	for i := 0; i < typ.NumField(); i++ {
+		ft := typ.Field(i)
+		if !embeddedset[ft.Name] {
+			continue
+		}
+		// %#v writes out the type name with the package name it was declared in
+		lit := fmt.Sprintf("%#v", embeddedvals[ft.Name].Interface())
+		lit = strings.Replace(lit, khanpkgalias+".", khanalias+".", 1)
+		*w.gobuf += fmt.Sprintf("\t\t%s: %s,\n", ft.Name, lit)
+	}
+
 	if any {
 		*w.gobuf += "\t"
 	}
@@ -408,6 +463,16 @@ func (br *buildrun) yaml2struct(w *yamlwalker, v *yaml.Node, si interface{}) err
 		}
 	}
 
+	// Hosts and groups have to be in the inventory, and whens have to compile
+	if item, ok := si.(khan.Item); ok {
+		if err := br.inventory.CheckTargets(item); err != nil {
+			return w.nodeErrorf(v, "%w", err)
+		}
+		if err := khan.CheckWhen(item); err != nil {
+			return w.nodeErrorf(v, "%w", err)
+		}
+	}
+
 	// Include static files into the go binary
 	sif, ok := si.(khan.StaticFiler)
 	if ok {
@@ -436,6 +501,19 @@ func yaml2value(w *yamlwalker, v *yaml.Node, kind yaml.Kind, value string, dest
 		return nil
 	}
 
+	// Durations are written like "30s" or "5m"
+	if typ == reflect.TypeOf(time.Duration(0)) {
+		if kind != yaml.ScalarNode {
+			return w.nodeErrorf(v, "Expected scaler convertable to duration: Got %s", yamlkind(kind))
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return w.nodeErrorf(v, "Conversion to duration failed: %w", err)
+		}
+		dest.SetInt(int64(d))
+		return nil
+	}
+
 	// General type handling
 	switch typ.Kind() {
 	case reflect.String:
@@ -480,6 +558,16 @@ func yaml2value(w *yamlwalker, v *yaml.Node, kind yaml.Kind, value string, dest
 				return nil
 			}
 
+			// Special case: Any other scalar is a list of one.
+			if kind == yaml.ScalarNode {
+				sv = reflect.MakeSlice(typ, 1, 1)
+				if err := yaml2value(w, v, kind, value, sv.Index(0)); err != nil {
+					return err
+				}
+				dest.Set(sv)
+				return nil
+			}
+
 			return w.nodeErrorf(v, "Expected array: Got %s", yamlkind(kind))
 		}
 
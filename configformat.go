@@ -0,0 +1,859 @@
+package khan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const unsetValue = "(unset)"
+
+// configformat edits one key in a config file. A nil value deletes the key.
+// old and new are how the value looked before and after, for showing the
+// change to people, and are equal if nothing changed.
+type configformat interface {
+	set(content, key string, value *string) (edited, old, new string, err error)
+}
+
+// JSON and YAML are both handled with yaml.Node trees, since they keep the
+// order of keys (and for YAML, comments) intact. YAML is then edited only on
+// the lines the key is on where it can be, since writing out the tree again
+// loses the file's own quoting and layout.
+
+type jsonformat struct{}
+
+func (jsonformat) set(content, key string, value *string) (string, string, string, error) {
+	doc, old, new, err := setnode(content, key, value)
+	if err != nil || old == new {
+		return content, old, new, err
+	}
+
+	buf := &bytes.Buffer{}
+	writejson(buf, doc.Content[0], jsonindent(content), 0)
+	buf.WriteByte('\n')
+	return buf.String(), old, new, nil
+}
+
+type yamlformat struct{}
+
+func (yamlformat) set(content, key string, value *string) (string, string, string, error) {
+	doc, old, new, err := setnode(content, key, value)
+	if err != nil || old == new {
+		return content, old, new, err
+	}
+
+	if edited, ok := yamledit(content, key, value); ok {
+		return edited, old, new, nil
+	}
+
+	// Flow style maps can't be edited a line at a time, so the whole file
+	// gets written out again, at least with the indentation it had
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(yamlindent(content))
+	if err := enc.Encode(doc); err != nil {
+		return "", "", "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", "", "", err
+	}
+	return buf.String(), old, new, nil
+}
+
+// yamledit makes the same change as setnode, but only to the lines the key
+// is on, so the rest of the file keeps its formatting. It returns false if
+// the key is somewhere that can't be edited like that.
+func yamledit(content, key string, value *string) (string, bool) {
+	var lines []string
+	if content != "" {
+		lines = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(content), doc); err != nil {
+		return "", false
+	}
+	var m *yaml.Node
+	if len(doc.Content) > 0 {
+		m = doc.Content[0]
+	}
+	indent := yamlindent(content)
+
+	keys := strings.Split(key, ".")
+	for i, k := range keys {
+		if m != nil && (m.Kind != yaml.MappingNode || m.Style&yaml.FlowStyle != 0) {
+			return "", false
+		}
+		var kn, vn *yaml.Node
+		for j := 0; m != nil && j+1 < len(m.Content); j += 2 {
+			if m.Content[j].Value == k {
+				kn, vn = m.Content[j], m.Content[j+1]
+			}
+		}
+
+		if kn == nil {
+			// add what's missing to the last map there is
+			if value == nil {
+				return content, true
+			}
+			v := valuenode(*value)
+			for j := len(keys) - 1; j > i; j-- {
+				v = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+					{Kind: yaml.ScalarNode, Tag: "!!str", Value: keys[j]}, v,
+				}}
+			}
+			at, col := len(lines), 0
+			if m != nil && len(m.Content) > 0 {
+				at = yamlentryend(lines, m.Content[len(m.Content)-2], m.Content[len(m.Content)-1])
+				col = m.Content[0].Column - 1
+			}
+			entry := yamlentry(k, v, col, indent)
+			return joinlines(append(lines[:at:at], append(entry, lines[at:]...)...)), true
+		}
+		if kn.Column != m.Content[0].Column {
+			return "", false
+		}
+
+		if i < len(keys)-1 {
+			m = vn
+			continue
+		}
+
+		start, end := kn.Line-1, yamlentryend(lines, kn, vn)
+		if value == nil {
+			return joinlines(append(lines[:start:start], lines[end:]...)), true
+		}
+
+		v := valuenode(*value)
+		// strings stay quoted the way they were, and flow style stays
+		// flow style
+		if v.Kind == vn.Kind && (v.Kind != yaml.ScalarNode || v.Tag == vn.Tag) {
+			v.Style = vn.Style &^ (yaml.TaggedStyle | yaml.LiteralStyle | yaml.FoldedStyle)
+		}
+		line := lines[start]
+		if text, ok := yamlinline(v); ok && vn.Line == kn.Line && end == start+1 && vn.Anchor == "" &&
+			vn.Style&(yaml.TaggedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 && vn.Column-1 < len(line) {
+			rest := line[vn.Column-1:]
+			if vn.Kind == yaml.ScalarNode || !strings.ContainsRune(rest, '#') {
+				_, comment := yamlsplitcomment(rest, vn.Style)
+				lines[start] = line[:vn.Column-1] + text + comment
+				return joinlines(lines), true
+			}
+		}
+		entry := yamlentry(k, v, kn.Column-1, indent)
+		return joinlines(append(lines[:start:start], append(entry, lines[end:]...)...)), true
+	}
+	return "", false
+}
+
+// yamlentryend finds the line after the last one of a key and its value in
+// a block style map: everything indented more than the key, and for a list,
+// "- " lines at the same indentation.
+func yamlentryend(lines []string, kn, vn *yaml.Node) int {
+	col := kn.Column - 1
+	end := kn.Line
+	for i := kn.Line; i < len(lines); i++ {
+		t := strings.TrimSpace(lines[i])
+		if t == "" || t[0] == '#' {
+			continue
+		}
+		ind := len(lines[i]) - len(strings.TrimLeft(lines[i], " "))
+		if ind > col || (ind == col && vn.Kind == yaml.SequenceNode && (t == "-" || strings.HasPrefix(t, "- "))) {
+			end = i + 1
+			continue
+		}
+		break
+	}
+	return end
+}
+
+// yamlentry writes out "key: value" indented by col
+func yamlentry(key string, v *yaml.Node, col, indent int) []string {
+	m := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v,
+	}}
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(indent)
+	_ = enc.Encode(m)
+	_ = enc.Close()
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = strings.Repeat(" ", col) + line
+		}
+	}
+	return lines
+}
+
+// yamlinline writes out a value that fits after a key on the same line
+func yamlinline(v *yaml.Node) (string, bool) {
+	if v.Kind == yaml.MappingNode || v.Kind == yaml.SequenceNode {
+		if len(v.Content) > 0 && v.Style&yaml.FlowStyle == 0 {
+			return "", false
+		}
+	}
+	buf, err := yaml.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	text := strings.TrimSuffix(string(buf), "\n")
+	return text, !strings.Contains(text, "\n")
+}
+
+// yamlsplitcomment separates a value on one line from a comment after it
+func yamlsplitcomment(rest string, style yaml.Style) (string, string) {
+	i := 0
+	if style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		quote := rest[0]
+		for i = 1; i < len(rest); i++ {
+			if rest[i] == '\\' && quote == '"' {
+				i++
+			} else if rest[i] == quote {
+				break
+			}
+		}
+	}
+	for ; i < len(rest); i++ {
+		if rest[i] == '#' && i > 0 && (rest[i-1] == ' ' || rest[i-1] == '\t') {
+			v := strings.TrimRight(rest[:i], " \t")
+			return v, rest[len(v):]
+		}
+	}
+	return strings.TrimRight(rest, " \t"), ""
+}
+
+// yamlindent guesses how far a YAML file indents each level
+func yamlindent(content string) int {
+	indent := 0
+	for _, line := range strings.Split(content, "\n") {
+		t := strings.TrimLeft(line, " ")
+		if t == "" || t[0] == '#' {
+			continue
+		}
+		if n := len(line) - len(t); n > 0 && (indent == 0 || n < indent) {
+			indent = n
+		}
+	}
+	if indent < 2 {
+		return 2
+	}
+	return indent
+}
+
+func setnode(content, key string, value *string) (*yaml.Node, string, string, error) {
+	doc := &yaml.Node{}
+	if strings.TrimSpace(content) != "" {
+		if err := yaml.Unmarshal([]byte(content), doc); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		doc = &yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}},
+		}
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, "", "", fmt.Errorf("Expected a map at the top level: Got %s", yamlkindname(root.Kind))
+	}
+
+	keys := strings.Split(key, ".")
+
+	// find the map the last key goes in, making any that are missing
+	m := root
+	for i, k := range keys[:len(keys)-1] {
+		v := mapget(m, k)
+		if v == nil {
+			if value == nil {
+				return doc, unsetValue, unsetValue, nil
+			}
+			v = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			mapset(m, k, v)
+		}
+		if v.Kind != yaml.MappingNode {
+			return nil, "", "", fmt.Errorf("%s is not a map", strings.Join(keys[:i+1], "."))
+		}
+		m = v
+	}
+
+	last := keys[len(keys)-1]
+
+	old := unsetValue
+	if v := mapget(m, last); v != nil {
+		old = compactjson(v)
+	}
+
+	if value == nil {
+		mapdelete(m, last)
+		return doc, old, unsetValue, nil
+	}
+
+	v := valuenode(*value)
+	new := compactjson(v)
+	if new != old {
+		mapset(m, last, v)
+	}
+	return doc, old, new, nil
+}
+
+// valuenode turns a value into a node: JSON if it parses, otherwise a string
+func valuenode(value string) *yaml.Node {
+	if json.Valid([]byte(value)) {
+		doc := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte(value), doc); err == nil && len(doc.Content) == 1 {
+			n := doc.Content[0]
+			blockstyle(n)
+			return n
+		}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// blockstyle undoes the JSON look of a parsed value, so it fits in with the
+// rest of a YAML file
+func blockstyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockstyle(c)
+	}
+}
+
+func mapget(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func mapset(m *yaml.Node, key string, v *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			// keep any comments that were on the old value
+			v.HeadComment = m.Content[i+1].HeadComment
+			v.LineComment = m.Content[i+1].LineComment
+			v.FootComment = m.Content[i+1].FootComment
+			m.Content[i+1] = v
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+}
+
+func mapdelete(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+func yamlkindname(kind yaml.Kind) string {
+	switch kind {
+	case yaml.SequenceNode:
+		return "array"
+	case yaml.MappingNode:
+		return "map"
+	case yaml.ScalarNode:
+		return "scalar"
+	case yaml.AliasNode:
+		return "alias"
+	default:
+		return fmt.Sprintf("yaml.Kind %d", kind)
+	}
+}
+
+var jsonIndentRe = regexp.MustCompile(`(?m)^[ \t]+`)
+
+// jsonindent guesses the indentation used in a JSON file
+func jsonindent(content string) string {
+	if indent := jsonIndentRe.FindString(content); indent != "" {
+		return indent
+	}
+	return "  "
+}
+
+func compactjson(n *yaml.Node) string {
+	buf := &bytes.Buffer{}
+	writejson(buf, n, "", 0)
+	return buf.String()
+}
+
+// writejson writes a node out as JSON. An empty indent writes it on one line.
+func writejson(buf *bytes.Buffer, n *yaml.Node, indent string, depth int) {
+	newline := func(depth int) {
+		if indent == "" {
+			return
+		}
+		buf.WriteByte('\n')
+		buf.WriteString(strings.Repeat(indent, depth))
+	}
+	sep := ", "
+	if indent != "" {
+		sep = ","
+	}
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) > 0 {
+			writejson(buf, n.Content[0], indent, depth)
+		}
+	case yaml.AliasNode:
+		writejson(buf, n.Alias, indent, depth)
+	case yaml.MappingNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteString(sep)
+			}
+			newline(depth + 1)
+			buf.WriteString(jsonstring(n.Content[i].Value))
+			buf.WriteString(": ")
+			writejson(buf, n.Content[i+1], indent, depth+1)
+		}
+		newline(depth)
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("[]")
+			return
+		}
+		buf.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				buf.WriteString(sep)
+			}
+			newline(depth + 1)
+			writejson(buf, c, indent, depth+1)
+		}
+		newline(depth)
+		buf.WriteByte(']')
+	default:
+		switch n.ShortTag() {
+		case "!!int", "!!float":
+			buf.WriteString(n.Value)
+		case "!!bool":
+			buf.WriteString(strings.ToLower(n.Value))
+		case "!!null":
+			buf.WriteString("null")
+		default:
+			buf.WriteString(jsonstring(n.Value))
+		}
+	}
+}
+
+func jsonstring(s string) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// INI and TOML are edited line by line, so everything else in the file
+// (comments, blank lines, ordering) stays exactly as it was.
+
+type iniformat struct{}
+
+func (iniformat) set(content, key string, value *string) (string, string, string, error) {
+	section, name := "", key
+	if dot := strings.LastIndexByte(key, '.'); dot != -1 {
+		section, name = key[:dot], key[dot+1:]
+	}
+	return setline(content, section, name, value, ";#", nil)
+}
+
+type tomlformat struct{}
+
+func (tomlformat) set(content, key string, value *string) (string, string, string, error) {
+	section, name := "", key
+	if dot := strings.LastIndexByte(key, '.'); dot != -1 {
+		section, name = key[:dot], key[dot+1:]
+	}
+	multi, err := tomlscan(content, key)
+	if err != nil {
+		return "", "", "", err
+	}
+	if value == nil {
+		return setline(content, section, name, nil, "#", multi)
+	}
+	v, err := tomlvalue(*value)
+	if err != nil {
+		return "", "", "", err
+	}
+	return setline(content, section, name, &v, "#", multi)
+}
+
+// tomlscan finds the lines that carry on a multi-line string or array, for
+// setline to skip over. It refuses keys that setline can't edit a line at a
+// time: ones with multi-line values, ones written as dotted keys, and ones
+// in a table header with quotes.
+func tomlscan(content, key string) (map[int]bool, error) {
+	var lines []string
+	if content != "" {
+		lines = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	}
+	want := strings.Split(key, ".")
+	wantsection := want[:len(want)-1]
+
+	multi := map[int]bool{}
+	sc := &tomlscanner{}
+	cont := false
+	var current []string
+	for i, line := range lines {
+		if cont {
+			multi[i] = true
+			cont = sc.scan(line)
+			continue
+		}
+		t := strings.TrimSpace(line)
+		if t == "" || t[0] == '#' {
+			continue
+		}
+		if t[0] == '[' {
+			h, _ := splitcomment(t)
+			array := strings.HasPrefix(h, "[[")
+			h = strings.TrimSpace(strings.Trim(h, "[]"))
+			parts, quoted := tomlparts(h)
+			current = parts
+			switch {
+			case haspath(parts, want):
+				return nil, fmt.Errorf("TOML key %#v is a table on line %d", key, i+1)
+			case array && haspath(want, parts):
+				return nil, fmt.Errorf("TOML key %#v is in an array of tables on line %d, which can't be edited", key, i+1)
+			case quoted && haspath(want, parts):
+				return nil, fmt.Errorf("TOML key %#v is in a table with a quoted name on line %d, which can't be edited", key, i+1)
+			case samepath(parts, wantsection) && h != strings.Join(wantsection, "."):
+				return nil, fmt.Errorf("TOML key %#v is in a table written as %#v on line %d, which can't be edited", key, h, i+1)
+			}
+			continue
+		}
+		eq := strings.IndexByte(t, '=')
+		if eq == -1 {
+			continue
+		}
+		parts, _ := tomlparts(t[:eq])
+		path := append(append([]string{}, current...), parts...)
+		cont = sc.scan(t[eq+1:])
+		switch {
+		case len(parts) > 1 && (haspath(path, want) || haspath(want, path)):
+			return nil, fmt.Errorf("TOML key %#v is set with the dotted key %#v on line %d, which can't be edited", key, strings.TrimSpace(t[:eq]), i+1)
+		case samepath(path, want) && cont:
+			return nil, fmt.Errorf("TOML key %#v has a multi-line value on line %d, which can't be edited", key, i+1)
+		case haspath(want, path) && len(path) < len(want):
+			return nil, fmt.Errorf("TOML key %#v is inside of %#v on line %d, which isn't a table", key, strings.Join(path, "."), i+1)
+		}
+	}
+	return multi, nil
+}
+
+// tomlscanner follows strings and arrays in TOML values across lines
+type tomlscanner struct {
+	delim string // of the string we're in
+	depth int    // of arrays
+}
+
+// scan reads some of a value, and returns whether it carries on past the end
+// of the line
+func (sc *tomlscanner) scan(v string) bool {
+scan:
+	for i := 0; i < len(v); i++ {
+		switch {
+		case sc.delim != "" && v[i] == '\\' && sc.delim[0] == '"':
+			i++
+		case sc.delim != "" && strings.HasPrefix(v[i:], sc.delim):
+			i += len(sc.delim) - 1
+			sc.delim = ""
+		case sc.delim != "":
+		case strings.HasPrefix(v[i:], `"""`) || strings.HasPrefix(v[i:], "'''"):
+			sc.delim = v[i : i+3]
+			i += 2
+		case v[i] == '"' || v[i] == '\'':
+			sc.delim = v[i : i+1]
+		case v[i] == '#':
+			break scan
+		case v[i] == '[':
+			sc.depth++
+		case v[i] == ']':
+			sc.depth--
+		}
+	}
+	if len(sc.delim) == 1 {
+		// only multi-line strings can be, so this is just broken
+		sc.delim = ""
+	}
+	return sc.delim != "" || sc.depth > 0
+}
+
+// tomlparts splits a TOML key at its dots, and takes the quotes off of the
+// parts. quoted is whether any of them had quotes.
+func tomlparts(key string) (parts []string, quoted bool) {
+	var (
+		part  strings.Builder
+		quote byte
+	)
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteByte(c)
+		case c == '"' || c == '\'':
+			quote = c
+			quoted = true
+		case c == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		default:
+			part.WriteByte(c)
+		}
+	}
+	return append(parts, strings.TrimSpace(part.String())), quoted
+}
+
+// haspath is whether path starts with prefix
+func haspath(path, prefix []string) bool {
+	return len(path) >= len(prefix) && samepath(path[:len(prefix)], prefix)
+}
+
+func samepath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tomlvalue writes a value the way TOML wants it. JSON strings are valid TOML
+// strings, and the other JSON types are close enough.
+func tomlvalue(value string) (string, error) {
+	if !json.Valid([]byte(value)) {
+		return jsonstring(value), nil
+	}
+
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+
+	var encode func(v interface{}) (string, error)
+	encode = func(v interface{}) (string, error) {
+		switch v := v.(type) {
+		case nil:
+			return "", fmt.Errorf("TOML has no null value")
+		case string:
+			return jsonstring(v), nil
+		case json.Number:
+			return v.String(), nil
+		case bool:
+			return fmt.Sprint(v), nil
+		case []interface{}:
+			parts := make([]string, len(v))
+			for i, e := range v {
+				s, err := encode(e)
+				if err != nil {
+					return "", err
+				}
+				parts[i] = s
+			}
+			return "[" + strings.Join(parts, ", ") + "]", nil
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			parts := make([]string, len(keys))
+			for i, k := range keys {
+				s, err := encode(v[k])
+				if err != nil {
+					return "", err
+				}
+				parts[i] = tomlkey(k) + " = " + s
+			}
+			return "{" + strings.Join(parts, ", ") + "}", nil
+		default:
+			return "", fmt.Errorf("Unhandled JSON type %T", v)
+		}
+	}
+	return encode(v)
+}
+
+var tomlBareKeyRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlkey(k string) string {
+	if tomlBareKeyRe.MatchString(k) {
+		return k
+	}
+	return jsonstring(k)
+}
+
+// setline finds "name = value" within a [section] and replaces, adds or
+// removes it. Keys outside of any section have a blank section name. Lines
+// in skip carry on a value from the line before.
+func setline(content, section, name string, value *string, comments string, skip map[int]bool) (string, string, string, error) {
+	var lines []string
+	if content != "" {
+		lines = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	}
+
+	current := ""
+	found := -1  // line with the key on it
+	insert := -1 // where a new key would go in the section
+	sectionfound := section == ""
+	firstsection := -1
+
+	for i, line := range lines {
+		if skip[i] {
+			if current == section {
+				insert = i
+			}
+			continue
+		}
+		t := strings.TrimSpace(line)
+		if t == "" || strings.ContainsRune(comments, rune(t[0])) {
+			continue
+		}
+		if t[0] == '[' {
+			if c := strings.IndexByte(t, '#'); c != -1 && comments == "#" {
+				t = strings.TrimSpace(t[:c])
+			}
+			current = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(t, "["), "]"))
+			if firstsection == -1 {
+				firstsection = i
+			}
+			if current == section {
+				sectionfound = true
+				insert = i
+			}
+			continue
+		}
+		if current != section {
+			continue
+		}
+		insert = i
+		eq := strings.IndexByte(t, '=')
+		if eq == -1 {
+			continue
+		}
+		k := strings.TrimSpace(t[:eq])
+		k = strings.Trim(k, `"'`)
+		if k == name {
+			found = i
+		}
+	}
+
+	old := unsetValue
+	comment := ""
+	if found != -1 {
+		line := lines[found]
+		old = strings.TrimSpace(line[strings.IndexByte(line, '=')+1:])
+		if comments == "#" {
+			old, comment = splitcomment(old)
+		} else {
+			old, comment = splitinicomment(old, comments)
+		}
+	}
+
+	if value == nil {
+		if found == -1 {
+			return content, old, old, nil
+		}
+		lines = append(lines[:found], lines[found+1:]...)
+		return joinlines(lines), old, unsetValue, nil
+	}
+
+	new := *value
+	if old == new {
+		return content, old, new, nil
+	}
+
+	if found != -1 {
+		// keep the spacing the file already uses
+		line := lines[found]
+		eq := strings.IndexByte(line, '=')
+		after := line[eq+1:]
+		space := after[:len(after)-len(strings.TrimLeft(after, " \t"))]
+		lines[found] = line[:eq+1] + space + new + comment
+		return joinlines(lines), old, new, nil
+	}
+
+	kv := name + " = " + new
+
+	switch {
+	case sectionfound && insert != -1:
+		lines = append(lines[:insert+1], append([]string{kv}, lines[insert+1:]...)...)
+	case sectionfound:
+		// no keys outside of a section yet
+		if firstsection == -1 {
+			lines = append(lines, kv)
+		} else {
+			lines = append(lines[:firstsection], append([]string{kv, ""}, lines[firstsection:]...)...)
+		}
+	default:
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+section+"]", kv)
+	}
+	return joinlines(lines), old, new, nil
+}
+
+// splitcomment separates a TOML value from a comment after it
+func splitcomment(value string) (string, string) {
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			v := strings.TrimRight(value[:i], " \t")
+			return v, value[len(v):]
+		}
+	}
+	return value, ""
+}
+
+// splitinicomment separates an INI value from a comment after it. The
+// comment character has to come after a space, so it can still be in values
+// like URLs.
+func splitinicomment(value, comments string) (string, string) {
+	for i := 1; i < len(value); i++ {
+		if strings.IndexByte(comments, value[i]) != -1 && (value[i-1] == ' ' || value[i-1] == '\t') {
+			v := strings.TrimRight(value[:i], " \t")
+			return v, value[len(v):]
+		}
+	}
+	return value, ""
+}
+
+func joinlines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,206 @@
+package khan
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTOMLSetMultiline(t *testing.T) {
+	content := `name = "x"
+desc = """
+[not.a.table]
+key = 1
+"""
+list = [
+  1,
+  2,
+]
+
+[a]
+b = 1
+c.d = 2
+list = [
+  "x",
+]
+`
+	tests := []struct {
+		key   string
+		value string
+		want  string // blank for an error
+	}{
+		{"name", `"y"`, strings.Replace(content, `name = "x"`, `name = "y"`, 1)},
+		{"key", "2", strings.Replace(content, "list = [\n  1,\n  2,\n]\n", "list = [\n  1,\n  2,\n]\nkey = 2\n", 1)},
+		{"a.b", "3", strings.Replace(content, "b = 1", "b = 3", 1)},
+		{"a.e", "4", content + "e = 4\n"},
+		{"not.a.table.key", "2", content + "\n[not.a.table]\nkey = 2\n"},
+		{"desc", `"y"`, ""},
+		{"list", "[]", ""},
+		{"a.list", "[]", ""},
+		{"a.c.d", "3", ""},
+		{"a.c", "3", ""},
+		{"a", "3", ""},
+		{"name.x", "3", ""},
+	}
+	for _, test := range tests {
+		v := test.value
+		got, _, _, err := tomlformat{}.set(content, test.key, &v)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("%s: no error, got\n%s", test.key, got)
+		case test.want != "" && err != nil:
+			t.Errorf("%s: %v", test.key, err)
+		case test.want != "" && got != test.want:
+			t.Errorf("%s: got\n%s\nwant\n%s", test.key, got, test.want)
+		}
+	}
+}
+
+func TestTOMLSetQuotedTable(t *testing.T) {
+	for _, content := range []string{
+		"[a.\"b\"]\nc = 1\n",
+		"[ a . b ]\nc = 1\n",
+		"[[a.b]]\nc = 1\n",
+	} {
+		v := "2"
+		if got, _, _, err := (tomlformat{}).set(content, "a.b.c", &v); err == nil {
+			t.Errorf("%#v: no error, got\n%s", content, got)
+		}
+	}
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func TestConfigFormatSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  configformat
+		content string
+		key     string
+		value   *string // nil deletes
+		want    string  // blank for an error
+		old     string
+		new     string
+	}{
+		{"json add", jsonformat{}, "{\n    \"a\": 1\n}\n", "b", str("true"),
+			"{\n    \"a\": 1,\n    \"b\": true\n}\n", unsetValue, "true"},
+		{"json nested", jsonformat{}, `{"a": {"b": 1}}`, "a.b", str("2"),
+			"{\n  \"a\": {\n    \"b\": 2\n  }\n}\n", "1", "2"},
+		{"json make map", jsonformat{}, "", "a.b", str("x"),
+			"{\n  \"a\": {\n    \"b\": \"x\"\n  }\n}\n", unsetValue, `"x"`},
+		{"json same", jsonformat{}, `{"a": [1, 2]}`, "a", str("[1,2]"),
+			`{"a": [1, 2]}`, "[1, 2]", "[1, 2]"},
+		{"json delete", jsonformat{}, "{\n  \"a\": 1,\n  \"b\": 2\n}\n", "a", nil,
+			"{\n  \"b\": 2\n}\n", "1", unsetValue},
+		{"json delete missing", jsonformat{}, `{"a": 1}`, "b.c", nil,
+			`{"a": 1}`, unsetValue, unsetValue},
+		{"json not a map", jsonformat{}, `{"a": 1}`, "a.b", str("2"), "", "", ""},
+		{"json top array", jsonformat{}, `[1]`, "a", str("2"), "", "", ""},
+
+		{"yaml set", yamlformat{}, "a: 1 # one\nb:\n  c: x\n", "b.c", str("y"),
+			"a: 1 # one\nb:\n  c: y\n", `"x"`, `"y"`},
+		{"yaml add", yamlformat{}, "a: 1\n", "b", str(`{"c": [1, 2]}`),
+			"a: 1\nb:\n  c:\n    - 1\n    - 2\n", unsetValue, `{"c": [1, 2]}`},
+		{"yaml delete", yamlformat{}, "a: 1\nb: 2\n", "a", nil,
+			"b: 2\n", "1", unsetValue},
+
+		{"ini set", iniformat{}, "; top\n[main]\nname = old ; keep\nx=1\n", "main.x", str("2"),
+			"; top\n[main]\nname = old ; keep\nx=2\n", "1", "2"},
+		{"ini add to section", iniformat{}, "[a]\nx = 1\n\n[b]\ny = 2\n", "a.z", str("3"),
+			"[a]\nx = 1\nz = 3\n\n[b]\ny = 2\n", unsetValue, "3"},
+		{"ini add section", iniformat{}, "[a]\nx = 1\n", "b.y", str("2"),
+			"[a]\nx = 1\n\n[b]\ny = 2\n", unsetValue, "2"},
+		{"ini add top", iniformat{}, "[a]\nx = 1\n", "y", str("2"),
+			"y = 2\n\n[a]\nx = 1\n", unsetValue, "2"},
+		{"ini delete", iniformat{}, "[a]\nx = 1\ny = 2\n", "a.x", nil,
+			"[a]\ny = 2\n", "1", unsetValue},
+		{"ini inline comment", iniformat{}, "[a]\nx = 1 ; one\ny = 2\t# two\n", "a.x", str("1"),
+			"[a]\nx = 1 ; one\ny = 2\t# two\n", "1", "1"},
+		{"ini set with inline comment", iniformat{}, "[a]\nx = 1 ; one\ny = 2\t# two\n", "a.y", str("3"),
+			"[a]\nx = 1 ; one\ny = 3\t# two\n", "2", "3"},
+		{"ini hash in value", iniformat{}, "url = http://a/#x\n", "url", str("http://a/#x"),
+			"url = http://a/#x\n", "http://a/#x", "http://a/#x"},
+		{"ini same section name elsewhere", iniformat{}, "[a]\nx = 1\n[b]\nx = 2\n", "b.x", str("3"),
+			"[a]\nx = 1\n[b]\nx = 3\n", "2", "3"},
+
+		{"toml string", tomlformat{}, "[server]\nhost = \"a\" # comment\n", "server.host", str("b"),
+			"[server]\nhost = \"b\" # comment\n", `"a"`, `"b"`},
+		{"toml number", tomlformat{}, "port = 1\n", "port", str("22"),
+			"port = 22\n", "1", "22"},
+		{"toml array", tomlformat{}, "", "a.list", str(`["x", 1]`),
+			"[a]\nlist = [\"x\", 1]\n", unsetValue, `["x", 1]`},
+		{"toml inline table", tomlformat{}, "", "t", str(`{"b": 1, "a key": true}`),
+			"t = {\"a key\" = true, b = 1}\n", unsetValue, `{"a key" = true, b = 1}`},
+		{"toml quoted key", tomlformat{}, "[a]\n\"b\" = 1\n", "a.b", str("2"),
+			"[a]\n\"b\" = 2\n", "1", "2"},
+		{"toml null", tomlformat{}, "", "a", str("null"), "", "", ""},
+	}
+	for _, test := range tests {
+		got, old, new, err := test.format.set(test.content, test.key, test.value)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("%s: no error, got %#v", test.name, got)
+		case test.want != "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.want != "" && (got != test.want || old != test.old || new != test.new):
+			t.Errorf("%s: got %#v (%s -> %s), want %#v (%s -> %s)", test.name, got, old, new, test.want, test.old, test.new)
+		}
+	}
+}
+
+func TestYAMLSetKeepsFormatting(t *testing.T) {
+	content := `# settings
+server:
+    host: 'old'   # where
+    ports: [80, 443]
+    tls:
+        cert: /etc/cert  # pem
+list:
+- a
+- b
+other: {x: 1}
+last: "x" # end
+`
+	tests := []struct {
+		key   string
+		value *string
+		from  string // what changes in content, blank for the end of it
+		to    string
+	}{
+		{"server.host", str("new"), "host: 'old'", "host: 'new'"},
+		{"server.host", str("it's"), "host: 'old'", "host: 'it''s'"},
+		{"server.ports", str("[8080]"), "ports: [80, 443]", "ports: [8080]"},
+		{"server.tls.cert", str("/c # 1"), "cert: /etc/cert  # pem", "cert: '/c # 1'  # pem"},
+		{"server.tls.key", str("/k"), "cert: /etc/cert  # pem\n", "cert: /etc/cert  # pem\n        key: /k\n"},
+		{"server.tls", nil, "    tls:\n        cert: /etc/cert  # pem\n", ""},
+		{"server.tls", str(`{"a": 1}`), "    tls:\n        cert: /etc/cert  # pem\n", "    tls:\n        a: 1\n"},
+		{"server.user", str("root"), "        cert: /etc/cert  # pem\n", "        cert: /etc/cert  # pem\n    user: root\n"},
+		{"list", str(`["c"]`), "list:\n- a\n- b\n", "list:\n    - c\n"},
+		{"list", nil, "list:\n- a\n- b\n", ""},
+		{"last", str("y"), `last: "x" # end`, `last: "y" # end`},
+		{"last", str("2"), `last: "x" # end`, `last: 2 # end`},
+		{"new.key", str("1"), "", "new:\n    key: 1\n"},
+	}
+	for _, test := range tests {
+		want := content + test.to
+		if test.from != "" {
+			want = strings.Replace(content, test.from, test.to, 1)
+		}
+		got, _, _, err := yamlformat{}.set(content, test.key, test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.key, err)
+		} else if got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.key, got, want)
+		}
+	}
+
+	// flow style maps are written out again, with the same indentation
+	got, _, _, err := yamlformat{}.set(content, "other.y", str("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "other: {x: 1, y: 2}\n") || !strings.Contains(got, "\n    ports: [80, 443]\n") {
+		t.Errorf("other.y: got\n%s", got)
+	}
+}
@@ -0,0 +1,144 @@
+package khan
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ConfigKey sets (or deletes) one key in a structured config file, leaving
+// the rest of the file alone. Other ConfigKey items can edit the same file.
+type ConfigKey struct {
+	Path string `khan:"path,shortkey"`
+
+	// Format is one of "json", "yaml", "ini" or "toml". If blank, it is
+	// guessed from the file extension.
+	Format string
+
+	// Key is a dotted path to the value, like "log-opts.max-size". For INI
+	// files, everything before the last dot is the section name, and a key
+	// without a dot is outside of any section.
+	Key string
+
+	// Value is parsed as JSON if it can be (so 5, true, ["a", "b"] and
+	// {"a": 1} all do what you would expect) and otherwise taken as a plain
+	// string. INI files have no types, so it is always written as is.
+	Value string
+
+	Delete bool
+
+	// Create the file if it doesn't exist, with this ownership and mode.
+	// Existing files keep theirs.
+	Create bool
+	User   string
+	Group  string
+	Mode   os.FileMode
+
+	Meta
+
+	id int
+}
+
+func (c *ConfigKey) String() string {
+	return c.Path + ": " + c.Key
+}
+
+func (c *ConfigKey) SetID(id int) {
+	c.id = id
+}
+func (c *ConfigKey) ID() int {
+	return c.id
+}
+func (c *ConfigKey) Clone() Item {
+	r := *c
+	r.id = 0
+	return &r
+}
+
+func (c *ConfigKey) Validate() error {
+	if c.Path == "" {
+		return errors.New("ConfigKey path is required")
+	}
+	if c.Key == "" {
+		return fmt.Errorf("ConfigKey %#v key is required", c.Path)
+	}
+	if _, err := c.format(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *ConfigKey) format() (configformat, error) {
+	name := c.Format
+	if name == "" {
+		name = strings.TrimPrefix(path.Ext(c.Path), ".")
+	}
+	switch strings.ToLower(name) {
+	case "json":
+		return jsonformat{}, nil
+	case "yaml", "yml":
+		return yamlformat{}, nil
+	case "ini", "cfg":
+		return iniformat{}, nil
+	case "toml":
+		return tomlformat{}, nil
+	}
+	if c.Format == "" {
+		return nil, fmt.Errorf("ConfigKey %#v needs a format (json, yaml, ini or toml)", c.Path)
+	}
+	return nil, fmt.Errorf("ConfigKey %#v has unknown format %#v", c.Path, c.Format)
+}
+
+func (c *ConfigKey) After() []string {
+	afters := parentpaths(c.Path)
+	afters = append(afters, "path:"+path.Clean(c.Path))
+	if c.Create && c.User != "" {
+		afters = append(afters, "user:"+c.User)
+	}
+	if c.Create && c.Group != "" {
+		afters = append(afters, "group:"+c.Group)
+	}
+	return afters
+}
+func (c *ConfigKey) Before() []string {
+	return nil
+}
+func (c *ConfigKey) editpath() string {
+	return c.Path
+}
+func (c *ConfigKey) Provides() []string {
+	return []string{"configkey:" + path.Clean(c.Path) + ":" + c.Key}
+}
+
+func (c *ConfigKey) Apply(host *Host) (itemStatus, error) {
+	format, err := c.format()
+	if err != nil {
+		return 0, err
+	}
+
+	fpath := path.Clean(c.Path)
+
+	return editfile(host, c, fpath, c.Create, c.User, c.Group, c.Mode, func(content string) (string, error) {
+		var value *string
+		if !c.Delete {
+			value = &c.Value
+		}
+
+		edited, old, new, err := format.set(content, c.Key, value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", fpath, err)
+		}
+		if old == new {
+			// Leave the file exactly how it was, even if we would have
+			// formatted it differently.
+			return content, nil
+		}
+
+		if host.Run.Dry || host.Run.Diff {
+			fmt.Println(host, "~", fpath, c.Key+":", old, "→", new)
+		}
+		return edited, nil
+	})
+}
@@ -0,0 +1,278 @@
+package khan
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"khan.rip/rio/util"
+)
+
+type Directory struct {
+	Path string `khan:"path,shortkey"`
+
+	User  string
+	Group string
+	Mode  os.FileMode
+
+	// Recurse makes everything inside the directory owned by User and Group
+	// too. (Modes of the contents are left alone.)
+	Recurse bool
+
+	// Purge deletes anything inside the directory that is not managed by
+	// another item.
+	Purge bool
+
+	Delete bool
+
+	Meta
+
+	id int
+}
+
+func (d *Directory) String() string {
+	return d.Path
+}
+
+func (d *Directory) SetID(id int) {
+	d.id = id
+}
+func (d *Directory) ID() int {
+	return d.id
+}
+func (d *Directory) Clone() Item {
+	r := *d
+	r.id = 0
+	return &r
+}
+
+func (d *Directory) Validate() error {
+	if d.Path == "" {
+		return errors.New("Directory path is required")
+	}
+	if !path.IsAbs(d.Path) {
+		return fmt.Errorf("Directory path %#v must be absolute", d.Path)
+	}
+	return nil
+}
+
+func (d *Directory) After() []string {
+	if d.Delete {
+		return nil
+	}
+	afters := parentpaths(d.Path)
+	if d.User != "" {
+		afters = append(afters, "user:"+d.User)
+	}
+	if d.Group != "" {
+		afters = append(afters, "group:"+d.Group)
+	}
+	return afters
+}
+func (d *Directory) Before() []string {
+	return nil
+}
+func (d *Directory) Provides() []string {
+	return []string{"path:" + path.Clean(d.Path)}
+}
+
+func (d *Directory) Apply(host *Host) (itemStatus, error) {
+	dpath := path.Clean(d.Path)
+
+	fi, err := host.rh.Stat(dpath)
+	if err != nil && !iserrnotfound(err) {
+		return 0, err
+	}
+
+	if d.Delete {
+		if err != nil {
+			return itemUnchanged, nil
+		}
+		if err := host.rh.RemoveAll(dpath); err != nil {
+			return 0, err
+		}
+		return itemDeleted, nil
+	}
+
+	mode := d.Mode
+	if mode == 0 {
+		mode = 0755
+	}
+
+	status := itemUnchanged
+
+	if err != nil {
+		if err := host.rh.Mkdir(dpath, mode); err != nil {
+			return 0, err
+		}
+		status = itemCreated
+	} else if !fi.IsDir() {
+		return 0, fmt.Errorf("%#v exists and is not a directory", dpath)
+	}
+
+	uid, gid, err := resolveowner(host, d, d.User, d.Group)
+	if err != nil {
+		return 0, err
+	}
+
+	pstatus, err := applyperms(host, dpath, uid, gid, mode)
+	if err != nil {
+		return 0, err
+	}
+	if status == itemUnchanged {
+		status = pstatus
+	}
+
+	if d.Purge && status != itemCreated {
+		managed := host.Run.managedpaths(host)
+		purged, err := purge(host, dpath, managed)
+		if err != nil {
+			return 0, err
+		}
+		if purged {
+			status = itemModified
+		}
+	}
+
+	if d.Recurse && status != itemCreated {
+		chowned, err := chownall(host, dpath, uid, gid)
+		if err != nil {
+			return 0, err
+		}
+		if chowned && status == itemUnchanged {
+			status = itemModified
+		}
+	}
+
+	return status, nil
+}
+
+// purge removes everything under dir that isn't managed and isn't on the way
+// to something managed.
+func purge(host *Host, dir string, managed map[string]bool) (bool, error) {
+	entries, err := lstatdir(host, dir)
+	if err != nil {
+		return false, err
+	}
+
+	purged := false
+
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+		if managed[p] {
+			continue
+		}
+
+		contains := false
+		for m := range managed {
+			if strings.HasPrefix(m, p+"/") {
+				contains = true
+				break
+			}
+		}
+
+		if contains && e.IsDir() {
+			more, err := purge(host, p, managed)
+			if err != nil {
+				return false, err
+			}
+			if more {
+				purged = true
+			}
+			continue
+		}
+
+		if err := host.rh.RemoveAll(p); err != nil {
+			return false, err
+		}
+		purged = true
+	}
+
+	return purged, nil
+}
+
+func chownall(host *Host, dir string, uid, gid uint32) (bool, error) {
+	entries, err := lstatdir(host, dir)
+	if err != nil {
+		return false, err
+	}
+
+	chowned := false
+
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+
+		ufi, err := util.ConvertStat(e)
+		if err != nil {
+			return false, err
+		}
+
+		if ufi.Fuid != uid || ufi.Fgid != gid {
+			// don't follow symlinks out of the directory
+			if ufi.Fislink {
+				err = host.rh.Lchown(p, uid, gid)
+			} else {
+				err = host.rh.Chown(p, uid, gid)
+			}
+			if err != nil {
+				return false, err
+			}
+			chowned = true
+		}
+
+		if e.IsDir() {
+			more, err := chownall(host, p, uid, gid)
+			if err != nil {
+				return false, err
+			}
+			if more {
+				chowned = true
+			}
+		}
+	}
+
+	return chowned, nil
+}
+
+// lstatdir lists dir with every entry checked by Lstat. ReadDir doesn't
+// follow symlinks on any host we know of, but if one did, purge and chownall
+// would end up following them out of the directory.
+func lstatdir(host *Host, dir string) ([]os.FileInfo, error) {
+	entries, err := host.rh.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		ufi, err := util.ConvertStat(e)
+		if err != nil {
+			return nil, err
+		}
+		if ufi.Fislink {
+			continue
+		}
+		fi, err := host.rh.Lstat(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if ufi, err = util.ConvertStat(fi); err != nil {
+			return nil, err
+		}
+		// hosts name it by the path it was asked for
+		named := *ufi
+		named.Fname = e.Name()
+		entries[i] = &named
+	}
+	return entries, nil
+}
+
+// parentpaths returns "path:" keys for every directory above fpath, so that
+// an item waits for any Directory items it lives in.
+func parentpaths(fpath string) []string {
+	var parents []string
+	for dir := path.Dir(path.Clean(fpath)); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		parents = append(parents, "path:"+dir)
+	}
+	return parents
+}
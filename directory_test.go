@@ -0,0 +1,85 @@
+package khan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"khan.rip/rio/local"
+)
+
+// followhost is a local host whose ReadDir follows symlinks
+type followhost struct {
+	*local.Host
+}
+
+func (fh followhost) ReadDir(dir string) ([]os.FileInfo, error) {
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, n := range names {
+		fi, err := os.Stat(filepath.Join(dir, n.Name()))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+func TestDirectorySymlinks(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	tmp, err := ioutil.TempDir("", "khan_directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "dir")
+	outside := filepath.Join(tmp, "outside")
+	for _, d := range []string{dir, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "file"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	defer quiet(t)()
+	rh := followhost{local.New()}
+	defer rh.Cleanup()
+	host := newtestrun(rh).Hosts[0]
+
+	if _, err := chownall(host, dir, 12345, 12345); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{outside, filepath.Join(outside, "file")} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Sys().(*syscall.Stat_t).Uid == 12345 {
+			t.Errorf("chownall followed the symlink to %s", p)
+		}
+	}
+
+	// managed is inside the link, so purge would go into it if it thought
+	// it was a directory
+	managed := map[string]bool{filepath.Join(dir, "link", "keep"): true}
+	if _, err := purge(host, dir, managed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); err != nil {
+		t.Errorf("purge followed the symlink: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package khan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"khan.rip/rio"
+
+	"github.com/keegancsmith/shell"
+)
+
+// Exec runs a command. Without any guards it runs every time, so use
+// Creates, Unless or Onlyif to make it idempotent. Like Function, if it
+// subscribes to other items, or other items notify it (as "exec:<name>"), it
+// only runs when one of them changes.
+type Exec struct {
+	Name string
+
+	Command string `khan:"command,shortvalue"`
+	Args    []string
+
+	// Shell runs Command with the shell, so it can use pipes, variables,
+	// globs and so on.
+	Shell bool
+
+	Env  []string // "NAME=value"
+	Dir  string
+	User string // Run as this user (with su)
+
+	Timeout time.Duration
+
+	// Creates skips the command if this path already exists
+	Creates string
+
+	// Unless skips the command if this shell command succeeds
+	Unless string
+
+	// Onlyif skips the command unless this shell command succeeds
+	Onlyif string
+
+	Meta
+
+	id int
+}
+
+func (e *Exec) String() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.Command
+}
+
+func (e *Exec) SetID(id int) {
+	e.id = id
+}
+func (e *Exec) ID() int {
+	return e.id
+}
+func (e *Exec) Clone() Item {
+	r := *e
+	r.id = 0
+	return &r
+}
+
+func (e *Exec) Validate() error {
+	if e.Command == "" {
+		return errors.New("Exec command is required")
+	}
+	for _, env := range e.Env {
+		if strings.IndexByte(env, '=') < 1 {
+			return fmt.Errorf("Exec env %#v must look like NAME=value", env)
+		}
+	}
+	if e.Timeout < 0 {
+		return fmt.Errorf("Exec timeout %v must not be negative", e.Timeout)
+	}
+	return nil
+}
+
+func (e *Exec) After() []string {
+	if e.User != "" {
+		return []string{"user:" + e.User}
+	}
+	return nil
+}
+func (e *Exec) Before() []string {
+	return nil
+}
+func (e *Exec) Provides() []string {
+	if e.Name != "" {
+		return []string{"exec:" + e.Name}
+	}
+	return nil
+}
+
+func (e *Exec) Apply(host *Host) (itemStatus, error) {
+	return e.run(host)
+}
+
+func (e *Exec) handler() bool {
+	return true
+}
+
+func (e *Exec) Notified(host *Host) (itemStatus, error) {
+	return e.run(host)
+}
+
+func (e *Exec) run(host *Host) (itemStatus, error) {
+	skip, err := e.skip(host)
+	if err != nil {
+		return 0, err
+	}
+	if skip {
+		return itemUnchanged, nil
+	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	if err := host.rh.Exec(e.command(ctx, e.Command, e.Args, e.Shell)); err != nil {
+		return 0, err
+	}
+	return itemModified, nil
+}
+
+// skip checks the guards. They are all read only, so they are still checked
+// during a dry run.
+func (e *Exec) skip(host *Host) (bool, error) {
+	if e.Creates != "" {
+		_, err := host.rh.Stat(e.Creates)
+		if err == nil {
+			return true, nil
+		}
+		if !iserrnotfound(err) {
+			return false, err
+		}
+	}
+
+	if e.Unless != "" {
+		ok, err := e.guard(host, e.Unless)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+
+	if e.Onlyif != "" {
+		ok, err := e.guard(host, e.Onlyif)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// guard runs a shell command the same way as the main command, and reports
+// whether it succeeded. It only fails if the command couldn't be run, or
+// timed out. Exiting 126 or 127 counts as not being able to run, since the
+// shell uses them for commands that aren't there or can't be executed, which
+// is more likely a typo than an answer.
+func (e *Exec) guard(host *Host, line string) (bool, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	cmd := e.command(ctx, line, nil, true)
+	cmd.ReadOnly = true
+	err := host.rh.Exec(cmd)
+	if err == nil {
+		return true, nil
+	}
+	if ctx.Err() == nil && rio.Exited(err) {
+		if status, ok := rio.ExitStatus(err); !ok || (status != 126 && status != 127) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("Guard %#v: %w", line, err)
+}
+
+func (e *Exec) context() (context.Context, context.CancelFunc) {
+	if e.Timeout > 0 {
+		return context.WithTimeout(context.Background(), e.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (e *Exec) command(ctx context.Context, path string, args []string, sh bool) *rio.Cmd {
+	cmd := &rio.Cmd{
+		Path:    path,
+		Args:    args,
+		Dir:     e.Dir,
+		Shell:   sh,
+		Context: ctx,
+	}
+
+	if sh {
+		for _, env := range e.Env {
+			eq := strings.IndexByte(env, '=')
+			cmd.Env = append(cmd.Env, [2]string{env[:eq], env[eq+1:]})
+		}
+	} else if len(e.Env) > 0 {
+		// Setting environment variables over SSH rarely works without a
+		// shell, so have env(1) do it.
+		cmd.Path = "env"
+		cmd.Args = append(append(append([]string{}, e.Env...), path), args...)
+	}
+
+	if e.User == "" {
+		return cmd
+	}
+
+	// su wants a single command line for the shell, so everything has to be
+	// spelled out in it.
+	line := cmd.Path
+	for _, a := range cmd.Args {
+		line += " " + shell.ReadableEscapeArg(a)
+	}
+	for _, env := range cmd.Env {
+		line = "export " + shell.ReadableEscapeArg(env[0]) + "=" + shell.ReadableEscapeArg(env[1]) + "; " + line
+	}
+	if e.Dir != "" {
+		line = "cd " + shell.ReadableEscapeArg(e.Dir) + " && " + line
+	}
+
+	return &rio.Cmd{
+		Path:    "su",
+		Args:    []string{"-s", "/bin/sh", e.User, "-c", line},
+		Context: ctx,
+	}
+}
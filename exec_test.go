@@ -0,0 +1,37 @@
+package khan
+
+import (
+	"testing"
+
+	"khan.rip/rio/local"
+)
+
+func TestExecGuard(t *testing.T) {
+	rh := local.New()
+	defer rh.Cleanup()
+	host := newtestrun(rh).Hosts[0]
+
+	tests := []struct {
+		line string
+		want bool
+		err  bool
+	}{
+		{"true", true, false},
+		{"false", false, false},
+		{"exit 3", false, false},
+		{"test -e /nonexistent/khan", false, false},
+		{"khan-no-such-command", false, true},
+		{"exit 126", false, true},
+		{"exit 127", false, true},
+	}
+	for _, test := range tests {
+		e := &Exec{Command: "true"}
+		ok, err := e.guard(host, test.line)
+		if (err != nil) != test.err {
+			t.Errorf("%#v: error %v", test.line, err)
+		}
+		if ok != test.want {
+			t.Errorf("%#v: got %v, want %v", test.line, ok, test.want)
+		}
+	}
+}
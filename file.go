@@ -1,15 +1,18 @@
 package khan
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/user"
+	"path"
+	"sort"
 	"strings"
 	"syscall"
 
+	"khan.rip/rio"
 	"khan.rip/rio/util"
 
 	"github.com/pmezard/go-difflib/difflib"
@@ -26,7 +29,9 @@ type File struct {
 	Content string
 
 	// Src is a path on the configurer for the source of the file.
-	// This will be bundled into your khan build output.
+	// This will be bundled into your khan build output. If it is a
+	// directory, the whole tree is copied to Path, and each file keeps its
+	// mode unless Mode is set.
 	Src string `khan:"src,shortvalue"`
 
 	// Local is a path on the configuree for the source of the file
@@ -37,8 +42,15 @@ type File struct {
 	// a jinja2 style template engine. (See https://github.com/flosch/pongo2)
 	Template string
 
+	// TemplateSuffix, when Src is a directory, templates only the files
+	// whose names end with it, and removes it from their names. (So with
+	// ".j2", "nginx.conf.j2" is templated and written out as "nginx.conf".)
+	TemplateSuffix string
+
 	Delete bool
 
+	Meta
+
 	id int
 }
 
@@ -62,6 +74,9 @@ func (f *File) Validate() error {
 	if f.Path == "" {
 		return errors.New("File path is required")
 	}
+	if f.TemplateSuffix != "" && f.Src == "" {
+		return fmt.Errorf("File %#v template suffix only works with a src directory", f.Path)
+	}
 	return nil
 }
 
@@ -76,7 +91,7 @@ func (f *File) After() []string {
 	if f.Delete {
 		return nil
 	}
-	var afters []string
+	afters := parentpaths(f.Path)
 	if f.Local != "" {
 		afters = append(afters, "path:"+f.Local)
 	}
@@ -97,6 +112,8 @@ func (f *File) Provides() []string {
 }
 
 func (f *File) Apply(host *Host) (itemStatus, error) {
+	tree := f.Src != "" && f.srcdir(host, f.Src)
+
 	if f.Delete {
 		_, err := host.rh.Stat(f.Path)
 		if err != nil && iserrnotfound(err) {
@@ -105,14 +122,27 @@ func (f *File) Apply(host *Host) (itemStatus, error) {
 		if err != nil {
 			return 0, err
 		}
-		if err := host.rh.Remove(f.Path); err != nil {
+		if tree {
+			err = host.rh.RemoveAll(f.Path)
+		} else {
+			err = host.rh.Remove(f.Path)
+		}
+		if err != nil {
 			return 0, err
 		}
 		return itemDeleted, nil
 	}
 
+	if tree {
+		return f.applytree(host, path.Clean(f.Src), path.Clean(f.Path))
+	}
+
 	content := f.Content
 
+	// open gets the content from the start. Files from Src or Local are
+	// streamed rather than loaded, since they can be huge.
+	var open func() (io.ReadCloser, error)
+
 	engine := f.Template
 	if engine == "1" || engine == "true" || engine == "yes" || engine == "pongo" {
 		engine = "pongo2"
@@ -135,39 +165,52 @@ func (f *File) Apply(host *Host) (itemStatus, error) {
 	} else if engine == "" {
 		// raw file mode
 		if f.Src != "" {
-			fh, err := host.Run.assetfn(f.Src)
-			if err != nil {
-				return 0, err
-			}
-			defer fh.Close()
-			buf := &bytes.Buffer{}
-			if _, err := io.Copy(buf, fh); err != nil {
-				return 0, err
+			open = func() (io.ReadCloser, error) {
+				return host.Run.assetfn(f.Src)
 			}
-			content = buf.String()
 		} else if f.Local != "" {
 			// copy from another path on managed host
-			srcbuf, err := host.rh.ReadFile(f.Local)
-			if err != nil {
-				return 0, err
+			open = func() (io.ReadCloser, error) {
+				return host.rh.Open(f.Local)
 			}
-			content = string(srcbuf)
 		}
 		// else: assume Content is the content. (Blank means a blank file.)
 	} else {
 		return 0, fmt.Errorf("Unknown template engine %#v", engine)
 	}
 
-	var (
-		buf []byte
-		err error
-	)
+	if open == nil {
+		open = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		}
+	}
 
-	buf, err = host.rh.ReadFile(f.Path)
+	var want string
+	if f.Local != "" {
+		// The host can hash it where it is
+		var err error
+		if want, err = host.rh.Hash(f.Local); err != nil {
+			return 0, err
+		}
+	} else {
+		fh, err := open()
+		if err != nil {
+			return 0, err
+		}
+		want, err = util.HashReader(fh)
+		fh.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Only the hash comes back, so big files that haven't changed don't
+	// have to be read.
+	hash, err := host.rh.Hash(f.Path)
 
 	status := itemModified
 
-	if err == nil && bytes.Compare(buf, []byte(content)) == 0 {
+	if err == nil && hash == want {
 		pstatus, err := f.applyperms(host, f.Path)
 		if err != nil {
 			return 0, err
@@ -182,58 +225,213 @@ func (f *File) Apply(host *Host) (itemStatus, error) {
 		}
 	}
 
-	if host.Run.Diff {
-		// This is cute but actually ugly.
-		// import "github.com/sergi/go-diff/diffmatchpatch"
-		//dmp := diffmatchpatch.New()
-		//diffs := dmp.DiffMain(string(buf), content, true)
-		//fmt.Println(dmp.DiffPrettyText(diffs))
-
-		// this seems nicer
-		diff := difflib.UnifiedDiff{
-			A:        difflib.SplitLines(string(buf)),
-			B:        difflib.SplitLines(content),
-			FromFile: f.Path,
-			ToFile:   f.Path,
-			Context:  3,
+	if err := showstreamdiff(host, f.Path, status == itemModified, open); err != nil {
+		return 0, err
+	}
+
+	fh, err := open()
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	// hosts that don't keep big content can read it from the source again
+	err = writefile(host, f.Path, &rio.Source{Reader: fh, Open: open}, func(tmpfile string) error {
+		_, err := f.applyperms(host, tmpfile)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return status, nil
+}
+
+// srcdir says whether a bundled source is a directory
+func (f *File) srcdir(host *Host, src string) bool {
+	if host.Run.assetdirfn == nil {
+		return false
+	}
+	_, err := host.Run.assetdirfn(path.Clean(src))
+	return err == nil
+}
+
+// applytree mirrors a bundled directory to dst, by applying a Directory or
+// File for everything in it.
+func (f *File) applytree(host *Host, src, dst string) (itemStatus, error) {
+	names, err := host.Run.assetdirfn(src)
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(names)
+
+	dir := &Directory{
+		Path:  dst,
+		User:  f.User,
+		Group: f.Group,
+	}
+	status, err := dir.Apply(host)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range names {
+		s := src + "/" + name
+		d := path.Join(dst, name)
+
+		var sstatus itemStatus
+		if f.srcdir(host, s) {
+			sstatus, err = f.applytree(host, s, d)
+		} else {
+			file := &File{
+				Path:     d,
+				User:     f.User,
+				Group:    f.Group,
+				Mode:     f.Mode,
+				Src:      s,
+				Template: f.Template,
+			}
+			if f.TemplateSuffix != "" {
+				file.Template = ""
+				if strings.HasSuffix(name, f.TemplateSuffix) {
+					file.Path = strings.TrimSuffix(d, f.TemplateSuffix)
+					file.Template = f.Template
+					if file.Template == "" {
+						file.Template = "pongo2"
+					}
+				}
+			}
+			if file.Mode == 0 && host.Run.assetinfofn != nil {
+				info, err := host.Run.assetinfofn(s)
+				if err != nil {
+					return 0, err
+				}
+				file.Mode = info.Mode() & util.S_justmode
+			}
+			sstatus, err = file.Apply(host)
 		}
-		difftxt, err := difflib.GetUnifiedDiffString(diff)
 		if err != nil {
 			return 0, err
 		}
-		fmt.Print(difftxt)
+		if sstatus != itemUnchanged && status == itemUnchanged {
+			status = itemModified
+		}
+	}
+
+	return status, nil
+}
+
+// Files bigger than this are too much to diff
+const maxdiff = 1024 * 1024
+
+// showstreamdiff is showdiff for content that could be too big to hold in
+// memory. The old content is only read if it exists.
+func showstreamdiff(host *Host, fpath string, exists bool, open func() (io.ReadCloser, error)) error {
+	if !host.Run.Diff {
+		return nil
+	}
+
+	old := ""
+	if exists {
+		fh, err := host.rh.Open(fpath)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if old, ok, err = readdiffable(fpath, fh); err != nil || !ok {
+			return err
+		}
+	}
+
+	fh, err := open()
+	if err != nil {
+		return err
+	}
+	new, ok, err := readdiffable(fpath, fh)
+	if err != nil || !ok {
+		return err
+	}
+
+	return showdiff(host, fpath, old, new)
+}
+
+// readdiffable reads and closes fh, unless it's too big to diff
+func readdiffable(fpath string, fh io.ReadCloser) (string, bool, error) {
+	defer fh.Close()
+	// Some readers know up front, and can't always be read (like dry
+	// run files that only have their hash kept)
+	if s, ok := fh.(interface{ Size() int64 }); ok && s.Size() > maxdiff {
+		fmt.Printf("%s is too big to diff\n", fpath)
+		return "", false, nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(fh, maxdiff+1))
+	if err != nil {
+		return "", false, err
 	}
+	if len(buf) > maxdiff {
+		fmt.Printf("%s is too big to diff\n", fpath)
+		return "", false, nil
+	}
+	return string(buf), true, nil
+}
+
+// showdiff prints what is about to change in a file, if we were asked to
+func showdiff(host *Host, fpath, old, new string) error {
+	if !host.Run.Diff {
+		return nil
+	}
+
+	// This is cute but actually ugly.
+	// import "github.com/sergi/go-diff/diffmatchpatch"
+	//dmp := diffmatchpatch.New()
+	//diffs := dmp.DiffMain(old, new, true)
+	//fmt.Println(dmp.DiffPrettyText(diffs))
 
-	// Try to make this as atomic as possible by doing the write to a temp
-	// file, getting the perms right, and when finished doing a mv to the
-	// final path.
+	// this seems nicer
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(old),
+		B:        difflib.SplitLines(new),
+		FromFile: fpath,
+		ToFile:   fpath,
+		Context:  3,
+	}
+	difftxt, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return err
+	}
+	fmt.Print(difftxt)
+	return nil
+}
 
+// writefile tries to make replacing a file as atomic as possible by doing the
+// write to a temp file, getting the perms right, and when finished doing a mv
+// to the final path.
+func writefile(host *Host, fpath string, content io.Reader, perms func(tmpfile string) error) error {
 	tmpfile, err := host.rh.TmpFile()
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	fh, err := host.rh.Create(tmpfile)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	defer fh.Close()
-	if _, err := fh.Write([]byte(content)); err != nil {
-		return 0, err
+	if _, err := io.Copy(fh, content); err != nil {
+		return err
 	}
 	if err := fh.Close(); err != nil {
-		return 0, err
+		return err
 	}
 
-	if _, err := f.applyperms(host, tmpfile); err != nil {
-		return 0, err
+	if err := perms(tmpfile); err != nil {
+		return err
 	}
 
-	if err := host.rh.Rename(tmpfile, f.Path); err != nil {
-		return 0, err
+	if err := host.rh.Rename(tmpfile, fpath); err != nil {
+		return err
 	}
-
-	return status, nil
+	return nil
 }
 
 func (f *File) applyperms(host *Host, fpath string) (itemStatus, error) {
@@ -242,59 +440,65 @@ func (f *File) applyperms(host *Host, fpath string) (itemStatus, error) {
 		mode = 0644
 	}
 
-	ustr := f.User
+	uid, gid, err := resolveowner(host, f, f.User, f.Group)
+	if err != nil {
+		return 0, err
+	}
+
+	return applyperms(host, fpath, uid, gid, mode)
+}
+
+// resolveowner looks up the uid and gid for a managed path. A blank user is
+// the user items run as, and a blank group is the user's primary group.
+func resolveowner(host *Host, item Item, ustr, gstr string) (uint32, uint32, error) {
+	if ustr == "" {
+		ustr = host.User
+	}
 	if ustr == "" {
+		// hosts made without main.go's help
 		at := strings.IndexByte(host.Host, '@')
 		if host.SSH && at > -1 {
 			ustr = host.Host[:at]
 		} else {
 			osu, err := user.Current()
 			if err != nil {
-				return 0, err
+				return 0, 0, err
 			}
 			ustr = osu.Username
 		}
 	}
 	if ustr == "" {
-		return 0, fmt.Errorf("Cannot determine user for managed file %v", f)
+		return 0, 0, fmt.Errorf("Cannot determine user for managed file %v", item)
 	}
 
 	user, err := host.rh.User(ustr)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	if user == nil {
+		return 0, 0, fmt.Errorf("Unknown user %#v", ustr)
 	}
 
-	gstr := f.Group
 	if gstr == "" {
 		gstr = user.Group
 	}
 
 	if gstr == "" {
-		return 0, fmt.Errorf("Cannot determine group for managed file %v", f)
+		return 0, 0, fmt.Errorf("Cannot determine group for managed file %v", item)
 	}
 
 	group, err := host.rh.Group(gstr)
 	if err != nil {
-		return 0, err
-	}
-
-	var (
-		uid     uint32
-		gid     uint32
-		wantuid uint32
-		wantgid uint32
-	)
-
-	if user == nil {
-		return 0, fmt.Errorf("Unknown user %#v", ustr)
+		return 0, 0, err
 	}
 	if group == nil {
-		return 0, fmt.Errorf("Unknown group %#v", gstr)
+		return 0, 0, fmt.Errorf("Unknown group %#v", gstr)
 	}
 
-	wantuid = user.Uid
-	wantgid = group.Gid
+	return user.Uid, group.Gid, nil
+}
 
+func applyperms(host *Host, fpath string, wantuid, wantgid uint32, mode os.FileMode) (itemStatus, error) {
 	fi, err := host.rh.Stat(fpath)
 	if err != nil {
 		return 0, err
@@ -305,8 +509,8 @@ func (f *File) applyperms(host *Host, fpath string) (itemStatus, error) {
 		return 0, err
 	}
 
-	uid = ufi.Fuid
-	gid = ufi.Fgid
+	uid := ufi.Fuid
+	gid := ufi.Fgid
 
 	status := itemUnchanged
 
@@ -339,3 +543,92 @@ func iserrnotfound(err error) bool {
 	}
 	return false
 }
+
+// editfile applies edit to the content of a file that other items may also be
+// editing. A missing file is only created if create is set, and then it gets
+// the given ownership and mode. An existing file keeps its own.
+func editfile(host *Host, item Item, fpath string, create bool, ustr, gstr string, mode os.FileMode, edit func(string) (string, error)) (itemStatus, error) {
+	unlock := host.lockfile(fpath)
+	defer unlock()
+
+	status := itemModified
+
+	buf, err := host.rh.ReadFile(fpath)
+	if err != nil {
+		if !iserrnotfound(err) {
+			return 0, err
+		}
+		status = itemCreated
+	}
+
+	old := string(buf)
+	content, err := edit(old)
+	if err != nil {
+		return 0, err
+	}
+
+	if status == itemCreated {
+		if content == "" {
+			return itemUnchanged, nil
+		}
+		if !create {
+			return 0, fmt.Errorf("%#v does not exist", fpath)
+		}
+	} else if content == old {
+		return itemUnchanged, nil
+	}
+
+	var uid, gid uint32
+	if status == itemCreated {
+		if mode == 0 {
+			mode = 0644
+		}
+		if uid, gid, err = resolveowner(host, item, ustr, gstr); err != nil {
+			return 0, err
+		}
+	} else {
+		fi, err := host.rh.Stat(fpath)
+		if err != nil {
+			return 0, err
+		}
+		ufi, err := util.ConvertStat(fi)
+		if err != nil {
+			return 0, err
+		}
+		uid, gid, mode = ufi.Fuid, ufi.Fgid, fi.Mode()&util.S_justmode
+	}
+
+	if err := showdiff(host, fpath, old, content); err != nil {
+		return 0, err
+	}
+
+	err = writefile(host, fpath, strings.NewReader(content), func(tmpfile string) error {
+		_, err := applyperms(host, tmpfile, uid, gid, mode)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return status, nil
+}
+
+// editlines adapts a line by line edit for editfile
+func editlines(edit func([]string) ([]string, error)) func(string) (string, error) {
+	return func(content string) (string, error) {
+		var lines []string
+		if content != "" {
+			lines = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+		}
+
+		lines, err := edit(lines)
+		if err != nil {
+			return "", err
+		}
+
+		if len(lines) == 0 {
+			return "", nil
+		}
+		return strings.Join(lines, "\n") + "\n", nil
+	}
+}
@@ -6,8 +6,14 @@ import (
 
 type FuncType func(*Host) error
 
+// Function runs arbitrary Go code. If it subscribes to other items, or other
+// items notify it (as "func:<name>"), it only runs when one of them changes.
 type Function struct {
-	Fn FuncType
+	Fn   FuncType
+	Name string
+
+	Meta
+
 	id int
 }
 
@@ -18,6 +24,9 @@ func Func(fn FuncType) Item {
 }
 
 func (f *Function) String() string {
+	if f.Name != "" {
+		return f.Name
+	}
 	return "function"
 }
 
@@ -51,9 +60,23 @@ func (f *Function) Before() []string {
 	return nil
 }
 func (f *Function) Provides() []string {
+	if f.Name != "" {
+		return []string{"func:" + f.Name}
+	}
 	return nil
 }
 
 func (f *Function) Apply(host *Host) (itemStatus, error) {
 	return itemUnchanged, f.Fn(host)
 }
+
+func (f *Function) handler() bool {
+	return true
+}
+
+func (f *Function) Notified(host *Host) (itemStatus, error) {
+	if err := f.Fn(host); err != nil {
+		return 0, err
+	}
+	return itemModified, nil
+}
@@ -12,6 +12,8 @@ type Group struct {
 
 	Delete bool
 
+	Meta
+
 	id int
 }
 
@@ -3,6 +3,7 @@ package khan
 import (
 	"fmt"
 	"runtime"
+	"sync"
 
 	"khan.rip/rio"
 )
@@ -17,7 +18,26 @@ type Host struct {
 	SSH  bool
 	Host string // Host for SSH
 
+	// User is who items run as: the become user, or else who we log in as
+	User string
+
+	// From the inventory, if it's in there
+	Groups []string
+	Vars   map[string]interface{}
+
 	rh rio.Host
+
+	// push is whether the run happens on the host itself, through a copy
+	// of this binary (see agent.go)
+	push bool
+
+	pkgs pkgbatch
+
+	editsmu sync.Mutex
+	edits   map[string]*sync.Mutex
+
+	tplmu   sync.Mutex
+	tplhost map[string]interface{}
 }
 
 func (host *Host) Key() string {
@@ -30,6 +50,20 @@ func (host *Host) String() string {
 	return host.rh.String()
 }
 
+// targets is whether an item is meant for this host
+func (host *Host) targets(item Item) bool {
+	m, ok := item.(metaer)
+	if !ok || len(m.meta().Hosts) == 0 {
+		return true
+	}
+	for _, t := range m.meta().Hosts {
+		if t == "all" || t == host.Name || contains(host.Groups, t) {
+			return true
+		}
+	}
+	return false
+}
+
 func (host *Host) Add(add ...Item) error {
 	_, fn, line, _ := runtime.Caller(1)
 	source := fmt.Sprintf("%s:%d", fn, line)
@@ -48,6 +82,24 @@ func (host *Host) AddFromSource(source string, add ...Item) error {
 	return nil
 }
 
+// lockfile serializes items that edit part of the same file, since each of
+// them reads the whole thing and writes it back.
+func (host *Host) lockfile(fpath string) func() {
+	host.editsmu.Lock()
+	if host.edits == nil {
+		host.edits = map[string]*sync.Mutex{}
+	}
+	mu, ok := host.edits[fpath]
+	if !ok {
+		mu = &sync.Mutex{}
+		host.edits[fpath] = mu
+	}
+	host.editsmu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
 func (host *Host) OS() (string, error) {
 	info, err := host.rh.Info()
 	if err != nil {
@@ -55,3 +107,10 @@ func (host *Host) OS() (string, error) {
 	}
 	return info.OS, nil
 }
+
+// Facts are what the host is running on, like its distro, CPUs and network
+// addresses, for Func items to decide what to do with. They are gathered the
+// first time they're asked for.
+func (host *Host) Facts() (*rio.Facts, error) {
+	return host.rh.Facts()
+}
@@ -0,0 +1,386 @@
+package khan
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host keys pinned into the binary at build time, in known_hosts format
+var mainknownhosts string
+
+// SetKnownHosts pins these host keys (in known_hosts format). khan build
+// calls it with the known_hosts file next to your yaml, if there is one, so
+// the binary can check hosts all by itself. Hosts with pinned keys are only
+// checked against those, never ~/.ssh/known_hosts or any other file.
+func SetKnownHosts(s string) {
+	mainknownhosts = s
+}
+
+// hostkeys checks the keys of remote hosts against known_hosts files
+type hostkeys struct {
+	insecure bool
+	tofu     bool
+
+	// new keys are written here when trusting on first use
+	userfile string
+
+	pinned   []pinnedkey
+	callback ssh.HostKeyCallback
+
+	mu      sync.Mutex
+	trusted map[string]ssh.PublicKey // trusted on first use during this run
+}
+
+func newhostkeys(files []string, tofu, insecure bool) (*hostkeys, error) {
+	hk := &hostkeys{
+		insecure: insecure,
+		tofu:     tofu,
+		trusted:  map[string]ssh.PublicKey{},
+	}
+	if insecure {
+		return hk, nil
+	}
+
+	var err error
+	if hk.pinned, err = parsepinned(mainknownhosts); err != nil {
+		return nil, err
+	}
+
+	var all []string
+
+	home, err := os.UserHomeDir()
+	if err == nil {
+		hk.userfile = filepath.Join(home, ".ssh", "known_hosts")
+		if _, err := os.Stat(hk.userfile); err == nil {
+			all = append(all, hk.userfile)
+		}
+	} else if tofu {
+		return nil, fmt.Errorf("Can't trust on first use without a home directory: %w", err)
+	}
+
+	all = append(all, files...)
+
+	if hk.callback, err = knownhosts.New(all...); err != nil {
+		return nil, err
+	}
+	return hk, nil
+}
+
+func (hk *hostkeys) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if hk.insecure {
+		return nil
+	}
+
+	err := hk.verify(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	fingerprint := key.Type() + " " + ssh.FingerprintSHA256(key)
+	name := knownhosts.Normalize(hostname)
+
+	var revoked *knownhosts.RevokedError
+	if errors.As(err, &revoked) {
+		return fmt.Errorf("Host key for %s is revoked (%s, %s:%d)", name, fingerprint, revoked.Revoked.Filename, revoked.Revoked.Line)
+	}
+
+	var keyerr *knownhosts.KeyError
+	if !errors.As(err, &keyerr) {
+		return err
+	}
+
+	if len(keyerr.Want) > 0 {
+		msg := fmt.Sprintf("HOST KEY FOR %s HAS CHANGED! Someone could be eavesdropping on you. It sent %s, but we know it as:", name, fingerprint)
+		for _, want := range keyerr.Want {
+			msg += fmt.Sprintf("\n    %s %s (%s:%d)", want.Key.Type(), ssh.FingerprintSHA256(want.Key), want.Filename, want.Line)
+		}
+		return errors.New(msg)
+	}
+
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	if trusted, ok := hk.trusted[name]; ok {
+		if string(trusted.Marshal()) == string(key.Marshal()) {
+			return nil
+		}
+		return fmt.Errorf("HOST KEY FOR %s HAS CHANGED! It sent %s, but it sent %s %s earlier", name, fingerprint, trusted.Type(), ssh.FingerprintSHA256(trusted))
+	}
+
+	if !hk.tofu {
+		return fmt.Errorf("Host key for %s is not known (%s). Add it to known_hosts, or use --tofu to trust it on first use", name, fingerprint)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(hk.userfile), 0700); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(hk.userfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(fh, knownhosts.Line([]string{hostname}, key)); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	hk.trusted[name] = key
+	fmt.Fprintf(os.Stderr, "Permanently added %s (%s) to %s\n", name, fingerprint, hk.userfile)
+	return nil
+}
+
+// hostkeyorder is the order host key types are asked for in, best first
+var hostkeyorder = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+}
+
+// algorithms returns the types of keys known for a host, so it can be asked
+// for one of those instead of whatever it likes best. Otherwise a host we
+// only know the ed25519 key of could send its ecdsa key and look like it
+// changed. It returns nil for hosts we don't know anything about.
+func (hk *hostkeys) algorithms(hostport string) []string {
+	if hk.insecure {
+		return nil
+	}
+
+	// Asking about a key nobody has makes knownhosts list the keys it does
+	// know about.
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+
+	var keyerr *knownhosts.KeyError
+	if !errors.As(hk.verify(hostport, &net.TCPAddr{IP: net.IPv4zero}, probe), &keyerr) {
+		return nil
+	}
+
+	// knownhosts finds them in no particular order
+	seen := map[string]bool{}
+	for _, want := range keyerr.Want {
+		seen[want.Key.Type()] = true
+	}
+	var types, others []string
+	for _, typ := range hostkeyorder {
+		if seen[typ] {
+			types = append(types, typ)
+			delete(seen, typ)
+		}
+	}
+	for typ := range seen {
+		others = append(others, typ)
+	}
+	sort.Strings(others)
+	types = append(types, others...)
+
+	var algos, certs []string
+	for _, typ := range types {
+		// An RSA key can sign with SHA-2, and servers these days won't
+		// sign with anything else
+		names := []string{typ}
+		if typ == ssh.KeyAlgoRSA {
+			names = []string{ssh.SigAlgoRSASHA2512, ssh.SigAlgoRSASHA2256, ssh.KeyAlgoRSA}
+		}
+		for _, name := range names {
+			algos = append(algos, name)
+			// the host may present a certificate for the key instead
+			certs = append(certs, name+"-cert-v01@openssh.com")
+		}
+	}
+	return append(algos, certs...)
+}
+
+// verify checks a key against the pinned keys for hosts that have any, and
+// against the known_hosts files for everything else. The errors are
+// knownhosts' either way.
+func (hk *hostkeys) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	addrs := []string{knownhosts.Normalize(hostname)}
+	if tcp, ok := remote.(*net.TCPAddr); ok && !tcp.IP.IsUnspecified() {
+		addrs = append(addrs, knownhosts.Normalize(remote.String()))
+	}
+
+	var want []knownhosts.KnownKey
+	var cas []ssh.PublicKey
+	for _, p := range hk.pinned {
+		if p.marker == "revoked" {
+			if samekey(p.key, key) {
+				return &knownhosts.RevokedError{Revoked: p.known()}
+			}
+			continue
+		}
+		if !p.matches(addrs) {
+			continue
+		}
+		if p.marker == "cert-authority" {
+			cas = append(cas, p.key)
+		} else {
+			want = append(want, p.known())
+		}
+	}
+	if len(want) == 0 && len(cas) == 0 {
+		return hk.callback(hostname, remote, key)
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok && len(cas) > 0 {
+		cc := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+				for _, ca := range cas {
+					if samekey(ca, auth) {
+						return true
+					}
+				}
+				return false
+			},
+		}
+		return cc.CheckHostKey(hostname, remote, cert)
+	}
+
+	for _, w := range want {
+		if samekey(w.Key, key) {
+			return nil
+		}
+	}
+	return &knownhosts.KeyError{Want: want}
+}
+
+func samekey(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// pinnedkey is a line of the known_hosts pinned into the binary
+type pinnedkey struct {
+	marker   string
+	patterns []string
+	key      ssh.PublicKey
+	line     int
+}
+
+func parsepinned(s string) ([]pinnedkey, error) {
+	all := []byte(s)
+	rest := all
+
+	var pinned []pinnedkey
+	for {
+		marker, patterns, key, _, next, err := ssh.ParseKnownHosts(rest)
+		if err == io.EOF {
+			return pinned, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Pinned known_hosts: %w", err)
+		}
+		line := bytes.Count(all[:len(all)-len(next)], []byte("\n"))
+		if len(next) == 0 && !bytes.HasSuffix(all, []byte("\n")) {
+			line++
+		}
+		pinned = append(pinned, pinnedkey{marker: marker, patterns: patterns, key: key, line: line})
+		rest = next
+	}
+}
+
+func (p *pinnedkey) known() knownhosts.KnownKey {
+	return knownhosts.KnownKey{Key: p.key, Filename: "pinned known_hosts", Line: p.line}
+}
+
+// matches is whether the line is for any of addrs, which are normalized like
+// knownhosts.Normalize does. Like ssh, a negated pattern that matches rules
+// the line out whatever else does.
+func (p *pinnedkey) matches(addrs []string) bool {
+next:
+	for _, addr := range addrs {
+		match := false
+		for _, pattern := range p.patterns {
+			negated := strings.HasPrefix(pattern, "!")
+			if !hostmatch(strings.TrimPrefix(pattern, "!"), addr) {
+				continue
+			}
+			if negated {
+				continue next
+			}
+			match = true
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// hostmatch matches an address against a known_hosts pattern, which can be
+// hashed or have wildcards in it
+func hostmatch(pattern, addr string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(addr))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		return knownhosts.Normalize(pattern) == addr
+	}
+	return wildcard(pattern, addr)
+}
+
+// wildcard matches s against a pattern where * is any run of characters and ?
+// is any one
+func wildcard(pattern, s string) bool {
+	for ; pattern != ""; pattern = pattern[1:] {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if wildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s = s[1:]
+	}
+	return s == ""
+}
@@ -0,0 +1,216 @@
+package khan
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKeys(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "khan_hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// keep away from the real ~/.ssh/known_hosts
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", tmp)
+
+	edpub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, _ := ssh.NewPublicKey(edpub)
+	rsapub, _ := ssh.NewPublicKey(&rsakey.PublicKey)
+	ecdsapub, _ := ssh.NewPublicKey(&ecdsakey.PublicKey)
+
+	file := filepath.Join(tmp, "known_hosts")
+	lines := []string{
+		knownhosts.Line([]string{"one"}, ed),
+		knownhosts.Line([]string{"two"}, rsapub),
+		knownhosts.Line([]string{"two"}, ecdsapub),
+		knownhosts.Line([]string{"[three]:2222"}, ed),
+	}
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hk, err := newhostkeys([]string{file}, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	algotests := []struct {
+		hostport string
+		want     []string
+	}{
+		{"one:22", []string{"ssh-ed25519", "ssh-ed25519-cert-v01@openssh.com"}},
+		{"two:22", []string{
+			"ecdsa-sha2-nistp256", "rsa-sha2-512", "rsa-sha2-256", "ssh-rsa",
+			"ecdsa-sha2-nistp256-cert-v01@openssh.com", "rsa-sha2-512-cert-v01@openssh.com", "rsa-sha2-256-cert-v01@openssh.com", "ssh-rsa-cert-v01@openssh.com",
+		}},
+		{"three:2222", []string{"ssh-ed25519", "ssh-ed25519-cert-v01@openssh.com"}},
+		{"three:22", nil},
+		{"four:22", nil},
+	}
+	for _, test := range algotests {
+		got := hk.algorithms(test.hostport)
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s: got %v, want %v", test.hostport, got, test.want)
+		}
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	checktests := []struct {
+		hostname string
+		key      ssh.PublicKey
+		err      string
+	}{
+		{"one:22", ed, ""},
+		{"two:22", ecdsapub, ""},
+		{"two:22", rsapub, ""},
+		{"one:22", rsapub, "HAS CHANGED"},
+		{"three:2222", ed, ""},
+		{"three:22", ed, "not known"},
+	}
+	for _, test := range checktests {
+		err := hk.check(test.hostname, addr, test.key)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s %s: %v", test.hostname, test.key.Type(), err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s %s: got error %v, want %#v", test.hostname, test.key.Type(), err, test.err)
+		}
+	}
+
+	tofu, err := newhostkeys([]string{file}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tofu.check("four:22", addr, ed); err != nil {
+		t.Errorf("Trusting on first use: %v", err)
+	}
+	if err := tofu.check("four:22", addr, rsapub); err == nil || !strings.Contains(err.Error(), "HAS CHANGED") {
+		t.Errorf("Trusted another key for the same host: %v", err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(tmp, ".ssh", "known_hosts")); err != nil || !strings.HasPrefix(string(buf), "four ssh-ed25519 ") {
+		t.Errorf("Trusted key wasn't saved: %#v (%v)", string(buf), err)
+	}
+
+	insecure, err := newhostkeys(nil, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algos := insecure.algorithms("one:22"); algos != nil {
+		t.Errorf("Insecure asked for %v", algos)
+	}
+	if err := insecure.check("four:22", addr, ed); err != nil {
+		t.Errorf("Insecure checked the key: %v", err)
+	}
+}
+
+func TestPinnedHostKeys(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "khan_hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", tmp)
+
+	newkey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	ecdsakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsapub, _ := ssh.NewPublicKey(&ecdsakey.PublicKey)
+	ed, wild, revoked := newkey(), newkey(), newkey()
+
+	// the user's file knows "one" by a key that isn't pinned
+	file := filepath.Join(tmp, "known_hosts")
+	lines := []string{
+		knownhosts.Line([]string{"one"}, ed),
+		knownhosts.Line([]string{"two"}, ed),
+	}
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := mainknownhosts
+	defer SetKnownHosts(pinned)
+	SetKnownHosts(strings.Join([]string{
+		"# pinned at build time",
+		knownhosts.Line([]string{"one"}, ecdsapub),
+		knownhosts.Line([]string{knownhosts.HashHostname("[five]:2200")}, ed),
+		knownhosts.Line([]string{"*.wild", "!bad.wild"}, wild),
+		"@revoked * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(revoked))),
+	}, "\n"))
+
+	hk, err := newhostkeys([]string{file}, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	tests := []struct {
+		hostname string
+		key      ssh.PublicKey
+		err      string
+	}{
+		{"one:22", ecdsapub, ""},
+		{"one:22", ed, "pinned known_hosts:2"},
+		{"two:22", ed, ""},
+		{"[five]:2200", ed, ""},
+		{"five:22", ed, "not known"},
+		{"x.wild:22", wild, ""},
+		{"bad.wild:22", wild, "not known"},
+		{"x.wild:22", revoked, "revoked"},
+	}
+	for _, test := range tests {
+		err := hk.check(test.hostname, addr, test.key)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s %s: %v", test.hostname, test.key.Type(), err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s %s: got error %v, want %#v", test.hostname, test.key.Type(), err, test.err)
+		}
+	}
+
+	// only the pinned key's type is asked for
+	if got := hk.algorithms("one:22"); strings.Join(got, " ") != "ecdsa-sha2-nistp256 ecdsa-sha2-nistp256-cert-v01@openssh.com" {
+		t.Errorf("one:22 asked for %v", got)
+	}
+}
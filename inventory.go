@@ -0,0 +1,176 @@
+package khan
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InventoryFile is looked for next to your yaml by khan build. It isn't
+// items like the other yaml files, it's the hosts you manage:
+//
+//	vars:
+//	  dns: 10.0.0.53
+//	groups:
+//	  web:
+//	    vars:
+//	      port: 8080
+//	hosts:
+//	  web1:
+//	    connect: root@10.0.0.11
+//	    jump: bastion
+//	    groups: [web]
+//	  db1:
+//	    vars:
+//	      port: 5432
+//
+// Items can then be given "hosts: web" to only go on the web group, and the
+// binary can be run with -g web. Every host is in the group "all".
+const InventoryFile = "inventory.yaml"
+
+var maininventory *Inventory
+
+// SetInventory sets the hosts the binary knows about. khan build calls it
+// with the inventory file, if there is one.
+func SetInventory(s string) {
+	inv, err := ParseInventory([]byte(s))
+	if err != nil {
+		// khan build already checked it
+		panic(err)
+	}
+	maininventory = inv
+}
+
+type Inventory struct {
+	// Vars are for every host
+	Vars map[string]interface{}
+
+	Groups map[string]*InventoryGroup
+	Hosts  map[string]*InventoryHost
+}
+
+type InventoryGroup struct {
+	Vars map[string]interface{}
+}
+
+type InventoryHost struct {
+	// Connect is how to reach it over SSH, as [user@]host[:port] or an
+	// ssh_config alias. If blank, it's the host's name.
+	Connect string
+
+	// Jump is the jump hosts to connect through, like ProxyJump in
+	// ssh_config ("jump1,jump2", or "none"). --jump wins over it.
+	Jump string
+
+	Groups []string
+
+	// Vars win over those of its groups, which win over the inventory's
+	Vars map[string]interface{}
+}
+
+func ParseInventory(buf []byte) (*Inventory, error) {
+	inv := &Inventory{}
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(inv); err != nil {
+		return nil, err
+	}
+	if inv.Groups == nil {
+		inv.Groups = map[string]*InventoryGroup{}
+	}
+	if inv.Hosts == nil {
+		inv.Hosts = map[string]*InventoryHost{}
+	}
+
+	for name, h := range inv.Hosts {
+		if h == nil {
+			h = &InventoryHost{}
+			inv.Hosts[name] = h
+		}
+		if h.Connect == "" {
+			h.Connect = name
+		}
+		// Groups don't have to be listed under groups unless they
+		// have vars
+		for _, g := range h.Groups {
+			if _, ok := inv.Groups[g]; !ok {
+				inv.Groups[g] = &InventoryGroup{}
+			}
+		}
+	}
+	for name, g := range inv.Groups {
+		if g == nil {
+			inv.Groups[name] = &InventoryGroup{}
+		}
+		if name == "all" {
+			return nil, fmt.Errorf("Group \"all\" is every host, it can't be defined")
+		}
+		if _, ok := inv.Hosts[name]; ok {
+			return nil, fmt.Errorf("%#v is both a host and a group", name)
+		}
+	}
+	return inv, nil
+}
+
+// Members lists the hosts in a group, sorted by name
+func (inv *Inventory) Members(group string) ([]string, error) {
+	if _, ok := inv.Groups[group]; !ok && group != "all" {
+		return nil, fmt.Errorf("No group %#v in the inventory", group)
+	}
+	var names []string
+	for name, h := range inv.Hosts {
+		if group == "all" || contains(h.Groups, group) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// HostVars merges the vars for a host
+func (inv *Inventory) HostVars(name string) map[string]interface{} {
+	vars := map[string]interface{}{}
+	for k, v := range inv.Vars {
+		vars[k] = v
+	}
+	h, ok := inv.Hosts[name]
+	if !ok {
+		return vars
+	}
+	for _, g := range h.Groups {
+		for k, v := range inv.Groups[g].Vars {
+			vars[k] = v
+		}
+	}
+	for k, v := range h.Vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// CheckTargets makes sure the hosts an item is for are all in the inventory
+func (inv *Inventory) CheckTargets(item Item) error {
+	m, ok := item.(metaer)
+	if !ok {
+		return nil
+	}
+	for _, t := range m.meta().Hosts {
+		_, host := inv.Hosts[t]
+		_, group := inv.Groups[t]
+		if !host && !group && t != "all" {
+			return fmt.Errorf("No host or group %#v in the inventory", t)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
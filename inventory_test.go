@@ -0,0 +1,146 @@
+package khan
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testinventory = `
+vars:
+  dns: 10.0.0.53
+  port: 80
+groups:
+  web:
+    vars:
+      port: 8080
+      tier: front
+  db:
+hosts:
+  web1:
+    connect: root@10.0.0.11
+    jump: bastion
+    groups: [web]
+  web2:
+    groups: [web, monitored]
+    vars:
+      port: 8081
+  db1:
+    groups: [db]
+    vars:
+      port: 5432
+  bare:
+`
+
+func TestParseInventory(t *testing.T) {
+	inv, err := ParseInventory([]byte(testinventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, connect := range map[string]string{
+		"web1": "root@10.0.0.11",
+		"web2": "web2",
+		"bare": "bare",
+	} {
+		if got := inv.Hosts[name].Connect; got != connect {
+			t.Errorf("%s: connect is %#v, want %#v", name, got, connect)
+		}
+	}
+	if inv.Hosts["web1"].Jump != "bastion" {
+		t.Errorf("web1: jump is %#v", inv.Hosts["web1"].Jump)
+	}
+	// only listed under a host
+	if _, ok := inv.Groups["monitored"]; !ok {
+		t.Errorf("Group monitored is missing")
+	}
+
+	errors := []struct {
+		yaml string
+		err  string
+	}{
+		{"hosts:\n  web1:\n    groups: [all]\n", `Group "all" is every host`},
+		{"groups:\n  all:\n", `Group "all" is every host`},
+		{"hosts:\n  web:\n    groups: [web]\n", `"web" is both a host and a group`},
+		{"hosts:\n  web1:\n    conect: x\n", "field conect not found"},
+		{"users:\n", "field users not found"},
+	}
+	for _, test := range errors {
+		_, err := ParseInventory([]byte(test.yaml))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%#v: got error %v, want %#v", test.yaml, err, test.err)
+		}
+	}
+}
+
+func TestInventoryMembers(t *testing.T) {
+	inv, err := ParseInventory([]byte(testinventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := map[string]string{
+		"all":       "[bare db1 web1 web2]",
+		"web":       "[web1 web2]",
+		"monitored": "[web2]",
+		"db":        "[db1]",
+	}
+	for group, want := range members {
+		names, err := inv.Members(group)
+		if err != nil {
+			t.Errorf("%s: %v", group, err)
+		} else if got := fmt.Sprint(names); got != want {
+			t.Errorf("%s: got %s, want %s", group, got, want)
+		}
+	}
+	// a host isn't a group
+	for _, group := range []string{"nope", "web1"} {
+		if names, err := inv.Members(group); err == nil {
+			t.Errorf("%s: got %v, want an error", group, names)
+		}
+	}
+}
+
+func TestInventoryHostVars(t *testing.T) {
+	inv, err := ParseInventory([]byte(testinventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"web1", "map[dns:10.0.0.53 port:8080 tier:front]"},
+		{"web2", "map[dns:10.0.0.53 port:8081 tier:front]"},
+		{"db1", "map[dns:10.0.0.53 port:5432]"},
+		{"bare", "map[dns:10.0.0.53 port:80]"},
+		{"unknown", "map[dns:10.0.0.53 port:80]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(inv.HostVars(test.host)); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.host, got, test.want)
+		}
+	}
+
+	// merging doesn't touch the inventory
+	if got := fmt.Sprint(inv.Vars); got != "map[dns:10.0.0.53 port:80]" {
+		t.Errorf("Inventory vars changed to %s", got)
+	}
+}
+
+func TestInventoryCheckTargets(t *testing.T) {
+	inv, err := ParseInventory([]byte(testinventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hosts := range [][]string{nil, {"all"}, {"web1", "db"}, {"monitored"}} {
+		if err := inv.CheckTargets(&Function{Meta: Meta{Hosts: hosts}}); err != nil {
+			t.Errorf("%v: %v", hosts, err)
+		}
+	}
+	if err := inv.CheckTargets(&Function{Meta: Meta{Hosts: []string{"web1", "web3"}}}); err == nil {
+		t.Error("web3 isn't in the inventory, but got no error")
+	}
+}
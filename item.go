@@ -17,6 +17,9 @@ const (
 	itemCreated
 	itemModified
 	itemDeleted
+	itemSkipped // its When didn't hold
+	itemRestarted
+	itemReloaded
 )
 
 func (s itemStatus) String() string {
@@ -29,6 +32,12 @@ func (s itemStatus) String() string {
 		return "modified"
 	case itemDeleted:
 		return "deleted"
+	case itemSkipped:
+		return "skipped"
+	case itemRestarted:
+		return "restarted"
+	case itemReloaded:
+		return "reloaded"
 	default:
 		return fmt.Sprintf("invalidItemStatus(%d)", s)
 	}
@@ -48,6 +57,54 @@ type Item interface {
 	Before() []string
 }
 
+// Meta holds the settings common to all items. Item types embed it.
+type Meta struct {
+	// Notify lists items (by what they provide, e.g. "service:nginx") that
+	// should be notified when this item changes.
+	Notify []string
+
+	// Subscribe lists items that this item should be notified about when
+	// they change. This item will be applied after them.
+	Subscribe []string
+
+	// Requires lists items that need to be applied before this one, like
+	// "path:/etc/nginx/nginx.conf" or "package:nginx".
+	Requires []string
+
+	// Hosts limits the item to these hosts or groups from the inventory.
+	// If empty, it goes on every host.
+	Hosts []string
+
+	// When is an expression that has to hold on a host for the item to be
+	// applied there (see when.go)
+	When string
+
+	// Tags are for picking out items to run with --tags and --skip-tags
+	Tags []string
+}
+
+func (m *Meta) meta() *Meta {
+	return m
+}
+
+type metaer interface {
+	meta() *Meta
+}
+
+// Notifiable items can react to changes in other items on the same host.
+// Notified is called once, after Apply, if any of the items notifying it or
+// that it subscribes to reported a change.
+type Notifiable interface {
+	Notified(host *Host) (itemStatus, error)
+}
+
+// handler is a Notifiable item that should not be applied at all unless
+// notified, if anything is set up to notify it.
+type handler interface {
+	Notifiable
+	handler() bool
+}
+
 type Validator interface {
 	Validate() error
 }
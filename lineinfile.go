@@ -0,0 +1,136 @@
+package khan
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+)
+
+// LineInFile makes sure a single line is in a file, without managing the
+// rest of it. Other LineInFile and BlockInFile items can edit the same file.
+type LineInFile struct {
+	Path string `khan:"path,shortkey"`
+	Line string `khan:"line,shortvalue"`
+
+	// Regexp finds the line to replace with Line. (If several match, the last
+	// one is replaced.) If nothing matches, Line is added to the end of the
+	// file. Without Regexp, only an exact copy of Line will do.
+	Regexp string
+
+	// Delete removes every line matching Regexp, or equal to Line.
+	Delete bool
+
+	// Create the file if it doesn't exist, with this ownership and mode.
+	// Existing files keep theirs.
+	Create bool
+	User   string
+	Group  string
+	Mode   os.FileMode
+
+	Meta
+
+	id int
+}
+
+func (l *LineInFile) String() string {
+	return l.Path + ": " + l.Line
+}
+
+func (l *LineInFile) SetID(id int) {
+	l.id = id
+}
+func (l *LineInFile) ID() int {
+	return l.id
+}
+func (l *LineInFile) Clone() Item {
+	r := *l
+	r.id = 0
+	return &r
+}
+
+func (l *LineInFile) Validate() error {
+	if l.Path == "" {
+		return errors.New("LineInFile path is required")
+	}
+	if l.Line == "" && l.Regexp == "" {
+		return fmt.Errorf("LineInFile %#v needs a line or a regexp", l.Path)
+	}
+	if l.Line == "" && !l.Delete {
+		return fmt.Errorf("LineInFile %#v line is required", l.Path)
+	}
+	if l.Regexp != "" {
+		if _, err := regexp.Compile(l.Regexp); err != nil {
+			return fmt.Errorf("LineInFile %#v regexp: %w", l.Path, err)
+		}
+	}
+	return nil
+}
+
+func (l *LineInFile) After() []string {
+	afters := parentpaths(l.Path)
+	afters = append(afters, "path:"+path.Clean(l.Path))
+	if l.Create && l.User != "" {
+		afters = append(afters, "user:"+l.User)
+	}
+	if l.Create && l.Group != "" {
+		afters = append(afters, "group:"+l.Group)
+	}
+	return afters
+}
+func (l *LineInFile) Before() []string {
+	return nil
+}
+func (l *LineInFile) editpath() string {
+	return l.Path
+}
+func (l *LineInFile) Provides() []string {
+	match := l.Regexp
+	if match == "" {
+		match = l.Line
+	}
+	return []string{"lineinfile:" + path.Clean(l.Path) + ":" + match}
+}
+
+func (l *LineInFile) Apply(host *Host) (itemStatus, error) {
+	matches := func(line string) bool {
+		return line == l.Line
+	}
+	if l.Regexp != "" {
+		re, err := regexp.Compile(l.Regexp)
+		if err != nil {
+			return 0, err
+		}
+		matches = re.MatchString
+	}
+
+	return editfile(host, l, path.Clean(l.Path), l.Create, l.User, l.Group, l.Mode, editlines(func(lines []string) ([]string, error) {
+		if l.Delete {
+			var kept []string
+			for _, line := range lines {
+				if !matches(line) {
+					kept = append(kept, line)
+				}
+			}
+			return kept, nil
+		}
+
+		found := -1
+		for i, line := range lines {
+			if matches(line) {
+				found = i
+			}
+		}
+		if found == -1 {
+			for _, line := range lines {
+				if line == l.Line {
+					return lines, nil
+				}
+			}
+			return append(lines, l.Line), nil
+		}
+		lines[found] = l.Line
+		return lines, nil
+	}))
+}
@@ -0,0 +1,91 @@
+package khan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"khan.rip/rio/local"
+)
+
+// quiet keeps what the local host prints about everything it does out of the
+// test output, until the returned func is called
+func quiet(t *testing.T) func() {
+	t.Helper()
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devnull
+	return func() {
+		os.Stdout = stdout
+		devnull.Close()
+	}
+}
+
+// edittest applies an item that edits the file at *fpath, starting with
+// content in it, and returns what the file ends up with
+func edittest(t *testing.T, item Item, fpath *string, content string) (string, itemStatus, error) {
+	t.Helper()
+	tmp, err := ioutil.TempDir("", "khan_edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	*fpath = filepath.Join(tmp, "file")
+	if err := ioutil.WriteFile(*fpath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer quiet(t)()
+	rh := local.New()
+	defer rh.Cleanup()
+	status, err := item.Apply(&Host{Run: &Run{}, Name: "test", rh: rh})
+
+	buf, rerr := ioutil.ReadFile(*fpath)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return string(buf), status, err
+}
+
+func TestLineInFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		item    LineInFile
+		content string
+		want    string
+		status  itemStatus
+	}{
+		{"add", LineInFile{Line: "c"}, "a\nb\n", "a\nb\nc\n", itemModified},
+		{"add to empty", LineInFile{Line: "a"}, "", "a\n", itemModified},
+		{"add without newline", LineInFile{Line: "c"}, "a\nb", "a\nb\nc\n", itemModified},
+		{"there", LineInFile{Line: "b"}, "a\nb\nc\n", "a\nb\nc\n", itemUnchanged},
+		{"replace", LineInFile{Line: "port 22", Regexp: "^#?port "}, "#port 2222\nx\n", "port 22\nx\n", itemModified},
+		{"replace last", LineInFile{Line: "port 22", Regexp: "^port "}, "port 1\nport 2\n", "port 1\nport 22\n", itemModified},
+		{"replace same", LineInFile{Line: "port 22", Regexp: "^port "}, "port 22\n", "port 22\n", itemUnchanged},
+		{"no match", LineInFile{Line: "port 22", Regexp: "^port "}, "x\n", "x\nport 22\n", itemModified},
+		{"no match but there", LineInFile{Line: "port 22", Regexp: "^Port "}, "port 22\n", "port 22\n", itemUnchanged},
+		{"delete", LineInFile{Line: "b", Delete: true}, "a\nb\nc\nb\n", "a\nc\n", itemModified},
+		{"delete regexp", LineInFile{Regexp: "^#", Delete: true}, "#a\nb\n#c\n", "b\n", itemModified},
+		{"delete missing", LineInFile{Line: "z", Delete: true}, "a\n", "a\n", itemUnchanged},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := test.item
+			got, status, err := edittest(t, &l, &l.Path, test.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("Got %#v, want %#v", got, test.want)
+			}
+			if status != test.status {
+				t.Errorf("Status is %v, want %v", status, test.status)
+			}
+		})
+	}
+}
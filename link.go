@@ -0,0 +1,243 @@
+package khan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"khan.rip/rio"
+	"khan.rip/rio/util"
+)
+
+// Link manages a symbolic link, or a hard link if Hard is set.
+type Link struct {
+	Path   string `khan:"path,shortkey"`
+	Target string `khan:"target,shortvalue"`
+
+	Hard bool
+
+	// Ownership of the link itself. If both are blank, whatever the link
+	// was created with is left alone. (For a hard link this is the
+	// ownership of the target, since they are the same file.)
+	User  string
+	Group string
+
+	// Force replaces a file that is already at Path. An existing symlink
+	// pointing somewhere else is always replaced.
+	Force bool
+
+	Delete bool
+
+	Meta
+
+	id int
+}
+
+func (l *Link) String() string {
+	return l.Path + " -> " + l.Target
+}
+
+func (l *Link) SetID(id int) {
+	l.id = id
+}
+func (l *Link) ID() int {
+	return l.id
+}
+func (l *Link) Clone() Item {
+	r := *l
+	r.id = 0
+	return &r
+}
+
+func (l *Link) Validate() error {
+	if l.Path == "" {
+		return errors.New("Link path is required")
+	}
+	if !path.IsAbs(l.Path) {
+		return fmt.Errorf("Link path %#v must be absolute", l.Path)
+	}
+	if l.Target == "" && !l.Delete {
+		return fmt.Errorf("Link %#v target is required", l.Path)
+	}
+	return nil
+}
+
+// target returns the link target relative to /
+func (l *Link) target() string {
+	if path.IsAbs(l.Target) {
+		return path.Clean(l.Target)
+	}
+	return path.Join(path.Dir(l.Path), l.Target)
+}
+
+func (l *Link) After() []string {
+	if l.Delete {
+		return nil
+	}
+	afters := parentpaths(l.Path)
+	afters = append(afters, "path:"+l.target())
+	if l.User != "" {
+		afters = append(afters, "user:"+l.User)
+	}
+	if l.Group != "" {
+		afters = append(afters, "group:"+l.Group)
+	}
+	return afters
+}
+func (l *Link) Before() []string {
+	return nil
+}
+func (l *Link) Provides() []string {
+	return []string{"path:" + path.Clean(l.Path)}
+}
+
+func (l *Link) Apply(host *Host) (itemStatus, error) {
+	lpath := path.Clean(l.Path)
+
+	fi, err := host.rh.Lstat(lpath)
+	if err != nil && !iserrnotfound(err) {
+		return 0, err
+	}
+	exists := err == nil
+
+	var ufi *util.FileInfo
+	if exists {
+		if ufi, err = util.ConvertStat(fi); err != nil {
+			return 0, err
+		}
+	}
+
+	if l.Delete {
+		if !exists {
+			return itemUnchanged, nil
+		}
+		if !ufi.Fislink && !l.Hard && !l.Force {
+			return 0, fmt.Errorf("%#v is not a symlink (use force to delete it anyway)", lpath)
+		}
+		if ufi.Fisdir {
+			return 0, fmt.Errorf("%#v is a directory", lpath)
+		}
+		if err := host.rh.Remove(lpath); err != nil {
+			return 0, err
+		}
+		return itemDeleted, nil
+	}
+
+	correct := false
+	if exists {
+		if l.Hard {
+			tfi, err := host.rh.Stat(l.target())
+			if err != nil {
+				return 0, err
+			}
+			tufi, err := util.ConvertStat(tfi)
+			if err != nil {
+				return 0, err
+			}
+			if ufi.Fino == 0 || tufi.Fino == 0 {
+				// Not every host can tell us inodes (SFTP can't), so
+				// ask stat instead.
+				id, err := fileid(host, lpath)
+				if err != nil {
+					return 0, err
+				}
+				tid, err := fileid(host, l.target())
+				if err != nil {
+					return 0, err
+				}
+				correct = !ufi.Fislink && id != "" && id == tid
+			} else {
+				correct = !ufi.Fislink && ufi.Fdev == tufi.Fdev && ufi.Fino == tufi.Fino
+			}
+		} else {
+			correct = ufi.Fislink && ufi.Flink == l.Target
+		}
+	}
+
+	status := itemUnchanged
+
+	if !correct {
+		if exists {
+			if ufi.Fisdir {
+				return 0, fmt.Errorf("%#v is a directory", lpath)
+			}
+			if !ufi.Fislink && !l.Force {
+				return 0, fmt.Errorf("%#v already exists and is not a link to %#v (use force to replace it)", lpath, l.Target)
+			}
+			if err := host.rh.Remove(lpath); err != nil {
+				return 0, err
+			}
+			status = itemModified
+		} else {
+			status = itemCreated
+		}
+
+		if l.Hard {
+			err = host.rh.Link(l.target(), lpath)
+		} else {
+			err = host.rh.Symlink(l.Target, lpath)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if l.User == "" && l.Group == "" {
+		return status, nil
+	}
+
+	uid, gid, err := resolveowner(host, l, l.User, l.Group)
+	if err != nil {
+		return 0, err
+	}
+
+	if fi, err = host.rh.Lstat(lpath); err != nil {
+		return 0, err
+	}
+	if ufi, err = util.ConvertStat(fi); err != nil {
+		return 0, err
+	}
+
+	if ufi.Fuid != uid || ufi.Fgid != gid {
+		if l.Hard {
+			err = host.rh.Chown(lpath, uid, gid)
+		} else {
+			err = host.rh.Lchown(lpath, uid, gid)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if status == itemUnchanged {
+			status = itemModified
+		}
+	}
+
+	return status, nil
+}
+
+// fileid gets "device:inode" for a file with the stat command. It's blank if
+// stat can't find the file (like one only a dry run made).
+func fileid(host *Host, fpath string) (string, error) {
+	info, err := host.rh.Info()
+	if err != nil {
+		return "", err
+	}
+	format := "-c"
+	if info.OS == "openbsd" {
+		format = "-f"
+	}
+
+	buf := &bytes.Buffer{}
+	cmd := rio.ReadOnlyCommand(context.Background(), "stat", "-L", format, "%d:%i", fpath)
+	cmd.Stdout = buf
+	if err := host.rh.Exec(cmd); err != nil {
+		if rio.Exited(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -2,8 +2,8 @@ package khan
 
 import (
 	"fmt"
-	"net"
 	"os"
+	osuser "os/user"
 	"strings"
 	"sync"
 
@@ -12,19 +12,18 @@ import (
 	"khan.rip/rio/local"
 	"khan.rip/rio/remote"
 
-	"github.com/desops/sshpool"
 	"github.com/flosch/pongo2/v4"
 	"github.com/spf13/pflag"
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
 var (
 	defaultrun *Run = &Run{
-		meta:    map[int]*imeta{},
-		fences:  map[string]*sync.Mutex{},
-		befores: map[string][]string{},
-		errors:  map[string]error{},
+		meta:     map[int]*imeta{},
+		fences:   map[string]*sync.Mutex{},
+		befores:  map[string][]string{},
+		notifies: map[string][]string{},
+		errors:   map[string]error{},
+		changed:  map[string]bool{},
 	}
 )
 
@@ -42,13 +41,13 @@ func Apply() error {
 	r := defaultrun
 
 	r.assetfn = mainassetfn
+	r.assetdirfn = mainassetdirfn
+	r.assetinfofn = mainassetinfofn
 
 	r.pongocachefiles = map[string]*pongo2.Template{}
 	r.pongocachestrings = map[string]*pongo2.Template{}
+	r.pongocachewhen = map[string]*pongo2.Template{}
 	r.pongopackedset = pongo2.NewSet("packed", &bindataloader{r})
-	r.pongopackedcontext = pongo2.Context{
-		"khan": map[string]interface{}{},
-	}
 
 	//r.rioconfig = &rio.Config{}
 
@@ -56,91 +55,259 @@ func Apply() error {
 	pflag.BoolVarP(&r.Diff, "diff", "D", false, "Show full diff of file content changes")
 	pflag.BoolVarP(&r.Verbose, "verbose", "v", false, "Be more verbose")
 
+	pflag.StringSliceVar(&r.Selection.Tags, "tags", nil, "Only apply items with these tags, and the items they need or notify")
+	pflag.StringSliceVar(&r.Selection.SkipTags, "skip-tags", nil, "Don't apply items with these tags")
+	pflag.StringSliceVar(&r.Selection.Only, "only", nil, "Only apply the items providing these, like path:/etc/foo, and the items they need or notify")
+	pflag.BoolVar(&r.Selection.NoDeps, "no-deps", false, "With --tags or --only, don't also apply the items they need or notify")
+
 	localmode := false
 	pflag.BoolVarP(&localmode, "local", "l", false, "Run without SSH against local host as current user")
 
 	var hostlist []string
-	pflag.StringSliceVarP(&hostlist, "remote", "r", nil, "Run against remote host via SSH (user@host:port, may be repeated)")
+	pflag.StringSliceVarP(&hostlist, "remote", "r", nil, "Run against remote host via SSH (user@host:port or an ssh_config alias, may be repeated)")
+
+	var grouplist []string
+	pflag.StringSliceVarP(&grouplist, "group", "g", nil, "Run against the hosts in this inventory group (may be repeated, all is every host)")
+
+	var identities []string
+	pflag.StringArrayVarP(&identities, "identity", "i", nil, "Private key file for SSH, on top of any IdentityFile in ssh_config (may be repeated)")
+
+	var authmethods []string
+	pflag.StringSliceVar(&authmethods, "auth", []string{"agent", "keys", "keyboard-interactive"}, "SSH auth methods to try, in order (agent, keys, keyboard-interactive, password)")
+
+	var jumplist []string
+	pflag.StringArrayVarP(&jumplist, "jump", "J", nil, "Connect to remote hosts through jump hosts (jump1,jump2 or host=jump1,jump2, may be repeated)")
+
+	sshconfigfile := ""
+	pflag.StringVarP(&sshconfigfile, "ssh-config", "F", "", "Use this ssh_config file instead of ~/.ssh/config and /etc/ssh/ssh_config")
+
+	var knownhostsfiles []string
+	pflag.StringSliceVar(&knownhostsfiles, "known-hosts", nil, "Also check host keys against this known_hosts file (may be repeated)")
+
+	tofu := false
+	pflag.BoolVar(&tofu, "tofu", false, "Trust on first use: Add keys of unknown hosts to ~/.ssh/known_hosts")
+
+	insecure := false
+	pflag.BoolVar(&insecure, "insecure-ignore-host-key", false, "Don't check host keys at all (dangerous)")
+
+	become := false
+	pflag.BoolVarP(&become, "become", "b", false, "Run everything with sudo or doas (see --become-method and --become-user)")
+
+	becomemethod := ""
+	pflag.StringVar(&becomemethod, "become-method", "", "sudo or doas (default doas on OpenBSD, sudo everywhere else)")
+
+	becomeuser := ""
+	pflag.StringVar(&becomeuser, "become-user", "root", "User to become")
+
+	push := false
+	pflag.BoolVarP(&push, "push", "p", false, "Copy this binary to remote hosts and run it there, instead of doing each step over SSH")
+
+	agent := ""
+	pflag.StringVar(&agent, "agent", "", "Run as a push agent for this host, sending results back on stdout")
+	_ = pflag.CommandLine.MarkHidden("agent")
 
 	pflag.Parse()
 
+	if agent != "" {
+		// stdout is for results now, everything else goes to stderr
+		r.agentout = os.Stdout
+		os.Stdout = os.Stderr
+	}
+
 	if localmode {
 		hostname, err := os.Hostname()
 		if err != nil {
 			return err
 		}
-		rh := rio.Host(local.New())
+		localhost := local.New()
+		user := ""
+		if u, err := osuser.Current(); err == nil {
+			user = u.Username
+		}
+		if become {
+			localhost.Become = newbecome(becomemethod, becomeuser, hostname)
+			user = becomeuser
+		}
+
+		rh := rio.Host(localhost)
 		if r.Dry {
-			rh = rio.Host(dry.New(uint32(os.Geteuid()), uint32(os.Getegid()), rh))
+			uid, gid, err := dryids(rh, user, become)
+			if err != nil {
+				return err
+			}
+			rh = rio.Host(dry.New(uid, gid, rh))
+		}
+
+		// An agent is whatever host the controller says it is
+		name := hostname
+		if agent != "" {
+			name = agent
 		}
+		groups, vars := inventoryhost(name)
 
 		r.Hosts = append(r.Hosts, &Host{
-			Name: hostname,
-			SSH:  false,
-			Run:  r,
-			rh:   rh,
+			Name:   name,
+			SSH:    false,
+			User:   user,
+			Groups: groups,
+			Vars:   vars,
+			Run:    r,
+			rh:     rh,
 		})
 
 		defer rh.Cleanup()
 	}
 
+	// --jump is either "jump1,jump2" for every host, or "host=jump1,jump2"
+	// for one host.
+	jumpall := ""
+	jumphost := map[string]string{}
+	for _, j := range jumplist {
+		if eq := strings.IndexByte(j, '='); eq > -1 {
+			jumphost[j[:eq]] = j[eq+1:]
+		} else {
+			jumpall = j
+		}
+	}
+
+	// Hosts come from -r, which can be inventory hosts or anything else
+	// ssh would take, and -g, which are all inventory hosts.
+	type hostarg struct {
+		name    string // blank if not in the inventory
+		connect string
+	}
+	var hostargs []hostarg
+	seen := map[string]bool{}
 	for _, h := range hostlist {
-		if r.Pool == nil {
-			// initialize SSH pool
-			socket := os.Getenv("SSH_AUTH_SOCK")
-			conn, err := net.Dial("unix", socket)
-			if err != nil {
-				return fmt.Errorf("Failed to open SSH_AUTH_SOCK: %w", err)
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		if maininventory != nil {
+			if ih, ok := maininventory.Hosts[h]; ok {
+				hostargs = append(hostargs, hostarg{h, ih.Connect})
+				continue
 			}
-			agentClient := agent.NewClient(conn)
-			sshconfig := &ssh.ClientConfig{
-				Auth: []ssh.AuthMethod{
-					ssh.PublicKeysCallback(agentClient.Signers),
-				},
-				HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-					// TODO
-					return nil
-				},
-				BannerCallback: ssh.BannerDisplayStderr(),
+		}
+		hostargs = append(hostargs, hostarg{"", h})
+	}
+	for _, g := range grouplist {
+		if maininventory == nil {
+			return fmt.Errorf("No inventory to find group %#v in (khan build looks for %s)", g, InventoryFile)
+		}
+		names, err := maininventory.Members(g)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if seen[name] {
+				continue
 			}
+			seen[name] = true
+			hostargs = append(hostargs, hostarg{name, maininventory.Hosts[name].Connect})
+		}
+	}
+
+	var ss *sshsetup
+	if len(hostargs) > 0 {
+		var err error
+		if ss, err = newsshsetup(sshconfigfile, knownhostsfiles, tofu, insecure, authmethods, identities); err != nil {
+			return err
+		}
+		defer ss.close()
+	}
 
-			r.Pool = sshpool.New(sshconfig, &sshpool.PoolConfig{Debug: false}) //r.Verbose})
+	for _, ha := range hostargs {
+		sh, err := ss.hosts.lookup(ha.connect)
+		if err != nil {
+			return err
+		}
+		h := ha.name
+		if h == "" {
+			h = ha.connect
 		}
-		name := h
-		if i := strings.IndexByte(name, ':'); i > -1 {
-			name = name[:i]
+		name := ha.name
+		if name == "" {
+			name = sh.alias
 		}
 
-		rh := rio.Host(remote.New(r.Pool, h))
-		if r.Dry {
-			// This uid/gid guess is incorrect. TODO: Concurrently SSH to all the hosts and
-			// get this info correctly. This could double-serve as a pool warmup :)
-			uid := os.Geteuid()
-			gid := os.Getegid()
-			at := strings.IndexByte(h, '@')
-			if at > -1 && h[:at] == "root" {
-				uid = 0
-				gid = 0
+		// Like ssh, jump hosts on the command line win over ProxyJump. The
+		// inventory's are in between.
+		jump := sh.proxyjump
+		if maininventory != nil && ha.name != "" && maininventory.Hosts[ha.name].Jump != "" {
+			jump = maininventory.Hosts[ha.name].Jump
+		}
+		if jumpall != "" {
+			jump = jumpall
+		}
+		if j, ok := jumphost[h]; ok {
+			jump = j
+		} else if j, ok := jumphost[ha.connect]; ok {
+			jump = j
+		} else if j, ok := jumphost[sh.alias]; ok {
+			jump = j
+		}
+		var jumps []string
+		if jump != "" && jump != "none" {
+			jumps = strings.Split(jump, ",")
+		}
+
+		// Each host gets its own pool, so it can be asked for the kind of
+		// host key we know it by, and use its own identity files. Hosts
+		// behind jump hosts are dialed by khan instead.
+		var remotehost *remote.Host
+		if len(jumps) > 0 {
+			remotehost = remote.NewClient(ss.client(ha.connect, jumps), sh.connect())
+		} else if r.Pool != nil {
+			remotehost = remote.New(r.Pool, sh.connect())
+		} else {
+			pool := ss.pool(sh)
+			defer pool.Close()
+			remotehost = remote.New(pool, sh.connect())
+		}
+		remotehost.Name = h
+		user := sh.user
+		if become {
+			remotehost.Become = newbecome(becomemethod, becomeuser, sh.alias)
+			user = becomeuser
+		}
+
+		rh := rio.Host(remotehost)
+		if r.Dry && !push {
+			uid, gid, err := dryids(rh, user, become)
+			if err != nil {
+				return err
 			}
-			rh = rio.Host(dry.New(uint32(uid), uint32(gid), rh))
+			rh = rio.Host(dry.New(uid, gid, rh))
 		}
 
+		groups, vars := inventoryhost(name)
+
 		r.Hosts = append(r.Hosts, &Host{
-			Name: name,
-			SSH:  true,
-			Host: h,
-			Run:  r,
-			rh:   rh,
+			Name:   name,
+			SSH:    true,
+			Host:   h,
+			User:   user,
+			Groups: groups,
+			Vars:   vars,
+			Run:    r,
+			rh:     rh,
+			push:   push,
 		})
 
 		defer rh.Cleanup()
 	}
 
 	if len(r.Hosts) == 0 {
-		fmt.Println("Nothing to do: No remote hosts (-h/--host) or local host (-l/--local) were specified")
+		fmt.Println("Nothing to do: No remote hosts (-r/--remote), groups (-g/--group) or local host (-l/--local) were specified")
 		return nil
 	}
 
+	if r.agentout != nil {
+		// the controller has its own title and result
+		return r.run()
+	}
+
 	decorate := color(Cyan) + "░▒▓█" + reset()
 
 	title := decorate + " "
@@ -171,3 +338,16 @@ func Apply() error {
 	fmt.Println(decorate + " " + color(Green) + "✓" + reset() + " Great success!")
 	return nil
 }
+
+// inventoryhost gets a host's groups and vars. Hosts that aren't in the
+// inventory still get its vars for every host.
+func inventoryhost(name string) ([]string, map[string]interface{}) {
+	if maininventory == nil {
+		return nil, map[string]interface{}{}
+	}
+	var groups []string
+	if ih, ok := maininventory.Hosts[name]; ok {
+		groups = ih.Groups
+	}
+	return groups, maininventory.HostVars(name)
+}
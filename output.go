@@ -1,34 +1,55 @@
 package khan
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
 type outputter struct {
+	// events is set when running as a push agent, to send results back
+	// to the controller instead
+	eventsmu sync.Mutex
+	events   *json.Encoder
 }
 
 func (o *outputter) FinishItem(start time.Time, r *Run, item Item, status itemStatus, err error) {
-	if err == nil && status == itemUnchanged && !r.Verbose {
+	typ := strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", item), "*khan."))
+	o.finish(time.Since(start), r, typ, item.String(), status.String(), err)
+}
+
+func (o *outputter) finish(d time.Duration, r *Run, typ, name, s string, err error) {
+	if o.events != nil {
+		ev := &agentevent{
+			Type:     typ,
+			Item:     name,
+			Status:   s,
+			Duration: d,
+		}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		o.send(ev)
+		return
+	}
+
+	if err == nil && s == itemUnchanged.String() && !r.Verbose {
 		return
 	}
 
-	d := time.Since(start)
 	dc := ""
 	ds := format_duration(d)
 	if d > time.Millisecond*100 {
 		dc = color(Red)
 	}
 
-	typ := strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", item), "*khan."))
-
-	s := status.String()
 	if err != nil {
 		s = "error"
 	}
 
-	msg := fmt.Sprintf("%s%8s%s │ %-10s │ %-10s │ %s", dc, ds, reset(), typ, s, item.String())
+	msg := fmt.Sprintf("%s%8s%s │ %-10s │ %-10s │ %s", dc, ds, reset(), typ, s, name)
 
 	//	if o.bar != nil {
 	//		o.bar.Println(msg)
@@ -39,6 +60,20 @@ func (o *outputter) FinishItem(start time.Time, r *Run, item Item, status itemSt
 	_ = msg
 }
 
+// Done sends a push agent's totals. It does nothing otherwise, since the run
+// prints its own.
+func (o *outputter) Done(failed, skipped int) {
+	if o.events != nil {
+		o.send(&agentevent{Done: true, Failed: failed, Skipped: skipped})
+	}
+}
+
+func (o *outputter) send(ev *agentevent) {
+	o.eventsmu.Lock()
+	defer o.eventsmu.Unlock()
+	_ = o.events.Encode(ev)
+}
+
 func (o *outputter) Flush() {
 }
 
@@ -1,5 +1,249 @@
 package khan
 
+import (
+	"errors"
+	"sync"
+
+	"khan.rip/rio"
+)
+
+// Package installs, upgrades or removes an OS package. The Package items for a
+// host go to its package manager together, except ones a Func adds during the
+// run, which are applied one at a time.
 type Package struct {
-	Name string
+	Name string `khan:"name,shortkey"`
+
+	// Version to install or upgrade to. If blank, any installed version is
+	// accepted, and the package manager's choice is installed if missing.
+	Version string `khan:"version,shortvalue"`
+
+	Delete bool
+
+	Meta
+
+	id int
+
+	// alone is set for a Package that has to wait for another one, or that
+	// was added while the run was going, so it gets its own transaction
+	// instead of joining the batch
+	alone bool
+}
+
+func (p *Package) String() string {
+	if p.Version != "" {
+		return p.Name + "/" + p.Version
+	}
+	return p.Name
+}
+
+func (p *Package) SetID(id int) {
+	p.id = id
+}
+func (p *Package) ID() int {
+	return p.id
+}
+func (p *Package) Clone() Item {
+	r := *p
+	r.id = 0
+	return &r
+}
+
+func (p *Package) Validate() error {
+	if p.Name == "" {
+		return errors.New("Package name is required")
+	}
+	return nil
+}
+
+func (p *Package) After() []string {
+	return nil
+}
+func (p *Package) Before() []string {
+	return nil
+}
+func (p *Package) Provides() []string {
+	if p.Delete {
+		return []string{"-package:" + p.Name}
+	} else {
+		return []string{"package:" + p.Name}
+	}
+}
+
+// Apply waits for the rest of the Package items on this host to show up so
+// they can all be handled by the package manager in one go.
+func (p *Package) Apply(host *Host) (itemStatus, error) {
+	if p.alone {
+		req := &pkgreq{
+			pkg:  p,
+			done: make(chan struct{}),
+		}
+		host.pkgs.run(host, []*pkgreq{req})
+		return req.status, req.err
+	}
+	return host.pkgs.apply(host, p)
+}
+
+// needspackage is whether an item has to wait, one way or another, for a
+// Package item on the same host. Always have itemsmu locked before calling
+// this.
+func (r *Run) needspackage(host *Host, item Item) bool {
+	providers := map[string]Item{}
+	for _, it := range r.items {
+		if r.meta[it.ID()].host != host {
+			continue
+		}
+		for _, p := range it.Provides() {
+			providers[host.Key()+"-"+p] = it
+		}
+	}
+
+	seen := map[int]bool{item.ID(): true}
+	todo := []Item{item}
+	for len(todo) > 0 {
+		it := todo[0]
+		todo = todo[1:]
+		for _, k := range r.waitlist(host, it) {
+			dep, ok := providers[k]
+			if !ok || seen[dep.ID()] {
+				continue
+			}
+			if _, ok := dep.(*Package); ok {
+				return true
+			}
+			seen[dep.ID()] = true
+			todo = append(todo, dep)
+		}
+	}
+	return false
+}
+
+// pkgbatch gathers up the Package items for a single host. Every Package item
+// (except the alone ones) is registered before any of them are applied, and
+// the last one to arrive runs the transaction for everybody.
+type pkgbatch struct {
+	mu      sync.Mutex
+	waiting int
+	queue   []*pkgreq
+}
+
+type pkgreq struct {
+	pkg    *Package
+	done   chan struct{}
+	status itemStatus
+	err    error
+}
+
+// register is called by the run loop for each Package item it is about to start
+func (b *pkgbatch) register() {
+	b.mu.Lock()
+	b.waiting++
+	b.mu.Unlock()
+}
+
+// unregister is called for a Package item that will never be applied
+func (b *pkgbatch) unregister(host *Host) {
+	b.mu.Lock()
+	b.waiting--
+	if b.waiting > 0 || len(b.queue) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	queue := b.queue
+	b.queue = nil
+	b.mu.Unlock()
+
+	b.run(host, queue)
+}
+
+func (b *pkgbatch) apply(host *Host, p *Package) (itemStatus, error) {
+	req := &pkgreq{
+		pkg:  p,
+		done: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.queue = append(b.queue, req)
+	b.waiting--
+	if b.waiting > 0 {
+		b.mu.Unlock()
+		<-req.done
+		return req.status, req.err
+	}
+	queue := b.queue
+	b.queue = nil
+	b.mu.Unlock()
+
+	b.run(host, queue)
+	return req.status, req.err
+}
+
+func (b *pkgbatch) run(host *Host, queue []*pkgreq) {
+	defer func() {
+		for _, req := range queue {
+			close(req.done)
+		}
+	}()
+
+	fail := func(err error) {
+		for _, req := range queue {
+			req.err = err
+		}
+	}
+
+	names := make([]string, len(queue))
+	for i, req := range queue {
+		names[i] = req.pkg.Name
+	}
+
+	installed, err := host.rh.Packages(names)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var (
+		install  []*rio.Package
+		remove   []string
+		installq []*pkgreq
+		removeq  []*pkgreq
+	)
+
+	for _, req := range queue {
+		p := req.pkg
+		old := installed[p.Name]
+		req.status = itemUnchanged
+
+		if p.Delete {
+			if old != nil {
+				remove = append(remove, p.Name)
+				removeq = append(removeq, req)
+				req.status = itemDeleted
+			}
+			continue
+		}
+
+		if old == nil {
+			req.status = itemCreated
+		} else if p.Version != "" && old.Version != p.Version {
+			req.status = itemModified
+		} else {
+			continue
+		}
+		install = append(install, &rio.Package{
+			Name:    p.Name,
+			Version: p.Version,
+		})
+		installq = append(installq, req)
+	}
+
+	if err := host.rh.InstallPackages(install); err != nil {
+		for _, req := range installq {
+			req.err = err
+		}
+	}
+	if err := host.rh.RemovePackages(remove); err != nil {
+		for _, req := range removeq {
+			req.err = err
+		}
+	}
 }
@@ -0,0 +1,139 @@
+package rio
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Become runs commands as another user (usually root) with sudo or doas, for
+// when you can't log in as that user directly.
+type Become struct {
+	// Method is "sudo" or "doas". If blank, it's doas on OpenBSD and sudo
+	// everywhere else.
+	Method string
+
+	// User defaults to root
+	User string
+
+	// Password is only called if sudo wants a password. doas will only read
+	// one from a terminal, so it needs to be set up with nopass, and fails
+	// straight away if it isn't.
+	Password func() (string, error)
+}
+
+func (b *Become) user() string {
+	if b.User == "" {
+		return "root"
+	}
+	return b.User
+}
+
+// IsRoot is whether commands end up running as root
+func (b *Become) IsRoot() bool {
+	return b.user() == "root"
+}
+
+// Becomer is a Become in use on one host
+type Becomer struct {
+	become *Become
+
+	once     sync.Once
+	method   string
+	password string
+	err      error
+}
+
+func NewBecomer(b *Become) *Becomer {
+	return &Becomer{become: b}
+}
+
+// Init works out the method to use, and tries it to find out if it needs a
+// password. probe runs a command as the login user, with its stderr in the
+// error if it fails. It only does anything the first time it's called.
+func (b *Becomer) Init(osname string, probe func(stdin io.Reader, args ...string) error) error {
+	b.once.Do(func() {
+		b.method = b.become.Method
+		if b.method == "" {
+			b.method = "sudo"
+			if osname == "openbsd" {
+				b.method = "doas"
+			}
+		}
+		user := b.become.user()
+
+		switch b.method {
+		case "sudo":
+			if probe(nil, "sudo", "-n", "-u", user, "true") == nil {
+				return
+			}
+			if b.become.Password == nil {
+				b.err = fmt.Errorf("sudo to %s needs a password", user)
+				return
+			}
+			password, err := b.become.Password()
+			if err != nil {
+				b.err = err
+				return
+			}
+			// Check it now, since a wrong one would have sudo read the
+			// next lines of stdin to try again.
+			if err := probe(strings.NewReader(password+"\n"), "sudo", "-S", "-k", "-p", "", "-u", user, "true"); err != nil {
+				b.err = fmt.Errorf("sudo to %s didn't take the password: %w", user, err)
+				return
+			}
+			b.password = password
+		case "doas":
+			err := probe(nil, "doas", "-n", "-u", user, "true")
+			if err == nil {
+				return
+			}
+			if doaswantspassword(err) {
+				b.err = fmt.Errorf("doas to %s wants a password, which it only reads from a terminal (set it up with nopass, or use sudo)", user)
+			} else {
+				b.err = fmt.Errorf("doas to %s (it needs to be set up with nopass): %w", user, err)
+			}
+		default:
+			b.err = fmt.Errorf("Unknown become method %#v (use sudo or doas)", b.method)
+		}
+	})
+	return b.err
+}
+
+// doaswantspassword is whether doas -n failed for want of a password. doas
+// on OpenBSD says "Authorization required", and OpenDoas "a password is
+// required". Without -n, either would be waiting on a terminal instead.
+func doaswantspassword(err error) bool {
+	e := strings.ToLower(err.Error())
+	return strings.Contains(e, "authorization required") || strings.Contains(e, "password is required")
+}
+
+// Args wraps a command to run as the become user. Init must have been
+// called first.
+func (b *Becomer) Args(args ...string) []string {
+	user := b.become.user()
+	var wrapped []string
+	switch {
+	case b.method == "doas":
+		wrapped = []string{"doas", "-n", "-u", user}
+	case b.password != "":
+		wrapped = []string{"sudo", "-S", "-k", "-p", "", "-u", user, "--"}
+	default:
+		wrapped = []string{"sudo", "-n", "-u", user, "--"}
+	}
+	return append(wrapped, args...)
+}
+
+// Stdin puts the password in front of the stdin for a wrapped command, if
+// sudo needs it.
+func (b *Becomer) Stdin(stdin io.Reader) io.Reader {
+	if b.password == "" {
+		return stdin
+	}
+	pw := strings.NewReader(b.password + "\n")
+	if stdin == nil {
+		return pw
+	}
+	return io.MultiReader(pw, stdin)
+}
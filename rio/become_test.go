@@ -0,0 +1,44 @@
+package rio
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBecomeDoas(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   string
+	}{
+		{"", ""},
+		{"doas: Authorization required", "wants a password"},
+		{"doas: a password is required", "wants a password"},
+		{"doas: Operation not permitted", "needs to be set up with nopass"},
+	}
+	for _, test := range tests {
+		probe := func(stdin io.Reader, args ...string) error {
+			if args[0] != "doas" || args[1] != "-n" {
+				t.Errorf("Probed with %v", args)
+			}
+			if test.stderr == "" {
+				return nil
+			}
+			return &CmdErr{Cmd: Command(nil, args[0], args[1:]...), StdErr: test.stderr, ExecErr: errors.New("exit status 1")}
+		}
+		b := NewBecomer(&Become{
+			Method: "doas",
+			Password: func() (string, error) {
+				return "", errors.New("doas shouldn't ask for a password")
+			},
+		})
+		err := b.Init("openbsd", probe)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%#v: %v", test.stderr, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%#v: got error %v, want %#v", test.stderr, err, test.want)
+		}
+	}
+}
@@ -10,13 +10,36 @@ import (
 	"khan.rip/rio/util"
 )
 
+// Files bigger than this only have their hash kept in memory, so dry runs
+// with big files don't need the memory to hold them. The content is read
+// from somewhere else if it's needed.
+const maxcontent = 16 * 1024 * 1024
+
 type File struct {
 	info    *util.FileInfo // nil info means file not present (deleted)
 	content []byte         // nil content means content not cached. (zero length slice means empty file.)
+	hash    string         // set instead of content for big files
+
+	// open reads a big file's content from wherever it really is: the real
+	// host, or whatever it was copied from. Nil if nobody knows.
+	open func() (io.ReadCloser, error)
+
+	// opaque directories did not exist on the cascade host, so there is no
+	// point asking it about what is inside them.
+	opaque bool
 }
 
 func (f *File) String() string {
-	return fmt.Sprintf("info %s content %#v\n", f.info, string(f.content))
+	return fmt.Sprintf("info %s content %#v hash %s\n", f.info, string(f.content), f.hash)
+}
+
+// uncached is whether the content is still only on the cascade host, because
+// the file hasn't been touched, or only its mode or owner has
+func (f *File) uncached() bool {
+	if f == nil {
+		return true
+	}
+	return f.info != nil && !f.info.Fisdir && !f.info.Fislink && f.content == nil && f.hash == ""
 }
 
 type Reader struct {
@@ -29,14 +52,52 @@ func (r *Reader) Read(p []byte) (int, error) {
 func (r *Reader) Close() error {
 	return nil
 }
+func (r *Reader) Size() int64 {
+	return r.r.Size()
+}
+
+// hashReader stands in for a big file that only has its hash kept. It reads
+// the content from wherever it is when it has to, but copying it to another
+// dry file only takes the hash, which is all most things want to do with big
+// files anyway.
+type hashReader struct {
+	path string
+	hash string
+	size int64
+	open func() (io.ReadCloser, error)
+
+	rc io.ReadCloser
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	if r.rc == nil {
+		if r.open == nil {
+			return 0, fmt.Errorf("dry run: content of %s was written without a source and isn't kept", r.path)
+		}
+		var err error
+		if r.rc, err = r.open(); err != nil {
+			return 0, err
+		}
+	}
+	return r.rc.Read(p)
+}
+func (r *hashReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	return r.rc.Close()
+}
+func (r *hashReader) Size() int64 {
+	return r.size
+}
 
 func (host *Host) Open(fpath string) (io.ReadCloser, error) {
 	host.fsmu.Lock()
-	file := host.fs[fpath]
-	if file == nil && host.cascade != nil {
+	rpath, file := host.resolve(fpath)
+	if file.uncached() && host.cascade != nil {
 		// we don't want to hold this lock while SSH does its thing if we don't have to
 		host.fsmu.Unlock()
-		return host.cascade.Open(fpath)
+		return host.cascade.Open(rpath)
 	}
 	defer host.fsmu.Unlock()
 
@@ -48,6 +109,14 @@ func (host *Host) Open(fpath string) (io.ReadCloser, error) {
 	if file.info.IsDir() {
 		return nil, &os.PathError{Op: "open", Path: fpath, Err: syscall.EISDIR}
 	}
+	if file.hash != "" {
+		return &hashReader{
+			path: fpath,
+			hash: file.hash,
+			size: file.info.Fsize,
+			open: file.open,
+		}, nil
+	}
 
 	reader := &Reader{
 		r: bytes.NewReader(file.content),
@@ -72,3 +141,24 @@ func (host *Host) ReadFile(fpath string) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+func (host *Host) Hash(fpath string) (string, error) {
+	host.fsmu.Lock()
+	rpath, file := host.resolve(fpath)
+	if file.uncached() && host.cascade != nil {
+		host.fsmu.Unlock()
+		return host.cascade.Hash(rpath)
+	}
+	defer host.fsmu.Unlock()
+
+	if file == nil || file.info == nil {
+		return "", &os.PathError{Op: "open", Path: fpath, Err: syscall.ENOENT}
+	}
+	if file.info.IsDir() {
+		return "", &os.PathError{Op: "read", Path: fpath, Err: syscall.EISDIR}
+	}
+	if file.hash != "" {
+		return file.hash, nil
+	}
+	return util.HashBytes(file.content), nil
+}
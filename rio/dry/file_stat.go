@@ -2,16 +2,18 @@ package dry
 
 import (
 	"os"
+	"path"
+	"sort"
 	"syscall"
 )
 
 func (host *Host) Stat(fpath string) (os.FileInfo, error) {
 	host.fsmu.Lock()
-	file := host.fs[fpath]
+	rpath, file := host.resolve(fpath)
 	if file == nil && host.cascade != nil {
 		// we don't want to hold this lock while SSH does its thing if we don't have to
 		host.fsmu.Unlock()
-		return host.cascade.Stat(fpath)
+		return host.cascade.Stat(rpath)
 	}
 	defer host.fsmu.Unlock()
 
@@ -24,12 +26,146 @@ func (host *Host) Stat(fpath string) (os.FileInfo, error) {
 
 // stat() should be called when fsmu is already locked.
 func (host *Host) stat(fpath string) (os.FileInfo, error) {
-	file := host.fs[fpath]
+	rpath, file := host.resolve(fpath)
 	if file == nil && host.cascade != nil {
-		return host.cascade.Stat(fpath)
+		return host.cascade.Stat(rpath)
 	}
 	if file == nil || file.info == nil {
 		return nil, &os.PathError{Op: "stat", Path: fpath, Err: syscall.ENOENT}
 	}
 	return file.info, nil
 }
+
+// lookup finds fpath in the model. A nil return means the model knows nothing
+// about it, and the cascade host should be asked. fsmu must be locked.
+func (host *Host) lookup(fpath string) *File {
+	if file, ok := host.fs[fpath]; ok {
+		return file
+	}
+	for dir := path.Dir(fpath); ; dir = path.Dir(dir) {
+		if file, ok := host.fs[dir]; ok {
+			if file.info == nil || !file.info.Fisdir || file.opaque {
+				// removed along with its parent, or never could have existed
+				return &File{}
+			}
+			return nil
+		}
+		if dir == "/" || dir == "." {
+			return nil
+		}
+	}
+}
+
+// lstat() is stat() without following symlinks. fsmu must be locked.
+func (host *Host) lstat(fpath string) (os.FileInfo, error) {
+	file := host.lookup(fpath)
+	if file == nil && host.cascade != nil {
+		return host.cascade.Lstat(fpath)
+	}
+	if file == nil || file.info == nil {
+		return nil, &os.PathError{Op: "lstat", Path: fpath, Err: syscall.ENOENT}
+	}
+	return file.info, nil
+}
+
+func (host *Host) Lstat(fpath string) (os.FileInfo, error) {
+	host.fsmu.Lock()
+	file := host.lookup(fpath)
+	if file == nil && host.cascade != nil {
+		host.fsmu.Unlock()
+		return host.cascade.Lstat(fpath)
+	}
+	defer host.fsmu.Unlock()
+
+	if file == nil || file.info == nil {
+		return nil, &os.PathError{Op: "lstat", Path: fpath, Err: syscall.ENOENT}
+	}
+	return file.info, nil
+}
+
+func (host *Host) Readlink(fpath string) (string, error) {
+	host.fsmu.Lock()
+	file := host.lookup(fpath)
+	if file == nil && host.cascade != nil {
+		host.fsmu.Unlock()
+		return host.cascade.Readlink(fpath)
+	}
+	defer host.fsmu.Unlock()
+
+	if file == nil || file.info == nil {
+		return "", &os.PathError{Op: "readlink", Path: fpath, Err: syscall.ENOENT}
+	}
+	if !file.info.Fislink {
+		return "", &os.PathError{Op: "readlink", Path: fpath, Err: syscall.EINVAL}
+	}
+	return file.info.Flink, nil
+}
+
+// resolve follows any symlinks the model knows about, and returns the path
+// it ended up at along with lookup()'s answer for it. fsmu must be locked.
+func (host *Host) resolve(fpath string) (string, *File) {
+	for i := 0; i < 40; i++ {
+		file := host.lookup(fpath)
+		if file == nil || file.info == nil || !file.info.Fislink {
+			return fpath, file
+		}
+		target := file.info.Flink
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(fpath), target)
+		}
+		fpath = target
+	}
+	// too many levels of symbolic links
+	return fpath, &File{}
+}
+
+func (host *Host) ReadDir(dir string) ([]os.FileInfo, error) {
+	host.fsmu.Lock()
+	defer host.fsmu.Unlock()
+
+	dir = path.Clean(dir)
+
+	fi, err := host.stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	entries := map[string]os.FileInfo{}
+
+	file := host.lookup(dir)
+	if (file == nil || !file.opaque) && host.cascade != nil {
+		list, err := host.cascade.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range list {
+			entries[e.Name()] = e
+		}
+	}
+
+	for fpath, file := range host.fs {
+		if path.Dir(fpath) != dir || fpath == dir {
+			continue
+		}
+		if file.info == nil {
+			delete(entries, path.Base(fpath))
+		} else {
+			entries[path.Base(fpath)] = file.info
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		list[i] = entries[name]
+	}
+	return list, nil
+}
@@ -2,40 +2,124 @@ package dry
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 	"time"
 
+	"khan.rip/rio"
 	"khan.rip/rio/util"
 )
 
 type Writer struct {
 	file *File
-	buf  *bytes.Buffer
+	buf  *bytes.Buffer // nil once it's too big to keep
+	hash hash.Hash
+	size int64
 	host *Host
-	err  error
+
+	// where the content can be read again once it's too big to keep
+	open func() (io.ReadCloser, error)
+
+	// set instead when copied from a hashReader
+	sum string
+
+	closed bool
 }
 
 func (w *Writer) Write(p []byte) (int, error) {
-	return w.buf.Write(p)
+	if w.sum != "" {
+		if err := w.unhash(); err != nil {
+			return 0, err
+		}
+	}
+	// whatever it was copied from isn't all of it anymore
+	w.open = nil
+
+	if w.buf != nil && w.size+int64(len(p)) > maxcontent {
+		w.buf = nil
+	}
+	if w.buf != nil {
+		w.buf.Write(p)
+	}
+	w.hash.Write(p)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// ReadFrom is what io.Copy uses, so a big file copied from another dry file
+// gets its hash without having to be read, and one copied from a rio.Source
+// can be read from there again
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	var open func() (io.ReadCloser, error)
+	if src, ok := r.(*rio.Source); ok && w.size == 0 {
+		r = src.Reader
+		open = src.Open
+	}
+	if hr, ok := r.(*hashReader); ok && w.size == 0 && hr.rc == nil {
+		w.buf = nil
+		w.sum = hr.hash
+		w.size = hr.size
+		w.open = hr.open
+		return hr.size, nil
+	}
+	n, err := io.Copy(struct{ io.Writer }{w}, r)
+	if err != nil {
+		return n, err
+	}
+	w.open = open
+	return n, nil
 }
+
+// unhash hashes the content a hashReader's shortcut skipped, so more can be
+// written after it
+func (w *Writer) unhash() error {
+	if w.open == nil {
+		return fmt.Errorf("dry run: can't append to %s, its content isn't kept", w.file.info.Fname)
+	}
+	src, err := w.open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	n, err := io.Copy(w.hash, src)
+	if err != nil {
+		return err
+	}
+	w.size = n
+	w.sum = ""
+	return nil
+}
+
 func (w *Writer) Close() error {
 	w.host.fsmu.Lock()
 	defer w.host.fsmu.Unlock()
-	if w.buf == nil {
-		// already closed
-		return w.err
+	if w.closed {
+		return nil
 	}
-
-	w.file.content = w.buf.Bytes()
-	w.file.info.Fsize = int64(len(w.file.content))
+	w.closed = true
+
+	if w.buf != nil {
+		w.file.content = append([]byte{}, w.buf.Bytes()...)
+	} else {
+		w.file.content = nil
+		w.file.hash = w.sum
+		if w.sum == "" {
+			w.file.hash = hex.EncodeToString(w.hash.Sum(nil))
+		}
+		w.file.open = w.open
+	}
+	w.file.info.Fsize = w.size
 	w.file.info.Fmodtime = time.Now()
 
 	w.buf = nil
-	w.err = nil
 	return nil
 }
 
@@ -45,7 +129,7 @@ func (host *Host) Create(fpath string) (io.WriteCloser, error) {
 	host.fsmu.Lock()
 	defer host.fsmu.Unlock()
 
-	file := host.fs[fpath]
+	file := host.lookup(fpath)
 	if file != nil && file.info != nil {
 		// TODO: Someday, be super cool and emulate a bunch of common permission errors.
 
@@ -65,6 +149,7 @@ func (host *Host) Create(fpath string) (io.WriteCloser, error) {
 			Fuid:     host.uid,
 			Fgid:     host.gid,
 		},
+		content: []byte{},
 	}
 	host.fs[fpath] = file
 
@@ -74,6 +159,7 @@ func (host *Host) Create(fpath string) (io.WriteCloser, error) {
 		file: file,
 		host: host,
 		buf:  &bytes.Buffer{},
+		hash: sha256.New(),
 	}
 	return writer, nil
 }
@@ -82,7 +168,7 @@ func (host *Host) Remove(fpath string) error {
 	host.fsmu.Lock()
 	defer host.fsmu.Unlock()
 
-	file := host.fs[fpath]
+	file := host.lookup(fpath)
 	if file != nil && file.info != nil {
 		// TODO: Someday, be super cool and emulate a bunch of common permission errors.
 
@@ -116,15 +202,14 @@ func (host *Host) Rename(fpath, newpath string) error {
 		}
 	}
 
-	file := host.fs[fpath]
+	file := host.lookup(fpath)
 
 	// we need to read the existing contents in order to correctly model the move, otherwise a dry run
 	// rename followed by a read would not return the correct contents. Maybe in the future, this could
 	// be replaced by a sort of virtual symlink to the cascade filesystem's path?
 	if file == nil && host.cascade != nil {
-		buf, err := host.cascade.ReadFile(fpath)
-		if err != nil {
-			return err
+		if erra != nil {
+			return erra
 		}
 
 		fi, err := util.ConvertStat(sa)
@@ -133,8 +218,12 @@ func (host *Host) Rename(fpath, newpath string) error {
 		}
 
 		file = &File{
-			info:    fi,
-			content: buf,
+			info: fi,
+		}
+	}
+	if file != nil && file.uncached() && host.cascade != nil {
+		if err := host.cascadecontent(fpath, file); err != nil {
+			return err
 		}
 	}
 
@@ -158,9 +247,9 @@ func (host *Host) Chmod(fpath string, mode os.FileMode) error {
 	host.fsmu.Lock()
 	defer host.fsmu.Unlock()
 
-	file := host.fs[fpath]
+	rpath, file := host.resolve(fpath)
 	if file == nil && host.cascade != nil {
-		f, err := host.cascade.Stat(fpath)
+		f, err := host.cascade.Stat(rpath)
 		if err != nil {
 			return err
 		}
@@ -173,7 +262,7 @@ func (host *Host) Chmod(fpath string, mode os.FileMode) error {
 		file = &File{
 			info: fi,
 		}
-		host.fs[fpath] = file
+		host.fs[rpath] = file
 	}
 	if file == nil || file.info == nil {
 		return &os.PathError{Op: "chmod", Path: fpath, Err: syscall.ENOENT}
@@ -191,9 +280,9 @@ func (host *Host) Chown(fpath string, uid uint32, gid uint32) error {
 	host.fsmu.Lock()
 	defer host.fsmu.Unlock()
 
-	file := host.fs[fpath]
+	rpath, file := host.resolve(fpath)
 	if file == nil && host.cascade != nil {
-		f, err := host.cascade.Stat(fpath)
+		f, err := host.cascade.Stat(rpath)
 		if err != nil {
 			return err
 		}
@@ -205,6 +294,7 @@ func (host *Host) Chown(fpath string, uid uint32, gid uint32) error {
 		file = &File{
 			info: info,
 		}
+		host.fs[rpath] = file
 	}
 	if file == nil || file.info == nil {
 		return &os.PathError{Op: "chown", Path: fpath, Err: syscall.ENOENT}
@@ -218,3 +308,185 @@ func (host *Host) Chown(fpath string, uid uint32, gid uint32) error {
 	file.info.Fgid = gid
 	return nil
 }
+
+func (host *Host) Mkdir(fpath string, mode os.FileMode) error {
+	host.fsmu.Lock()
+	defer host.fsmu.Unlock()
+
+	if err := host.mkparent("mkdir", fpath); err != nil {
+		return err
+	}
+
+	if err := util.Mkdir(host, fpath, mode); err != nil {
+		return err
+	}
+
+	host.fs[fpath] = &File{
+		info: &util.FileInfo{
+			Fname:    path.Base(fpath),
+			Fmode:    mode,
+			Fmodtime: time.Now(),
+			Fisdir:   true,
+			Fuid:     host.uid,
+			Fgid:     host.gid,
+		},
+		opaque: true,
+	}
+	return nil
+}
+
+func (host *Host) RemoveAll(fpath string) error {
+	host.fsmu.Lock()
+	defer host.fsmu.Unlock()
+
+	if err := util.RemoveAll(host, fpath); err != nil {
+		return err
+	}
+
+	// the tombstone hides everything underneath it
+	for p := range host.fs {
+		if strings.HasPrefix(p, fpath+"/") {
+			delete(host.fs, p)
+		}
+	}
+	host.fs[fpath] = &File{}
+	return nil
+}
+
+// mkparent checks that fpath could be created. fsmu must be locked.
+func (host *Host) mkparent(op, fpath string) error {
+	if _, err := host.lstat(fpath); err == nil {
+		return &os.PathError{Op: op, Path: fpath, Err: syscall.EEXIST}
+	}
+	parent, err := host.stat(path.Dir(fpath))
+	if err != nil {
+		return &os.PathError{Op: op, Path: fpath, Err: syscall.ENOENT}
+	}
+	if !parent.IsDir() {
+		return &os.PathError{Op: op, Path: fpath, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+func (host *Host) Symlink(target, fpath string) error {
+	host.fsmu.Lock()
+	defer host.fsmu.Unlock()
+
+	if err := host.mkparent("symlink", fpath); err != nil {
+		return err
+	}
+
+	if err := util.Symlink(host, target, fpath); err != nil {
+		return err
+	}
+
+	host.fs[fpath] = &File{
+		info: &util.FileInfo{
+			Fname:    path.Base(fpath),
+			Fsize:    int64(len(target)),
+			Fmode:    0777,
+			Fmodtime: time.Now(),
+			Fislink:  true,
+			Flink:    target,
+			Fuid:     host.uid,
+			Fgid:     host.gid,
+		},
+	}
+	return nil
+}
+
+func (host *Host) Link(target, fpath string) error {
+	host.fsmu.Lock()
+	defer host.fsmu.Unlock()
+
+	if err := host.mkparent("link", fpath); err != nil {
+		return err
+	}
+
+	rpath, file := host.resolve(target)
+	if file == nil && host.cascade != nil {
+		// Same as Rename, the contents have to come along so that reading
+		// either path gives the same answer.
+		f, err := host.cascade.Stat(rpath)
+		if err != nil {
+			return err
+		}
+		info, err := util.ConvertStat(f)
+		if err != nil {
+			return err
+		}
+		file = &File{
+			info: info,
+		}
+		host.fs[rpath] = file
+	}
+	if file != nil && file.uncached() && host.cascade != nil {
+		if err := host.cascadecontent(rpath, file); err != nil {
+			return err
+		}
+	}
+	if file == nil || file.info == nil {
+		return &os.PathError{Op: "link", Path: target, Err: syscall.ENOENT}
+	}
+	if file.info.Fisdir {
+		return &os.PathError{Op: "link", Path: target, Err: syscall.EPERM}
+	}
+
+	if err := util.Link(host, target, fpath); err != nil {
+		return err
+	}
+
+	// both paths share the one File, so they share an inode as far as
+	// anybody can tell
+	host.fs[fpath] = file
+	return nil
+}
+
+func (host *Host) Lchown(fpath string, uid uint32, gid uint32) error {
+	host.fsmu.Lock()
+	defer host.fsmu.Unlock()
+
+	file := host.lookup(fpath)
+	if file == nil && host.cascade != nil {
+		f, err := host.cascade.Lstat(fpath)
+		if err != nil {
+			return err
+		}
+		info, err := util.ConvertStat(f)
+		if err != nil {
+			return err
+		}
+
+		file = &File{
+			info: info,
+		}
+		host.fs[fpath] = file
+	}
+	if file == nil || file.info == nil {
+		return &os.PathError{Op: "lchown", Path: fpath, Err: syscall.ENOENT}
+	}
+
+	if err := util.Lchown(host, fpath, uid, gid); err != nil {
+		return err
+	}
+
+	file.info.Fuid = uid
+	file.info.Fgid = gid
+	return nil
+}
+
+// cascadecontent copies a file's content from the cascade host, or just its
+// hash if it's too big
+func (host *Host) cascadecontent(fpath string, file *File) error {
+	var err error
+	if file.info.Fsize > maxcontent {
+		file.hash, err = host.cascade.Hash(fpath)
+		cascade := host.cascade
+		file.open = func() (io.ReadCloser, error) {
+			return cascade.Open(fpath)
+		}
+	} else {
+		file.content, err = host.cascade.ReadFile(fpath)
+	}
+	return err
+}
@@ -24,6 +24,12 @@ type Host struct {
 	users     map[string]*rio.User
 	groups    map[string]*rio.Group
 	passwords map[string]*rio.Password
+
+	pkgsmu   sync.Mutex
+	packages map[string]*rio.Package
+
+	servicesmu sync.Mutex
+	services   map[string]*rio.Service
 }
 
 func (host *Host) String() string {
@@ -49,6 +55,8 @@ func New(uid, gid uint32, cascade rio.Host) *Host {
 		users:     map[string]*rio.User{},
 		groups:    map[string]*rio.Group{},
 		passwords: map[string]*rio.Password{},
+		packages:  map[string]*rio.Package{},
+		services:  map[string]*rio.Service{},
 	}
 }
 
@@ -64,3 +72,11 @@ func (host *Host) Info() (*rio.Info, error) {
 		Arch:     runtime.GOARCH,
 	}, nil
 }
+
+// Facts are the real host's, since the dry run doesn't change them
+func (host *Host) Facts() (*rio.Facts, error) {
+	if host.cascade != nil {
+		return host.cascade.Facts()
+	}
+	return &rio.Facts{}, nil
+}
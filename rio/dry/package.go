@@ -0,0 +1,76 @@
+package dry
+
+import (
+	"khan.rip/rio"
+	"khan.rip/rio/util"
+)
+
+func (host *Host) Packages(names []string) (map[string]*rio.Package, error) {
+	host.pkgsmu.Lock()
+	defer host.pkgsmu.Unlock()
+
+	r := map[string]*rio.Package{}
+
+	var rest []string
+	for _, name := range names {
+		pkg, ok := host.packages[name]
+		if !ok {
+			rest = append(rest, name)
+			continue
+		}
+		if pkg != nil {
+			r[name] = pkg
+		}
+	}
+
+	if len(rest) > 0 && host.cascade != nil {
+		upstream, err := host.cascade.Packages(rest)
+		if err != nil {
+			return nil, err
+		}
+		for name, pkg := range upstream {
+			r[name] = pkg
+		}
+	}
+
+	return r, nil
+}
+
+func (host *Host) InstallPackages(pkgs []*rio.Package) error {
+	host.pkgsmu.Lock()
+	defer host.pkgsmu.Unlock()
+
+	if err := util.InstallPackages(host, pkgs); err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		host.packages[pkg.Name] = pkg
+	}
+	return nil
+}
+
+func (host *Host) RemovePackages(names []string) error {
+	host.pkgsmu.Lock()
+	defer host.pkgsmu.Unlock()
+
+	if err := util.RemovePackages(host, names); err != nil {
+		return err
+	}
+	for _, name := range names {
+		host.packages[name] = nil // tombstone
+	}
+	return nil
+}
+
+// installedPackages reports whether any packages were installed during this dry run
+func (host *Host) installedPackages() bool {
+	host.pkgsmu.Lock()
+	defer host.pkgsmu.Unlock()
+
+	for _, pkg := range host.packages {
+		if pkg != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package dry
+
+import (
+	"fmt"
+
+	"khan.rip/rio"
+	"khan.rip/rio/util"
+)
+
+func (host *Host) Service(name string) (*rio.Service, error) {
+	host.servicesmu.Lock()
+	defer host.servicesmu.Unlock()
+
+	old, ok := host.services[name]
+	if ok {
+		return old, nil
+	}
+	if host.cascade != nil {
+		var err error
+		old, err = host.cascade.Service(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if old == nil && host.installedPackages() {
+		// We can't know what services a package would have brought along,
+		// so give it the benefit of the doubt.
+		old = &rio.Service{
+			Name: name,
+		}
+		host.services[name] = old
+	}
+	return old, nil
+}
+
+func (host *Host) UpdateService(service *rio.Service) error {
+	host.servicesmu.Lock()
+	defer host.servicesmu.Unlock()
+
+	old, ok := host.services[service.Name]
+	if !ok && host.cascade != nil {
+		var err error
+		old, err = host.cascade.Service(service.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if old == nil && host.installedPackages() {
+		old = &rio.Service{
+			Name: service.Name,
+		}
+	}
+	if old == nil {
+		return fmt.Errorf("Service %#v does not exist", service.Name)
+	}
+	if err := util.UpdateService(host, old, service); err != nil {
+		return err
+	}
+	host.services[service.Name] = service
+	return nil
+}
+
+func (host *Host) RestartService(name string) error {
+	return host.notifyService(name)
+}
+
+func (host *Host) ReloadService(name string) error {
+	return host.notifyService(name)
+}
+
+// notifyService only checks there's a service to restart or reload. The run
+// reports what would happen, like it does for everything else.
+func (host *Host) notifyService(name string) error {
+	service, err := host.Service(name)
+	if err != nil {
+		return err
+	}
+	if service == nil {
+		return fmt.Errorf("Service %#v does not exist", name)
+	}
+	return nil
+}
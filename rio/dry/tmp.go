@@ -43,7 +43,7 @@ func (host *Host) TmpDir() (string, error) {
 		fpath = fmt.Sprintf("/tmp/tmpkhan_%d", i)
 	}
 
-	if err := util.Mkdir(host, fpath); err != nil {
+	if err := util.Mkdir(host, fpath, 0700); err != nil {
 		return "", err
 	}
 	file := &File{
@@ -56,6 +56,7 @@ func (host *Host) TmpDir() (string, error) {
 			Fuid:     host.uid,
 			Fgid:     host.gid,
 		},
+		opaque: true,
 	}
 	host.fs[fpath] = file
 	host.tmpdir = fpath
@@ -2,9 +2,13 @@ package rio
 
 import (
 	"context"
+	"errors"
 	"io"
+	"os"
+	"os/exec"
 
 	"github.com/keegancsmith/shell"
+	"golang.org/x/crypto/ssh"
 )
 
 type Cmd struct {
@@ -47,6 +51,37 @@ func (c CmdErr) Error() string {
 	return r
 }
 
+func (c CmdErr) Unwrap() error {
+	return c.ExecErr
+}
+
+// Exited is whether a command's error only means it exited with a non-zero
+// status, rather than it not getting to run (like when the host is
+// unreachable).
+func Exited(err error) bool {
+	var (
+		sshexit  *ssh.ExitError
+		execexit *exec.ExitError
+		patherr  *os.PathError // remote hosts make these from "No such file or directory"
+	)
+	return errors.As(err, &sshexit) || errors.As(err, &execexit) || errors.As(err, &patherr)
+}
+
+// ExitStatus is the status a command exited with, if that's all its error is
+func ExitStatus(err error) (int, bool) {
+	var (
+		sshexit  *ssh.ExitError
+		execexit *exec.ExitError
+	)
+	switch {
+	case errors.As(err, &sshexit):
+		return sshexit.ExitStatus(), true
+	case errors.As(err, &execexit):
+		return execexit.ExitCode(), true
+	}
+	return 0, false
+}
+
 func Command(ctx context.Context, path string, args ...string) *Cmd {
 	return &Cmd{
 		Path:    path,
@@ -0,0 +1,58 @@
+package rio
+
+import (
+	"net"
+	"strings"
+)
+
+// Facts are more than Info knows about a host. They take a few commands to
+// find out, so hosts only gather them once, when they're first asked for.
+// Anything that couldn't be found out is left blank.
+type Facts struct {
+	// Distro is the ID from /etc/os-release, like "ubuntu" (or the OS, if
+	// it has no such file)
+	Distro        string
+	DistroVersion string
+	DistroName    string // PRETTY_NAME, like "Ubuntu 22.04.3 LTS"
+
+	// DistroFamily groups distributions that work alike: "debian",
+	// "redhat", "alpine", "arch" or "suse", otherwise the same as Distro
+	DistroFamily string
+
+	CPUs   int
+	Memory int64 // bytes
+
+	Interfaces []*Interface
+	Mounts     []*Mount
+
+	// Virtualization is what the host runs in, like "kvm" or "docker", or
+	// "none" on bare metal
+	Virtualization string
+}
+
+type Interface struct {
+	Name  string
+	Addrs []string // with prefix lengths, like 10.0.0.5/24
+}
+
+type Mount struct {
+	Device string
+	Path   string
+	Type   string
+}
+
+// IPs are the addresses of all the interfaces, without loopback or link
+// local ones
+func (f *Facts) IPs() []string {
+	var ips []string
+	for _, iface := range f.Interfaces {
+		for _, addr := range iface.Addrs {
+			ip := net.ParseIP(strings.SplitN(addr, "/", 2)[0])
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips
+}
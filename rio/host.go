@@ -9,6 +9,7 @@ import (
 type Host interface {
 	String() string
 	Info() (*Info, error)
+	Facts() (*Facts, error)
 
 	TmpFile() (string, error)
 	TmpDir() (string, error)
@@ -19,11 +20,24 @@ type Host interface {
 	Stat(string) (os.FileInfo, error)
 	Open(string) (io.ReadCloser, error)
 	ReadFile(string) ([]byte, error)
+	// Hash returns the sha256 of a file's content in hex, so it can be
+	// compared without reading the whole thing
+	Hash(string) (string, error)
 	Create(string) (io.WriteCloser, error)
 	Remove(string) error // I'd rather call this Delete. But in this case, follow "os" package style.
 	Chmod(string, os.FileMode) error
 	Chown(string, uint32, uint32) error
 	Rename(string, string) error
+	Mkdir(string, os.FileMode) error
+	RemoveAll(string) error
+	ReadDir(string) ([]os.FileInfo, error)
+
+	// Lstat does not follow symlinks, and fills in the link target
+	Lstat(string) (os.FileInfo, error)
+	Readlink(string) (string, error)
+	Symlink(string, string) error // target, path (same order as "os" and ln)
+	Link(string, string) error
+	Lchown(string, uint32, uint32) error
 
 	User(string) (*User, error)
 	CreateUser(*User) error
@@ -37,6 +51,18 @@ type Host interface {
 
 	Password(string) (*Password, error)
 	UpdatePassword(*Password) error
+
+	// Packages returns the installed packages out of the list of names.
+	// Packages that are not installed are absent from the map.
+	Packages([]string) (map[string]*Package, error)
+	InstallPackages([]*Package) error
+	RemovePackages([]string) error
+
+	// Service returns nil if there is no such service
+	Service(string) (*Service, error)
+	UpdateService(*Service) error
+	RestartService(string) error
+	ReloadService(string) error
 }
 
 type Info struct {
@@ -50,3 +76,11 @@ type Info struct {
 func (info *Info) String() string {
 	return fmt.Sprintf("%s (%s/%s)", info.Hostname, info.OS, info.Arch)
 }
+
+// Source is content that can be read again from the start. Hosts that would
+// rather not keep a copy of big content written to them, like dry runs, get
+// it from Open again when it's needed.
+type Source struct {
+	io.Reader
+	Open func() (io.ReadCloser, error)
+}
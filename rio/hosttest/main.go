@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"net"
 	"os"
 
@@ -30,15 +31,22 @@ func run() error {
 		return fmt.Errorf("Failed to open SSH_AUTH_SOCK: %w", err)
 	}
 	agentClient := agent.NewClient(conn)
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	hostkeys, err := knownhosts.New(home + "/.ssh/known_hosts")
+	if err != nil {
+		return err
+	}
+
 	sshconfig := &ssh.ClientConfig{
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeysCallback(agentClient.Signers),
 		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// TODO
-			return nil
-		},
-		BannerCallback: ssh.BannerDisplayStderr(),
+		HostKeyCallback: hostkeys,
+		BannerCallback:  ssh.BannerDisplayStderr(),
 	}
 
 	pool := sshpool.New(sshconfig, &sshpool.PoolConfig{Debug: true})
@@ -0,0 +1,155 @@
+package local
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+
+	"khan.rip/rio"
+	"khan.rip/rio/util"
+)
+
+// Becoming another user means everything has to go through commands, since
+// sudo can't be applied to a syscall.
+
+func (host *Host) becomer() (*rio.Becomer, error) {
+	host.becomemu.Lock()
+	if host.becomerstate == nil {
+		host.becomerstate = rio.NewBecomer(host.Become)
+	}
+	b := host.becomerstate
+	host.becomemu.Unlock()
+
+	if err := b.Init(runtime.GOOS, probe); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func probe(stdin io.Reader, args ...string) error {
+	c := exec.Command(args[0], args[1:]...)
+	errbuf := &bytes.Buffer{}
+	c.Stdin = stdin
+	c.Stderr = errbuf
+	if err := c.Run(); err != nil {
+		return &rio.CmdErr{Cmd: rio.Command(nil, args[0], args[1:]...), StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+	}
+	return nil
+}
+
+// command makes an exec.Cmd that runs as the become user
+func (host *Host) command(stdin io.Reader, args ...string) (*exec.Cmd, error) {
+	b, err := host.becomer()
+	if err != nil {
+		return nil, err
+	}
+	args = b.Args(args...)
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = b.Stdin(stdin)
+	return c, nil
+}
+
+func (host *Host) becomeopen(fpath string) (io.ReadCloser, error) {
+	c, err := host.command(nil, "cat", fpath)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	errbuf := &bytes.Buffer{}
+	c.Stdout = w
+	c.Stderr = errbuf
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		err := c.Wait()
+		if err != nil {
+			e := strings.TrimSpace(errbuf.String())
+			if strings.HasPrefix(e, "cat: ") && strings.HasSuffix(e, "No such file or directory") {
+				err = &os.PathError{Op: "open", Path: fpath, Err: syscall.ENOENT}
+			} else {
+				err = &rio.CmdErr{Cmd: rio.Command(nil, "cat", fpath), StdErr: e, ExecErr: err}
+			}
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+func (host *Host) becomereadfile(fpath string) ([]byte, error) {
+	fh, err := host.becomeopen(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return ioutil.ReadAll(fh)
+}
+
+// becomewriter waits for cat to finish when it's closed
+type becomewriter struct {
+	*io.PipeWriter
+	done chan error
+
+	closeonce sync.Once
+	closeerr  error
+}
+
+func (w *becomewriter) Close() error {
+	w.closeonce.Do(func() {
+		if w.closeerr = w.PipeWriter.Close(); w.closeerr == nil {
+			w.closeerr = <-w.done
+		}
+	})
+	return w.closeerr
+}
+
+func (host *Host) becomecreate(fpath string) (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	c, err := host.command(r, "sh", "-c", "cat > \"$0\"", fpath)
+	if err != nil {
+		return nil, err
+	}
+	errbuf := &bytes.Buffer{}
+	c.Stderr = errbuf
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	bw := &becomewriter{PipeWriter: w, done: make(chan error, 1)}
+	go func() {
+		err := c.Wait()
+		if err != nil {
+			err = &rio.CmdErr{Cmd: rio.Command(nil, "cat", ">", fpath), StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+			r.CloseWithError(err)
+		}
+		bw.done <- err
+	}()
+	return bw, nil
+}
+
+func (host *Host) becomestat(fpath string, follow bool) (*util.FileInfo, error) {
+	args := []string{"stat"}
+	if follow {
+		args = append(args, "-L")
+	}
+	if runtime.GOOS == "openbsd" {
+		args = append(args, "-r")
+	} else {
+		args = append(args, "-t")
+	}
+	c, err := host.command(nil, append(args, fpath)...)
+	if err != nil {
+		return nil, err
+	}
+	outbuf := &bytes.Buffer{}
+	errbuf := &bytes.Buffer{}
+	c.Stdout = outbuf
+	c.Stderr = errbuf
+	err = c.Run()
+	return util.ParseStat(runtime.GOOS, fpath, strings.TrimSpace(outbuf.String()), strings.TrimSpace(errbuf.String()), err)
+}
@@ -2,12 +2,15 @@ package local
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
 
 	"khan.rip/rio"
+
+	"github.com/keegancsmith/shell"
 )
 
 func (host *Host) Exec(cmd *rio.Cmd) error {
@@ -22,8 +25,43 @@ func (host *Host) Exec(cmd *rio.Cmd) error {
 		stderr = errbuf
 	}
 
-	c := exec.CommandContext(cmd.Context, cmd.Path, cmd.Args...)
-	c.Stdin = cmd.Stdin
+	ctx := cmd.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	args := append([]string{cmd.Path}, cmd.Args...)
+	if cmd.Shell {
+		// We already have our own environment, so there's no profile to
+		// source like the remote host does. Just let the shell interpret it.
+		cmdline := cmd.Path
+		for _, a := range cmd.Args {
+			cmdline += " " + shell.ReadableEscapeArg(a)
+		}
+		args = []string{"sh", "-c", cmdline}
+	}
+
+	stdin := cmd.Stdin
+	if host.Become != nil {
+		b, err := host.becomer()
+		if err != nil {
+			return err
+		}
+		// sudo throws away the environment, so set it on the other side
+		if len(cmd.Env) > 0 {
+			envargs := []string{"env"}
+			for _, e := range cmd.Env {
+				envargs = append(envargs, e[0]+"="+e[1])
+			}
+			args = append(envargs, args...)
+		}
+		args = b.Args(args...)
+		stdin = b.Stdin(stdin)
+	}
+
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	c.Dir = cmd.Dir
+	c.Stdin = stdin
 	c.Stdout = cmd.Stdout
 	c.Stderr = stderr
 	if len(cmd.Env) > 0 {
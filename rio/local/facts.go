@@ -0,0 +1,22 @@
+package local
+
+import (
+	"khan.rip/rio"
+	"khan.rip/rio/util"
+)
+
+func (host *Host) Facts() (*rio.Facts, error) {
+	host.factsmu.Lock()
+	defer host.factsmu.Unlock()
+
+	if host.facts != nil {
+		return host.facts, nil
+	}
+
+	facts, err := util.GatherFacts(host)
+	if err != nil {
+		return nil, err
+	}
+	host.facts = facts
+	return facts, nil
+}
@@ -5,41 +5,163 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+
+	"khan.rip/rio/util"
 )
 
 func (host *Host) Create(fpath string) (io.WriteCloser, error) {
 	fmt.Println(host, ">", fpath)
+	if host.Become != nil {
+		return host.becomecreate(fpath)
+	}
 	return os.Create(fpath)
 }
 
 func (host *Host) Remove(fpath string) error {
+	if host.Become != nil {
+		return util.Remove(host, fpath)
+	}
 	fmt.Println(host, "! rm", fpath)
 	return os.Remove(fpath)
 }
 
 func (host *Host) Rename(oldpath, newpath string) error {
+	if host.Become != nil {
+		return util.Rename(host, oldpath, newpath)
+	}
 	fmt.Println(host, "! mv", oldpath, newpath)
 	return os.Rename(oldpath, newpath)
 }
 
 func (host *Host) Open(fpath string) (io.ReadCloser, error) {
+	if host.Become != nil {
+		return host.becomeopen(fpath)
+	}
 	return os.Open(fpath)
 }
 
 func (host *Host) ReadFile(fpath string) ([]byte, error) {
+	if host.Become != nil {
+		return host.becomereadfile(fpath)
+	}
 	return ioutil.ReadFile(fpath)
 }
 
 func (host *Host) Stat(fpath string) (os.FileInfo, error) {
+	if host.Become != nil {
+		fi, err := host.becomestat(fpath, true)
+		if err != nil {
+			return nil, err
+		}
+		return fi, nil
+	}
 	return os.Stat(fpath)
 }
 
 func (host *Host) Chmod(fpath string, mode os.FileMode) error {
+	if host.Become != nil {
+		return util.Chmod(host, fpath, mode)
+	}
 	fmt.Printf("%s ! chmod %o %s\n", host, mode, fpath)
 	return os.Chmod(fpath, mode)
 }
 
 func (host *Host) Chown(fpath string, uid uint32, gid uint32) error {
+	if host.Become != nil {
+		return util.Chown(host, fpath, uid, gid)
+	}
 	fmt.Printf("%s ! chown %d:%d %s\n", host, uid, gid, fpath)
 	return os.Chown(fpath, int(uid), int(gid))
 }
+
+func (host *Host) Mkdir(fpath string, mode os.FileMode) error {
+	if host.Become != nil {
+		return util.Mkdir(host, fpath, mode)
+	}
+	fmt.Printf("%s ! mkdir -m %o %s\n", host, mode, fpath)
+	return os.Mkdir(fpath, mode)
+}
+
+func (host *Host) RemoveAll(fpath string) error {
+	if host.Become != nil {
+		return util.RemoveAll(host, fpath)
+	}
+	fmt.Println(host, "! rm -rf", fpath)
+	return os.RemoveAll(fpath)
+}
+
+func (host *Host) ReadDir(fpath string) ([]os.FileInfo, error) {
+	if host.Become != nil {
+		return util.ReadDir(host, fpath)
+	}
+	return ioutil.ReadDir(fpath)
+}
+
+func (host *Host) Lstat(fpath string) (os.FileInfo, error) {
+	if host.Become != nil {
+		fi, err := host.becomestat(fpath, false)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Fislink {
+			if fi.Flink, err = util.Readlink(host, fpath); err != nil {
+				return nil, err
+			}
+		}
+		return fi, nil
+	}
+	fi, err := os.Lstat(fpath)
+	if err != nil {
+		return nil, err
+	}
+	ufi, err := util.ConvertStat(fi)
+	if err != nil {
+		return nil, err
+	}
+	if ufi.Fislink {
+		if ufi.Flink, err = os.Readlink(fpath); err != nil {
+			return nil, err
+		}
+	}
+	return ufi, nil
+}
+
+func (host *Host) Readlink(fpath string) (string, error) {
+	if host.Become != nil {
+		return util.Readlink(host, fpath)
+	}
+	return os.Readlink(fpath)
+}
+
+func (host *Host) Symlink(target, fpath string) error {
+	if host.Become != nil {
+		return util.Symlink(host, target, fpath)
+	}
+	fmt.Println(host, "! ln -s", target, fpath)
+	return os.Symlink(target, fpath)
+}
+
+func (host *Host) Link(target, fpath string) error {
+	if host.Become != nil {
+		return util.Link(host, target, fpath)
+	}
+	fmt.Println(host, "! ln", target, fpath)
+	return os.Link(target, fpath)
+}
+
+func (host *Host) Lchown(fpath string, uid uint32, gid uint32) error {
+	if host.Become != nil {
+		return util.Lchown(host, fpath, uid, gid)
+	}
+	fmt.Printf("%s ! chown -h %d:%d %s\n", host, uid, gid, fpath)
+	return os.Lchown(fpath, int(uid), int(gid))
+}
+
+func (host *Host) Hash(fpath string) (string, error) {
+	fh, err := host.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	return util.HashReader(fh)
+}
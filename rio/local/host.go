@@ -7,7 +7,19 @@ import (
 )
 
 type Host struct {
+	// Become runs everything as another user with sudo or doas
+	Become *rio.Become
+
+	becomemu     sync.Mutex
+	becomerstate *rio.Becomer
+
 	// cache
+	infomu sync.Mutex
+	info   *rio.Info
+
+	factsmu sync.Mutex
+	facts   *rio.Facts
+
 	usersmu   sync.Mutex
 	users     map[string]*rio.User
 	groups    map[string]*rio.Group
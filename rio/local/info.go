@@ -2,20 +2,40 @@ package local
 
 import (
 	"os"
+	"os/exec"
 	"runtime"
+	"strings"
 
 	"khan.rip/rio"
 )
 
 func (host *Host) Info() (*rio.Info, error) {
+	host.infomu.Lock()
+	defer host.infomu.Unlock()
+
+	if host.info != nil {
+		return host.info, nil
+	}
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
 
-	return &rio.Info{
+	info := &rio.Info{
 		Hostname: hostname,
 		OS:       runtime.GOOS,
 		Arch:     runtime.GOARCH,
-	}, nil
+	}
+
+	// not much cares about these, so don't fail without them
+	if out, err := exec.Command("uname", "-a").Output(); err == nil {
+		info.Uname = strings.TrimSpace(string(out))
+	}
+	if out, err := exec.Command("uname", "-r").Output(); err == nil {
+		info.Kernel = strings.TrimSpace(string(out))
+	}
+
+	host.info = info
+	return info, nil
 }
@@ -0,0 +1,18 @@
+package local
+
+import (
+	"khan.rip/rio"
+	"khan.rip/rio/util"
+)
+
+func (host *Host) Packages(names []string) (map[string]*rio.Package, error) {
+	return util.LoadPackages(host, names)
+}
+
+func (host *Host) InstallPackages(pkgs []*rio.Package) error {
+	return util.InstallPackages(host, pkgs)
+}
+
+func (host *Host) RemovePackages(names []string) error {
+	return util.RemovePackages(host, names)
+}
@@ -1,9 +1,13 @@
 package local
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"os"
+	"strings"
+
+	"khan.rip/rio"
 )
 
 func (host *Host) TmpFile() (string, error) {
@@ -12,6 +16,10 @@ func (host *Host) TmpFile() (string, error) {
 		return "", err
 	}
 
+	if host.Become != nil {
+		return host.mktemp("-p", tmpdir, "XXXXXXXX")
+	}
+
 	fmt.Println(host, "! mktemp -p", tmpdir, "XXXXXXXX")
 
 	f, err := ioutil.TempFile(tmpdir, "")
@@ -31,9 +39,14 @@ func (host *Host) TmpDir() (string, error) {
 		return host.tmpdir, nil
 	}
 
-	fmt.Println(host, "! mktemp -d /tmp/tmpkhan_XXXXXXXX")
-
-	fpath, err := ioutil.TempDir("", "tmpkhan_")
+	var fpath string
+	var err error
+	if host.Become != nil {
+		fpath, err = host.mktemp("-d", "/tmp/tmpkhan_XXXXXXXX")
+	} else {
+		fmt.Println(host, "! mktemp -d /tmp/tmpkhan_XXXXXXXX")
+		fpath, err = ioutil.TempDir("", "tmpkhan_")
+	}
 	if err != nil {
 		return "", err
 	}
@@ -48,9 +61,21 @@ func (host *Host) Cleanup() error {
 	if host.tmpdir == "" {
 		return nil
 	}
-	fmt.Println(host, "! rm -rf", host.tmpdir)
-	if err := os.RemoveAll(host.tmpdir); err != nil {
+	if err := host.RemoveAll(host.tmpdir); err != nil {
 		return err
 	}
 	return nil
 }
+
+// mktemp makes temp files as the become user, so they own them
+func (host *Host) mktemp(args ...string) (string, error) {
+	cmd := rio.Command(context.Background(), "mktemp", args...)
+
+	buf := &bytes.Buffer{}
+	cmd.Stdout = buf
+
+	if err := host.Exec(cmd); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,6 @@
+package rio
+
+type Package struct {
+	Name    string
+	Version string
+}
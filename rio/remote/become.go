@@ -0,0 +1,63 @@
+package remote
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"khan.rip/rio"
+
+	"github.com/keegancsmith/shell"
+)
+
+// wrap makes a shell command line run as the become user, if there is one
+func (host *Host) wrap(line string, stdin io.Reader) (string, io.Reader, error) {
+	if host.Become == nil {
+		return line, stdin, nil
+	}
+
+	host.becomemu.Lock()
+	if host.becomer == nil {
+		host.becomer = rio.NewBecomer(host.Become)
+	}
+	b := host.becomer
+	host.becomemu.Unlock()
+
+	info, err := host.Info()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := b.Init(info.OS, host.probe); err != nil {
+		return "", nil, err
+	}
+
+	return cmdline(b.Args("sh", "-c", line)), b.Stdin(stdin), nil
+}
+
+// probe runs a command as the login user, to try out become
+func (host *Host) probe(stdin io.Reader, args ...string) error {
+	session, err := host.session()
+	if err != nil {
+		return err
+	}
+	defer session.Put()
+
+	errbuf := &bytes.Buffer{}
+	session.Stdin = stdin
+	session.Stderr = errbuf
+	if err := session.Run(cmdline(args)); err != nil {
+		return &rio.CmdErr{Cmd: rio.Command(nil, args[0], args[1:]...), StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+	}
+	return nil
+}
+
+func cmdline(args []string) string {
+	line := ""
+	for i, a := range args {
+		if i > 0 {
+			line += " "
+		}
+		line += shell.ReadableEscapeArg(a)
+	}
+	return line
+}
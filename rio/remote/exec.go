@@ -10,6 +10,7 @@ import (
 	"khan.rip/rio"
 
 	"github.com/keegancsmith/shell"
+	"golang.org/x/crypto/ssh"
 )
 
 func (host *Host) Exec(cmd *rio.Cmd) error {
@@ -24,13 +25,35 @@ func (host *Host) Exec(cmd *rio.Cmd) error {
 		stderr = errbuf
 	}
 
-	session, err := host.pool.Get(host.connect)
+	cmdline := cmd.Path
+	for _, a := range cmd.Args {
+		cmdline += " " + shell.ReadableEscapeArg(a)
+	}
+
+	if cmd.Dir != "" {
+		cmdline = "cd " + shell.ReadableEscapeArg(cmd.Dir) + " && " + cmdline
+	}
+
+	if cmd.Shell {
+		exports := "source /etc/profile; "
+		for _, e := range cmd.Env {
+			exports += "export " + shell.ReadableEscapeArg(e[0]) + "=" + shell.ReadableEscapeArg(e[1]) + "; "
+		}
+		cmdline = "bash -c " + shell.ReadableEscapeArg(exports+cmdline)
+	}
+
+	cmdline, stdin, err := host.wrap(cmdline, cmd.Stdin)
 	if err != nil {
 		return err
 	}
-	defer session.Close()
 
-	session.Stdin = cmd.Stdin
+	session, err := host.session()
+	if err != nil {
+		return err
+	}
+	defer session.Put()
+
+	session.Stdin = stdin
 	session.Stdout = cmd.Stdout
 	session.Stderr = stderr
 
@@ -45,21 +68,35 @@ func (host *Host) Exec(cmd *rio.Cmd) error {
 		}
 	}
 
-	cmdline := cmd.Path
-	for _, a := range cmd.Args {
-		cmdline += " " + shell.ReadableEscapeArg(a)
-	}
-
-	if cmd.Shell {
-		exports := "source /etc/profile; "
-		for _, e := range cmd.Env {
-			exports += "export " + shell.ReadableEscapeArg(e[0]) + "=" + shell.ReadableEscapeArg(e[1]) + "; "
-		}
-		cmdline = "bash -c " + shell.ReadableEscapeArg(exports+cmdline)
+	if cmd.Context != nil {
+		// There's no way to kill the remote process other than asking nicely,
+		// so also close the session to make Run give up on it.
+		// A session that got closed is done for, so wait for that to
+		// finish before the deferred Put gives up its slot. (sshpool opens
+		// a new session for every Get, so it's never handed out again.)
+		done := make(chan struct{})
+		killed := make(chan struct{})
+		defer func() {
+			close(done)
+			<-killed
+		}()
+		go func() {
+			defer close(killed)
+			select {
+			case <-cmd.Context.Done():
+				_ = session.Signal(ssh.SIGKILL)
+				_ = session.Close()
+			case <-done:
+			}
+		}()
 	}
 
 	err = session.Run(cmdline)
 
+	if err != nil && cmd.Context != nil && cmd.Context.Err() != nil {
+		return &rio.CmdErr{Cmd: cmd, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: cmd.Context.Err()}
+	}
+
 	if err != nil {
 		// Capture certain stderr responses for programs like rm, stat, chmod, chown, etc
 		// and emulate the kind of error you would get from the "os" package if the file
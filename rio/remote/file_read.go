@@ -9,6 +9,8 @@ import (
 	"sync"
 	"syscall"
 
+	"khan.rip/rio/util"
+
 	"github.com/keegancsmith/shell"
 )
 
@@ -43,11 +45,25 @@ func (r *Reader) Close() error {
 }
 
 func (host *Host) Open(path string) (io.ReadCloser, error) {
+	if c := host.sftp(); c != nil {
+		fh, err := c.open(path)
+		if err != nil {
+			return nil, err
+		}
+		return fh, nil
+	}
+
 	reader := &Reader{
 		procerr: make(chan error),
 	}
 
-	session, err := host.pool.Get(host.connect)
+	cmdline := "cat " + shell.ReadableEscapeArg(path)
+	wrapped, stdin, err := host.wrap(cmdline, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := host.session()
 	if err != nil {
 		return nil, err
 	}
@@ -56,13 +72,12 @@ func (host *Host) Open(path string) (io.ReadCloser, error) {
 
 	errbuf := &bytes.Buffer{}
 
+	session.Stdin = stdin
 	session.Stdout = w
 	session.Stderr = errbuf
 	reader.reader = r
 
-	cmdline := "cat " + shell.ReadableEscapeArg(path)
-
-	if err := session.Start(cmdline); err != nil {
+	if err := session.Start(wrapped); err != nil {
 		w.Close()
 		r.Close()
 		session.Put()
@@ -116,3 +131,7 @@ func (host *Host) ReadFile(fpath string) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+func (host *Host) Hash(fpath string) (string, error) {
+	return util.Hash(host, fpath)
+}
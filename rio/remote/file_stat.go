@@ -11,13 +11,60 @@ import (
 )
 
 func (host *Host) Stat(path string) (os.FileInfo, error) {
+	fi, err := host.stat(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (host *Host) Lstat(path string) (os.FileInfo, error) {
+	fi, err := host.stat(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Fislink {
+		if fi.Flink, err = host.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	return fi, nil
+}
+
+func (host *Host) Readlink(path string) (string, error) {
+	if c := host.sftp(); c != nil {
+		return c.readlink(path)
+	}
+	return util.Readlink(host, path)
+}
+
+func (host *Host) stat(path string, follow bool) (*util.FileInfo, error) {
+	if c := host.sftp(); c != nil {
+		return c.stat(path, follow)
+	}
+
 	// need this to know what args to pass to stat command
 	info, err := host.Info()
 	if err != nil {
 		return nil, err
 	}
 
-	session, err := host.pool.Get(host.connect)
+	statcmd := "stat"
+	if follow {
+		statcmd += " -L"
+	}
+	if info.OS == "openbsd" {
+		statcmd += " -r"
+	} else {
+		statcmd += " -t"
+	}
+
+	cmdline, stdin, err := host.wrap(statcmd+" "+shell.ReadableEscapeArg(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := host.session()
 	if err != nil {
 		return nil, err
 	}
@@ -26,16 +73,10 @@ func (host *Host) Stat(path string) (os.FileInfo, error) {
 	outbuf := &bytes.Buffer{}
 	errbuf := &bytes.Buffer{}
 
+	session.Stdin = stdin
 	session.Stdout = outbuf
 	session.Stderr = errbuf
 
-	statcmd := "stat -t"
-	if info.OS == "openbsd" {
-		statcmd = "stat -r"
-	}
-
-	cmdline := statcmd + " " + shell.ReadableEscapeArg(path)
-
 	err = session.Run(cmdline)
 
 	outstr := strings.TrimSpace(outbuf.String())
@@ -43,3 +84,10 @@ func (host *Host) Stat(path string) (os.FileInfo, error) {
 
 	return util.ParseStat(info.OS, path, outstr, errstr, err)
 }
+
+func (host *Host) ReadDir(fpath string) ([]os.FileInfo, error) {
+	if c := host.sftp(); c != nil {
+		return c.readdir(fpath)
+	}
+	return util.ReadDir(host, fpath)
+}
@@ -45,15 +45,31 @@ func (w *Writer) Close() error {
 func (host *Host) Create(path string) (io.WriteCloser, error) {
 	fmt.Println(host, ">", path)
 
-	session, err := host.pool.Get(host.connect)
+	if c := host.sftp(); c != nil {
+		fh, err := c.create(path)
+		if err != nil {
+			return nil, err
+		}
+		return fh, nil
+	}
+
+	cmdline := "cat > " + shell.ReadableEscapeArg(path)
+
+	r, w := io.Pipe()
+
+	wrapped, stdin, err := host.wrap(cmdline, r)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := host.session()
 	if err != nil {
 		return nil, err
 	}
 
-	r, w := io.Pipe()
 	errbuf := &bytes.Buffer{}
 
-	session.Stdin = r
+	session.Stdin = stdin
 	session.Stderr = errbuf
 
 	writer := &Writer{
@@ -61,9 +77,7 @@ func (host *Host) Create(path string) (io.WriteCloser, error) {
 		writer:  w,
 	}
 
-	cmdline := "cat > " + shell.ReadableEscapeArg(path)
-
-	if err := session.Start(cmdline); err != nil {
+	if err := session.Start(wrapped); err != nil {
 		w.Close()
 		r.Close()
 		session.Put()
@@ -89,17 +103,53 @@ func (host *Host) Create(path string) (io.WriteCloser, error) {
 }
 
 func (host *Host) Remove(fpath string) error {
+	if c := host.sftp(); c != nil {
+		fmt.Println(host, "! rm", fpath)
+		return c.remove(fpath)
+	}
 	return util.Remove(host, fpath)
 }
 
 func (host *Host) Rename(oldpath, newpath string) error {
+	if c := host.sftp(); c != nil && c.canrename() {
+		fmt.Println(host, "! mv", oldpath, newpath)
+		return c.rename(oldpath, newpath)
+	}
 	return util.Rename(host, oldpath, newpath)
 }
 
 func (host *Host) Chown(fpath string, uid uint32, gid uint32) error {
+	if c := host.sftp(); c != nil {
+		fmt.Printf("%s ! chown %d:%d %s\n", host, uid, gid, fpath)
+		return c.chown(fpath, uid, gid)
+	}
 	return util.Chown(host, fpath, uid, gid)
 }
 
 func (host *Host) Chmod(fpath string, perms os.FileMode) error {
+	if c := host.sftp(); c != nil {
+		fmt.Printf("%s ! chmod %o %s\n", host, perms, fpath)
+		return c.chmod(fpath, perms)
+	}
 	return util.Chmod(host, fpath, perms)
 }
+
+func (host *Host) Mkdir(fpath string, mode os.FileMode) error {
+	return util.Mkdir(host, fpath, mode)
+}
+
+func (host *Host) RemoveAll(fpath string) error {
+	return util.RemoveAll(host, fpath)
+}
+
+func (host *Host) Symlink(target, fpath string) error {
+	return util.Symlink(host, target, fpath)
+}
+
+func (host *Host) Link(target, fpath string) error {
+	return util.Link(host, target, fpath)
+}
+
+func (host *Host) Lchown(fpath string, uid uint32, gid uint32) error {
+	return util.Lchown(host, fpath, uid, gid)
+}
@@ -6,15 +6,37 @@ import (
 	"khan.rip/rio"
 
 	"github.com/desops/sshpool"
+	"golang.org/x/crypto/ssh"
 )
 
 type Host struct {
-	pool    *sshpool.Pool
+	// Name is shown instead of the connect string if set, which is handy
+	// when that's an address looked up in ssh_config.
+	Name string
+
+	// Become runs everything as another user, with sudo or doas
+	Become *rio.Become
+
+	becomemu sync.Mutex
+	becomer  *rio.Becomer
+
+	pool    Pool
 	connect string
 
+	// for hosts made with NewClient
+	client   func() (*ssh.Client, error)
+	sessions chan struct{}
+
+	sftpmu      sync.Mutex
+	sftpstarted bool
+	sftpc       *sftpclient
+
 	infomu sync.Mutex
 	info   *rio.Info
 
+	factsmu sync.Mutex
+	facts   *rio.Facts
+
 	usersmu   sync.Mutex
 	users     map[string]*rio.User
 	groups    map[string]*rio.Group
@@ -25,12 +47,32 @@ type Host struct {
 }
 
 func (host *Host) String() string {
+	if host.Name != "" {
+		return "ssh " + host.Name
+	}
 	return "ssh " + host.connect
 }
 
-func New(pool *sshpool.Pool, connect string) *Host {
+// Pool is where a host's sessions come from, which is usually an
+// sshpool.Pool
+type Pool interface {
+	Get(host string) (*sshpool.Session, error)
+}
+
+func New(pool Pool, connect string) *Host {
 	return &Host{
 		pool:    pool,
 		connect: connect,
 	}
 }
+
+// NewClient is New for a host that sshpool can't dial itself, like one
+// behind a jump host. client is called for every session, and should give
+// back the same connection until it goes away.
+func NewClient(client func() (*ssh.Client, error), connect string) *Host {
+	return &Host{
+		connect:  connect,
+		client:   client,
+		sessions: make(chan struct{}, sshpool.DefaultMaxSessions),
+	}
+}
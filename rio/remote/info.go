@@ -16,7 +16,7 @@ func (host *Host) Info() (*rio.Info, error) {
 		return host.info, nil
 	}
 
-	session, err := host.pool.Get(host.connect)
+	session, err := host.session()
 	if err != nil {
 		return nil, err
 	}
@@ -54,8 +54,15 @@ func (host *Host) Info() (*rio.Info, error) {
 	}
 
 	// try to make like GOARCH
-	if info.Arch == "x86_64" {
+	switch info.Arch {
+	case "x86_64":
 		info.Arch = "amd64"
+	case "aarch64":
+		info.Arch = "arm64"
+	case "i386", "i486", "i586", "i686":
+		info.Arch = "386"
+	case "armv6l", "armv7l":
+		info.Arch = "arm"
 	}
 
 	return info, nil
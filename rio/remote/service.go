@@ -0,0 +1,31 @@
+package remote
+
+import (
+	"fmt"
+
+	"khan.rip/rio"
+	"khan.rip/rio/util"
+)
+
+func (host *Host) Service(name string) (*rio.Service, error) {
+	return util.LoadService(host, name)
+}
+
+func (host *Host) UpdateService(service *rio.Service) error {
+	old, err := util.LoadService(host, service.Name)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return fmt.Errorf("Service %#v does not exist", service.Name)
+	}
+	return util.UpdateService(host, old, service)
+}
+
+func (host *Host) RestartService(name string) error {
+	return util.RestartService(host, name)
+}
+
+func (host *Host) ReloadService(name string) error {
+	return util.ReloadService(host, name)
+}
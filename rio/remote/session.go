@@ -0,0 +1,49 @@
+package remote
+
+import (
+	"time"
+
+	"github.com/desops/sshpool"
+	"golang.org/x/crypto/ssh"
+)
+
+// session is an SSH session to the host. Put gives it back when it's done.
+type session struct {
+	*ssh.Session
+	put func()
+}
+
+func (s *session) Put() {
+	s.put()
+}
+
+func (host *Host) session() (*session, error) {
+	if host.client == nil {
+		s, err := host.pool.Get(host.connect)
+		if err != nil {
+			return nil, err
+		}
+		return &session{Session: s.Session, put: s.Put}, nil
+	}
+
+	// Everything shares the one connection, so keep to sshd's default
+	// MaxSessions like sshpool does.
+	host.sessions <- struct{}{}
+	client, err := host.client()
+	if err != nil {
+		<-host.sessions
+		return nil, err
+	}
+	s, err := client.NewSession()
+	if err != nil {
+		<-host.sessions
+		return nil, err
+	}
+	return &session{Session: s, put: func() {
+		go func() {
+			// see sshpool.DefaultSessionCloseDelay
+			time.Sleep(sshpool.DefaultSessionCloseDelay)
+			<-host.sessions
+		}()
+	}}, nil
+}
@@ -0,0 +1,245 @@
+package remote
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"khan.rip/rio/util"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpclient is the host's SFTP connection, for reading, writing and
+// stat-ing files without running commands and scraping their output
+type sftpclient struct {
+	session *session
+	client  *sftp.Client
+
+	mu   sync.Mutex
+	dead bool
+}
+
+// sftp returns the host's SFTP connection, starting it the first time. It
+// returns nil if the host doesn't do SFTP, so the caller can fall back to
+// running commands. With become, everything has to go through sudo/doas, so
+// SFTP (running as the login user) is no use.
+func (host *Host) sftp() *sftpclient {
+	if host.Become != nil {
+		return nil
+	}
+
+	host.sftpmu.Lock()
+	defer host.sftpmu.Unlock()
+
+	if !host.sftpstarted {
+		host.sftpstarted = true
+		c, err := newsftpclient(host)
+		if err != nil {
+			return nil
+		}
+		host.sftpc = c
+	}
+	if host.sftpc == nil {
+		return nil
+	}
+
+	host.sftpc.mu.Lock()
+	dead := host.sftpc.dead
+	host.sftpc.mu.Unlock()
+	if dead {
+		return nil
+	}
+
+	return host.sftpc
+}
+
+func (host *Host) closesftp() {
+	host.sftpmu.Lock()
+	defer host.sftpmu.Unlock()
+
+	if host.sftpc != nil {
+		host.sftpc.close()
+		host.sftpc = nil
+	}
+}
+
+func newsftpclient(host *Host) (*sftpclient, error) {
+	session, err := host.session()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Put()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Put()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		session.Put()
+		return nil, err
+	}
+
+	c, err := sftpconnect(stdout, stdin)
+	if err != nil {
+		session.Close()
+		session.Put()
+		return nil, err
+	}
+	c.session = session
+	return c, nil
+}
+
+// sftpconnect starts talking SFTP to a server. Once the connection is lost,
+// the client is dead and the host goes back to running commands.
+func sftpconnect(rd io.Reader, wr io.WriteCloser) (*sftpclient, error) {
+	client, err := sftp.NewClientPipe(rd, wr)
+	if err != nil {
+		return nil, err
+	}
+	c := &sftpclient{client: client}
+	go func() {
+		_ = client.Wait()
+		c.mu.Lock()
+		c.dead = true
+		c.mu.Unlock()
+	}()
+	return c, nil
+}
+
+func (c *sftpclient) close() {
+	c.client.Close()
+	if c.session != nil {
+		c.session.Close()
+		c.session.Put()
+	}
+}
+
+// sftperr makes errors from the server look like the os package's, since
+// that's what everything checks for
+func sftperr(op, fpath string, err error) error {
+	var status *sftp.StatusError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		err = syscall.ENOENT
+	case errors.Is(err, os.ErrPermission):
+		err = syscall.EACCES
+	case errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxOpUnsupported:
+		err = syscall.ENOTSUP
+	case errors.As(err, &status):
+	default:
+		// the connection, not the file
+		return err
+	}
+	return &os.PathError{Op: op, Path: fpath, Err: err}
+}
+
+// fileinfo is a FileInfo like util.ParseStat's. SFTP doesn't know about
+// devices or inodes, so those are left as 0.
+func fileinfo(name string, fi os.FileInfo) *util.FileInfo {
+	ufi := &util.FileInfo{
+		Fname:    name,
+		Fsize:    fi.Size(),
+		Fmodtime: fi.ModTime(),
+	}
+	if st, ok := fi.Sys().(*sftp.FileStat); ok {
+		ufi.Fmode = os.FileMode(st.Mode)
+		ufi.Fuid = st.UID
+		ufi.Fgid = st.GID
+		ufi.Fmodtime = time.Unix(int64(st.Mtime), 0)
+	}
+	switch ufi.Fmode & util.S_ifmt {
+	case util.S_ifdir:
+		ufi.Fisdir = true
+	case util.S_iflnk:
+		ufi.Fislink = true
+	}
+	return ufi
+}
+
+func (c *sftpclient) stat(fpath string, follow bool) (*util.FileInfo, error) {
+	stat, op := c.client.Lstat, "lstat"
+	if follow {
+		stat, op = c.client.Stat, "stat"
+	}
+	fi, err := stat(fpath)
+	if err != nil {
+		return nil, sftperr(op, fpath, err)
+	}
+	// like the stat command, the name is what it was asked for
+	return fileinfo(fpath, fi), nil
+}
+
+func (c *sftpclient) readlink(fpath string) (string, error) {
+	target, err := c.client.ReadLink(fpath)
+	return target, sftperr("readlink", fpath, err)
+}
+
+func (c *sftpclient) readdir(dir string) ([]os.FileInfo, error) {
+	fis, err := c.client.ReadDir(dir)
+	if err != nil {
+		return nil, sftperr("readdir", dir, err)
+	}
+	infos := make([]os.FileInfo, len(fis))
+	for i, fi := range fis {
+		infos[i] = fileinfo(path.Base(fi.Name()), fi)
+	}
+	return infos, nil
+}
+
+func (c *sftpclient) chmod(fpath string, mode os.FileMode) error {
+	return sftperr("chmod", fpath, c.client.Chmod(fpath, mode))
+}
+
+func (c *sftpclient) chown(fpath string, uid, gid uint32) error {
+	return sftperr("chown", fpath, c.client.Chown(fpath, int(uid), int(gid)))
+}
+
+func (c *sftpclient) remove(fpath string) error {
+	return sftperr("remove", fpath, c.client.Remove(fpath))
+}
+
+// rename replaces newpath like mv does. Plain SFTP renames refuse to, so this
+// needs OpenSSH's posix-rename extension.
+func (c *sftpclient) rename(oldpath, newpath string) error {
+	err := sftperr("rename", oldpath, c.client.PosixRename(oldpath, newpath))
+	var perr *os.PathError
+	if errors.As(err, &perr) {
+		// like os.Rename
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: perr.Err}
+	}
+	return err
+}
+
+func (c *sftpclient) canrename() bool {
+	_, ok := c.client.HasExtension("posix-rename@openssh.com")
+	return ok
+}
+
+func (c *sftpclient) open(fpath string) (io.ReadCloser, error) {
+	fh, err := c.client.Open(fpath)
+	if err != nil {
+		return nil, sftperr("open", fpath, err)
+	}
+	return fh, nil
+}
+
+func (c *sftpclient) create(fpath string) (io.WriteCloser, error) {
+	fh, err := c.client.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, sftperr("open", fpath, err)
+	}
+	return fh, nil
+}
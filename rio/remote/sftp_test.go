@@ -0,0 +1,158 @@
+package remote
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// pipes is one end of a pair of pipes, for a client and server to talk over
+type pipes struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (p pipes) Close() error {
+	return p.WriteCloser.Close()
+}
+
+// sftptest connects a client to an SFTP server serving the local filesystem.
+// Closing the returned writer hangs up on the client.
+func sftptest(t *testing.T) (*sftpclient, io.Closer) {
+	t.Helper()
+	toserver, fromclient := io.Pipe()
+	toclient, fromserver := io.Pipe()
+
+	server, err := sftp.NewServer(pipes{toserver, fromserver})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	c, err := sftpconnect(toclient, fromclient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, fromserver
+}
+
+func TestSFTP(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "khan_sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	c, hangup := sftptest(t)
+	defer c.close()
+
+	fpath := filepath.Join(tmp, "file")
+	w, err := c.create(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.chmod(fpath, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(buf) != "hello\n" {
+		t.Errorf("Read back %#v (%v)", string(buf), err)
+	}
+
+	fi, err := c.stat(fpath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Fname != fpath || fi.Fsize != 6 || fi.Fmode&0777 != 0640 || fi.Fisdir || fi.Fislink || fi.Fuid != uint32(os.Getuid()) {
+		t.Errorf("Stat got %+v", fi)
+	}
+
+	link := filepath.Join(tmp, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := c.stat(link, false); err != nil || !fi.Fislink {
+		t.Errorf("Lstat of a symlink got %+v (%v)", fi, err)
+	}
+	if fi, err := c.stat(link, true); err != nil || fi.Fislink || fi.Fsize != 6 {
+		t.Errorf("Stat of a symlink got %+v (%v)", fi, err)
+	}
+	if target, err := c.readlink(link); err != nil || target != "file" {
+		t.Errorf("Readlink got %#v (%v)", target, err)
+	}
+
+	// errors look like the os package's
+	_, err = c.stat(filepath.Join(tmp, "missing"), false)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ENOENT {
+		t.Errorf("Stat of a missing file got %#v", err)
+	}
+	if _, err := c.open(filepath.Join(tmp, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Open of a missing file got %v", err)
+	}
+
+	// posix-rename replaces what's there
+	other := filepath.Join(tmp, "other")
+	if err := ioutil.WriteFile(other, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !c.canrename() {
+		t.Fatal("No posix-rename")
+	}
+	if err := c.rename(fpath, other); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(other); err != nil || string(buf) != "hello\n" {
+		t.Errorf("Renamed over %#v (%v)", string(buf), err)
+	}
+
+	fis, err := c.readdir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if got := strings.Join(names, " "); got != "link other" && got != "other link" {
+		t.Errorf("Readdir got %v", names)
+	}
+
+	if err := c.remove(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(other); !os.IsNotExist(err) {
+		t.Errorf("Remove left it there (%v)", err)
+	}
+
+	hangup.Close()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		dead := c.dead
+		c.mu.Unlock()
+		if dead {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Client didn't notice the server hung up")
+		}
+	}
+}
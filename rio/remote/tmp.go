@@ -55,6 +55,8 @@ func (host *Host) Cleanup() error {
 	host.tmpdirmu.Lock()
 	defer host.tmpdirmu.Unlock()
 
+	defer host.closesftp()
+
 	if host.tmpdir == "" {
 		return nil
 	}
@@ -0,0 +1,13 @@
+package rio
+
+type Service struct {
+	Name    string
+	Enabled bool
+	Running bool
+	Masked  bool
+
+	// Static units are only started by other units, or are set up at
+	// boot some other way, so they can't be enabled or disabled. (systemd
+	// only)
+	Static bool
+}
@@ -23,3 +23,12 @@ func Chmod(host rio.Host, fpath string, perms os.FileMode) error {
 	}
 	return nil
 }
+
+// Lchown changes the owner of a symlink itself rather than what it points to
+func Lchown(host rio.Host, fpath string, uid uint32, gid uint32) error {
+	ctx := context.Background()
+	if err := host.Exec(rio.Command(ctx, "chown", "-h", fmt.Sprintf("%d:%d", uid, gid), fpath)); err != nil {
+		return err
+	}
+	return nil
+}
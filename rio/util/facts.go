@@ -0,0 +1,231 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"khan.rip/rio"
+)
+
+// GatherFacts finds out about a host with files and read only commands. It
+// carries on past anything that fails, since not every host has every
+// command, and leaves those facts blank.
+func GatherFacts(host rio.Host) (*rio.Facts, error) {
+	info, err := host.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &rio.Facts{}
+	osrelease(host, info, f)
+
+	ctx := context.Background()
+	if out, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "getconf", "_NPROCESSORS_ONLN")); err == nil {
+		f.CPUs, _ = strconv.Atoi(out)
+	}
+
+	switch info.OS {
+	case "linux":
+		linuxfacts(host, f)
+	case "openbsd":
+		openbsdfacts(host, f)
+	}
+	return f, nil
+}
+
+func osrelease(host rio.Host, info *rio.Info, f *rio.Facts) {
+	buf, err := host.ReadFile("/etc/os-release")
+	if err != nil {
+		buf, err = host.ReadFile("/usr/lib/os-release")
+	}
+	if err != nil {
+		// OpenBSD doesn't have one, but its release is its kernel's
+		f.Distro = info.OS
+		f.DistroFamily = info.OS
+		f.DistroVersion = info.Kernel
+		return
+	}
+
+	var like []string
+	scanner := bufio.NewScanner(strings.NewReader(string(buf)))
+	for scanner.Scan() {
+		eq := strings.IndexByte(scanner.Text(), '=')
+		if eq == -1 {
+			continue
+		}
+		key, value := scanner.Text()[:eq], scanner.Text()[eq+1:]
+		if uq, err := strconv.Unquote(value); err == nil {
+			value = uq
+		} else {
+			value = strings.Trim(value, "'")
+		}
+		switch key {
+		case "ID":
+			f.Distro = value
+		case "ID_LIKE":
+			like = strings.Fields(value)
+		case "VERSION_ID":
+			f.DistroVersion = value
+		case "PRETTY_NAME":
+			f.DistroName = value
+		}
+	}
+
+	f.DistroFamily = f.Distro
+	for _, id := range append([]string{f.Distro}, like...) {
+		family := ""
+		switch id {
+		case "debian", "ubuntu":
+			family = "debian"
+		case "rhel", "fedora", "centos":
+			family = "redhat"
+		case "alpine", "arch":
+			family = id
+		case "suse", "opensuse":
+			family = "suse"
+		}
+		if family != "" {
+			f.DistroFamily = family
+			break
+		}
+	}
+}
+
+func linuxfacts(host rio.Host, f *rio.Facts) {
+	ctx := context.Background()
+
+	if buf, err := host.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(buf), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+				kb, _ := strconv.ParseInt(fields[1], 10, 64)
+				f.Memory = kb * 1024
+			}
+		}
+	}
+
+	// 2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0\ ...
+	if out, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "ip", "-o", "addr", "show")); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+				continue
+			}
+			name := strings.SplitN(fields[1], "@", 2)[0]
+			addaddr(f, name, fields[3])
+		}
+	}
+
+	if buf, err := host.ReadFile("/proc/mounts"); err == nil {
+		unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+		for _, line := range strings.Split(string(buf), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			f.Mounts = append(f.Mounts, &rio.Mount{
+				Device: unescape.Replace(fields[0]),
+				Path:   unescape.Replace(fields[1]),
+				Type:   fields[2],
+			})
+		}
+	}
+
+	// systemd-detect-virt says "none" but fails on bare metal
+	if out, _ := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "systemd-detect-virt")); out != "" {
+		f.Virtualization = out
+	} else if _, err := host.Stat("/.dockerenv"); err == nil {
+		f.Virtualization = "docker"
+	} else if _, err := host.Stat("/run/.containerenv"); err == nil {
+		f.Virtualization = "podman"
+	} else if buf, err := host.ReadFile("/sys/class/dmi/id/product_name"); err == nil {
+		f.Virtualization = virtproduct(string(buf))
+	}
+}
+
+func openbsdfacts(host rio.Host, f *rio.Facts) {
+	ctx := context.Background()
+
+	if out, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "sysctl", "-n", "hw.physmem")); err == nil {
+		f.Memory, _ = strconv.ParseInt(out, 10, 64)
+	}
+
+	// em0: flags=8843<UP,BROADCAST,RUNNING,SIMPLEX,MULTICAST> mtu 1500
+	//         inet 10.0.0.5 netmask 0xffffff00 broadcast 10.0.0.255
+	//         inet6 fe80::1%em0 prefixlen 64 scopeid 0x1
+	if out, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "ifconfig", "-a")); err == nil {
+		name := ""
+		for _, line := range strings.Split(out, "\n") {
+			if line != "" && line[0] != ' ' && line[0] != '\t' {
+				name = strings.SplitN(line, ":", 2)[0]
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 4 || name == "" {
+				continue
+			}
+			switch {
+			case fields[0] == "inet" && fields[2] == "netmask":
+				mask, err := strconv.ParseUint(strings.TrimPrefix(fields[3], "0x"), 16, 32)
+				if err == nil {
+					addaddr(f, name, fields[1]+"/"+strconv.Itoa(bits.OnesCount32(uint32(mask))))
+				}
+			case fields[0] == "inet6" && fields[2] == "prefixlen":
+				addr := strings.SplitN(fields[1], "%", 2)[0]
+				addaddr(f, name, addr+"/"+fields[3])
+			}
+		}
+	}
+
+	// /dev/sd0a on / type ffs (local)
+	if out, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "mount")); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 5 || fields[1] != "on" || fields[3] != "type" {
+				continue
+			}
+			f.Mounts = append(f.Mounts, &rio.Mount{
+				Device: fields[0],
+				Path:   fields[2],
+				Type:   fields[4],
+			})
+		}
+	}
+
+	if out, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "sysctl", "-n", "hw.product")); err == nil {
+		f.Virtualization = virtproduct(out)
+	}
+}
+
+func addaddr(f *rio.Facts, name, addr string) {
+	for _, iface := range f.Interfaces {
+		if iface.Name == name {
+			iface.Addrs = append(iface.Addrs, addr)
+			return
+		}
+	}
+	f.Interfaces = append(f.Interfaces, &rio.Interface{Name: name, Addrs: []string{addr}})
+}
+
+// virtproduct guesses the virtualization from the hardware's product name
+func virtproduct(product string) string {
+	p := strings.ToLower(strings.TrimSpace(product))
+	switch {
+	case strings.Contains(p, "kvm"), strings.Contains(p, "qemu"), strings.Contains(p, "standard pc"):
+		return "kvm"
+	case strings.Contains(p, "vmware"):
+		return "vmware"
+	case strings.Contains(p, "virtualbox"):
+		return "oracle"
+	case strings.Contains(p, "hvm domu"):
+		return "xen"
+	case strings.Contains(p, "virtual machine"):
+		return "microsoft"
+	case p == "vmm":
+		return "vmm"
+	}
+	return "none"
+}
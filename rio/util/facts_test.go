@@ -0,0 +1,230 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"khan.rip/rio"
+)
+
+// factshost only has the files and command output it's given. Anything else
+// panics, since the embedded Host is nil.
+type factshost struct {
+	rio.Host
+	info  *rio.Info
+	files map[string]string
+	cmds  map[string]string
+}
+
+func (h *factshost) Info() (*rio.Info, error) {
+	return h.info, nil
+}
+
+func (h *factshost) ReadFile(fpath string) ([]byte, error) {
+	if s, ok := h.files[fpath]; ok {
+		return []byte(s), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (h *factshost) Stat(fpath string) (os.FileInfo, error) {
+	return nil, os.ErrNotExist
+}
+
+func (h *factshost) Exec(cmd *rio.Cmd) error {
+	out, ok := h.cmds[strings.Join(append([]string{cmd.Path}, cmd.Args...), " ")]
+	if !ok {
+		return errors.New("exit status 127")
+	}
+	_, err := io.WriteString(cmd.Stdout, out)
+	return err
+}
+
+func ifaces(f *rio.Facts) string {
+	var s []string
+	for _, iface := range f.Interfaces {
+		s = append(s, iface.Name+"="+strings.Join(iface.Addrs, ","))
+	}
+	return strings.Join(s, " ")
+}
+
+func TestOSRelease(t *testing.T) {
+	tests := []struct {
+		osrelease string
+		want      string // distro family version "name"
+	}{
+		{`NAME="Ubuntu"
+ID=ubuntu
+ID_LIKE=debian
+PRETTY_NAME="Ubuntu 22.04.3 LTS"
+VERSION_ID="22.04"
+`, `ubuntu debian 22.04 "Ubuntu 22.04.3 LTS"`},
+		{`ID=debian
+VERSION_ID="12"
+PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+`, `debian debian 12 "Debian GNU/Linux 12 (bookworm)"`},
+		{`ID="rocky"
+ID_LIKE="rhel centos fedora"
+VERSION_ID="9.3"
+`, `rocky redhat 9.3 ""`},
+		{`ID="opensuse-leap"
+ID_LIKE="suse opensuse"
+VERSION_ID="15.5"
+`, `opensuse-leap suse 15.5 ""`},
+		{`ID=alpine
+VERSION_ID=3.19.0
+PRETTY_NAME='Alpine Linux v3.19'
+`, `alpine alpine 3.19.0 "Alpine Linux v3.19"`},
+		{"ID=arch\nBUILD_ID=rolling\n# a comment\n\n", `arch arch  ""`},
+		{"ID=nixos\nVERSION_ID=\"23.11\"\n", `nixos nixos 23.11 ""`},
+		// no os-release at all
+		{"", `openbsd openbsd 7.4 ""`},
+	}
+	for _, test := range tests {
+		h := &factshost{files: map[string]string{}}
+		if test.osrelease != "" {
+			h.files["/etc/os-release"] = test.osrelease
+		}
+		f := &rio.Facts{}
+		osrelease(h, &rio.Info{OS: "openbsd", Kernel: "7.4"}, f)
+		got := fmt.Sprintf("%s %s %s %#v", f.Distro, f.DistroFamily, f.DistroVersion, f.DistroName)
+		if got != test.want {
+			t.Errorf("%#v: got %s, want %s", test.osrelease, got, test.want)
+		}
+	}
+
+	// the fallback
+	h := &factshost{files: map[string]string{"/usr/lib/os-release": "ID=fedora\n"}}
+	f := &rio.Facts{}
+	osrelease(h, &rio.Info{OS: "linux"}, f)
+	if f.Distro != "fedora" || f.DistroFamily != "redhat" {
+		t.Errorf("/usr/lib/os-release: got %s %s", f.Distro, f.DistroFamily)
+	}
+}
+
+func TestLinuxFacts(t *testing.T) {
+	tests := []struct {
+		ipaddr string
+		want   string
+	}{
+		{"", ""},
+		{`1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+1: lo    inet6 ::1/128 scope host \       valid_lft forever preferred_lft forever
+2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0\       valid_lft forever preferred_lft forever
+2: eth0    inet 10.0.0.6/24 brd 10.0.0.255 scope global secondary eth0\       valid_lft forever preferred_lft forever
+2: eth0    inet6 fe80::1/64 scope link \       valid_lft forever preferred_lft forever
+`, "lo=127.0.0.1/8,::1/128 eth0=10.0.0.5/24,10.0.0.6/24,fe80::1/64"},
+		// veths in containers are named after their peer
+		{`5: eth0@if6    inet 172.17.0.2/16 brd 172.17.255.255 scope global eth0\       valid_lft forever preferred_lft forever
+`, "eth0=172.17.0.2/16"},
+		// without -o, nothing lines up
+		{`2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500
+    link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff
+`, ""},
+	}
+	for _, test := range tests {
+		h := &factshost{
+			files: map[string]string{
+				"/proc/meminfo": "MemTotal:        2048000 kB\nMemFree:          512000 kB\n",
+				"/proc/mounts":  "/dev/vda1 / ext4 rw,relatime 0 0\n/dev/vdb1 /mnt/my\\040disk xfs rw 0 0\n",
+			},
+			cmds: map[string]string{
+				"ip -o addr show":     test.ipaddr,
+				"systemd-detect-virt": "kvm\n",
+			},
+		}
+		f := &rio.Facts{}
+		linuxfacts(h, f)
+		if got := ifaces(f); got != test.want {
+			t.Errorf("%#v: got %s, want %s", test.ipaddr, got, test.want)
+		}
+		if f.Memory != 2048000*1024 {
+			t.Errorf("Memory is %d", f.Memory)
+		}
+		if len(f.Mounts) != 2 || f.Mounts[1].Path != "/mnt/my disk" || f.Mounts[1].Type != "xfs" {
+			t.Errorf("Mounts are %v", f.Mounts)
+		}
+		if f.Virtualization != "kvm" {
+			t.Errorf("Virtualization is %#v", f.Virtualization)
+		}
+	}
+}
+
+func TestOpenBSDFacts(t *testing.T) {
+	tests := []struct {
+		ifconfig string
+		want     string
+	}{
+		{"", ""},
+		{`lo0: flags=8049<UP,LOOPBACK,RUNNING,MULTICAST> mtu 32768
+	index 4 priority 0 llprio 3
+	groups: lo
+	inet6 ::1 prefixlen 128
+	inet6 fe80::1%lo0 prefixlen 64 scopeid 0x4
+	inet 127.0.0.1 netmask 0xff000000
+em0: flags=8843<UP,BROADCAST,RUNNING,SIMPLEX,MULTICAST> mtu 1500
+	lladdr 52:54:00:12:34:56
+	index 1 priority 0 llprio 3
+	media: Ethernet autoselect (1000baseT full-duplex)
+	status: active
+	inet 10.0.0.5 netmask 0xffffff00 broadcast 10.0.0.255
+	inet 10.0.1.5 netmask 0xfffffc00 broadcast 10.0.3.255
+enc0: flags=0<>
+	index 2 priority 0 llprio 3
+	status: active
+pflog0: flags=141<UP,RUNNING,PROMISC> mtu 33136
+`, "lo0=::1/128,fe80::1/64,127.0.0.1/8 em0=10.0.0.5/24,10.0.1.5/22"},
+		// a netmask that isn't hex is skipped
+		{`vio0: flags=8843<UP,BROADCAST,RUNNING,SIMPLEX,MULTICAST> mtu 1500
+	inet 192.168.1.2 netmask 255.255.255.0
+	inet6 2001:db8::2 prefixlen 64
+`, "vio0=2001:db8::2/64"},
+	}
+	for _, test := range tests {
+		h := &factshost{
+			cmds: map[string]string{
+				"ifconfig -a":          test.ifconfig,
+				"sysctl -n hw.physmem": "4278124544\n",
+				"sysctl -n hw.product": "VMM\n",
+				"mount":                "/dev/sd0a on / type ffs (local)\n/dev/sd0e on /home type ffs (local, nodev, nosuid)\n",
+			},
+		}
+		f := &rio.Facts{}
+		openbsdfacts(h, f)
+		if got := ifaces(f); got != test.want {
+			t.Errorf("%#v: got %s, want %s", test.ifconfig, got, test.want)
+		}
+		if f.Memory != 4278124544 {
+			t.Errorf("Memory is %d", f.Memory)
+		}
+		if len(f.Mounts) != 2 || f.Mounts[1].Path != "/home" || f.Mounts[1].Type != "ffs" {
+			t.Errorf("Mounts are %v", f.Mounts)
+		}
+		if f.Virtualization != "vmm" {
+			t.Errorf("Virtualization is %#v", f.Virtualization)
+		}
+	}
+}
+
+func TestVirtProduct(t *testing.T) {
+	tests := map[string]string{
+		"KVM\n":                          "kvm",
+		"Standard PC (Q35 + ICH9, 2009)": "kvm",
+		"VMware Virtual Platform":        "vmware",
+		"VirtualBox":                     "oracle",
+		"HVM domU":                       "xen",
+		"Virtual Machine":                "microsoft",
+		"VMM":                            "vmm",
+		"PowerEdge R640":                 "none",
+		"":                               "none",
+	}
+	for product, want := range tests {
+		if got := virtproduct(product); got != want {
+			t.Errorf("%#v: got %s, want %s", product, got, want)
+		}
+	}
+}
@@ -1,7 +1,13 @@
 package util
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
 
 	"khan.rip/rio"
 )
@@ -30,10 +36,57 @@ func Rename(host rio.Host, oldpath, newpath string) error {
 	return nil
 }
 
-func Mkdir(host rio.Host, fpath string) error {
+func Mkdir(host rio.Host, fpath string, mode os.FileMode) error {
 	ctx := context.Background()
-	if err := host.Exec(rio.Command(ctx, "mkdir", fpath)); err != nil {
+	if err := host.Exec(rio.Command(ctx, "mkdir", "-m", fmt.Sprintf("%o", mode), fpath)); err != nil {
 		return err
 	}
 	return nil
 }
+
+// ReadDir lists a directory by running stat on everything in it. Like the
+// stat command itself, symlinks are not followed.
+func ReadDir(host rio.Host, dir string) ([]os.FileInfo, error) {
+	info, err := host.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	statcmd := "-t"
+	if info.OS == "openbsd" {
+		statcmd = "-r"
+	}
+
+	ctx := context.Background()
+	cmd := rio.ReadOnlyCommand(ctx, "find", dir, "-mindepth", "1", "-maxdepth", "1", "-exec", "stat", statcmd, "{}", "+")
+
+	outbuf := &bytes.Buffer{}
+	errbuf := &bytes.Buffer{}
+	cmd.Stdout = outbuf
+	cmd.Stderr = errbuf
+
+	if err := host.Exec(cmd); err != nil {
+		e := strings.TrimSpace(errbuf.String())
+		if strings.HasSuffix(e, "No such file or directory") {
+			return nil, &os.PathError{Op: "readdir", Path: dir, Err: syscall.ENOENT}
+		}
+		if strings.HasSuffix(e, "Not a directory") {
+			return nil, &os.PathError{Op: "readdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil, &rio.CmdErr{Cmd: cmd, StdErr: e, ExecErr: err}
+	}
+
+	var infos []os.FileInfo
+	for _, line := range strings.Split(outbuf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		fi, err := ParseStat(info.OS, dir, line, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		fi.Fname = path.Base(fi.Fname)
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"khan.rip/rio"
+)
+
+// Hash runs sha256sum (sha256 on OpenBSD) on a file, so only the hash has to
+// come back from the host
+func Hash(host rio.Host, fpath string) (string, error) {
+	info, err := host.Info()
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	var cmd *rio.Cmd
+	if info.OS == "openbsd" {
+		cmd = rio.ReadOnlyCommand(ctx, "sha256", "-q", fpath)
+	} else {
+		cmd = rio.ReadOnlyCommand(ctx, "sha256sum", "--", fpath)
+	}
+
+	buf := &bytes.Buffer{}
+	cmd.Stdout = buf
+
+	if err := host.Exec(cmd); err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(buf.String())
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("Cannot parse %s output: %#v", cmd.Path, buf.String())
+	}
+	return fields[0], nil
+}
+
+// HashBytes hashes content the same way Hash does
+func HashBytes(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// HashReader hashes everything in r the same way Hash does
+func HashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
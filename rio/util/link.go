@@ -0,0 +1,79 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"khan.rip/rio"
+)
+
+func Symlink(host rio.Host, target, fpath string) error {
+	ctx := context.Background()
+	if err := host.Exec(rio.Command(ctx, "ln", "-s", target, fpath)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func Link(host rio.Host, target, fpath string) error {
+	ctx := context.Background()
+	if err := host.Exec(rio.Command(ctx, "ln", target, fpath)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Readlink asks stat for the target of a symlink. On Linux that's %N, which
+// prints "fpath -> target" (literally, if quoting is turned off), and on
+// OpenBSD it's %Y, which prints just the target.
+func Readlink(host rio.Host, fpath string) (string, error) {
+	info, err := host.Info()
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+
+	var cmd *rio.Cmd
+	switch info.OS {
+	case "linux":
+		cmd = rio.ReadOnlyCommand(ctx, "env", "QUOTING_STYLE=literal", "stat", "-c", "%N", fpath)
+	case "openbsd":
+		cmd = rio.ReadOnlyCommand(ctx, "stat", "-f", "%Y", fpath)
+	default:
+		return "", fmt.Errorf("Cannot read links: Unhandled OS %#v", info.OS)
+	}
+
+	outbuf := &bytes.Buffer{}
+	errbuf := &bytes.Buffer{}
+	cmd.Stdout = outbuf
+	cmd.Stderr = errbuf
+
+	if err := host.Exec(cmd); err != nil {
+		e := strings.TrimSpace(errbuf.String())
+		if strings.HasSuffix(e, "No such file or directory") {
+			return "", &os.PathError{Op: "readlink", Path: fpath, Err: syscall.ENOENT}
+		}
+		return "", &rio.CmdErr{Cmd: cmd, StdErr: e, ExecErr: err}
+	}
+
+	out := strings.TrimSuffix(outbuf.String(), "\n")
+
+	if info.OS == "linux" {
+		prefix := fpath + " -> "
+		if !strings.HasPrefix(out, prefix) {
+			// not a symlink; stat printed only the name
+			return "", &os.PathError{Op: "readlink", Path: fpath, Err: syscall.EINVAL}
+		}
+		return out[len(prefix):], nil
+	}
+
+	if out == "" {
+		return "", &os.PathError{Op: "readlink", Path: fpath, Err: syscall.EINVAL}
+	}
+	return out, nil
+}
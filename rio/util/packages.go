@@ -0,0 +1,237 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"khan.rip/rio"
+)
+
+// PackageManager figures out which package tool a host uses. Linux
+// distributions are told apart by their release files.
+func PackageManager(host rio.Host) (string, error) {
+	info, err := host.Info()
+	if err != nil {
+		return "", err
+	}
+
+	switch info.OS {
+	case "openbsd":
+		return "pkg_add", nil
+	case "linux":
+		releases := []struct {
+			file    string
+			manager string
+		}{
+			{"/etc/debian_version", "apt"},
+			{"/etc/redhat-release", "dnf"},
+			{"/etc/fedora-release", "dnf"},
+			{"/etc/alpine-release", "apk"},
+		}
+		for _, r := range releases {
+			if _, err := host.Stat(r.file); err == nil {
+				return r.manager, nil
+			}
+		}
+		return "", fmt.Errorf("Cannot determine package manager for Linux distribution on %s", host)
+	default:
+		return "", fmt.Errorf("Package management not supported for OS %#v", info.OS)
+	}
+}
+
+func LoadPackages(host rio.Host, names []string) (map[string]*rio.Package, error) {
+	manager, err := PackageManager(host)
+	if err != nil {
+		return nil, err
+	}
+
+	r := map[string]*rio.Package{}
+	if len(names) == 0 {
+		return r, nil
+	}
+
+	ctx := context.Background()
+	outbuf := &bytes.Buffer{}
+	errbuf := &bytes.Buffer{}
+
+	switch manager {
+	case "apt":
+		// dpkg-query exits non-zero if any of the names are unknown, but still
+		// reports on the ones it does know about.
+		cmd := rio.ReadOnlyCommand(ctx, "dpkg-query", append([]string{"-W", "-f", "${Package}\t${db:Status-Abbrev}\t${Version}\n"}, names...)...)
+		cmd.Stdout = outbuf
+		cmd.Stderr = errbuf
+		if err := host.Exec(cmd); err != nil && !strings.Contains(errbuf.String(), "no packages found") {
+			return nil, &rio.CmdErr{Cmd: cmd, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+		}
+		for _, row := range splitTabs(outbuf.String()) {
+			if len(row) < 3 || !strings.HasPrefix(row[1], "ii") {
+				continue
+			}
+			r[row[0]] = &rio.Package{Name: row[0], Version: row[2]}
+		}
+
+	case "dnf":
+		// rpm exits with the number of packages not installed
+		cmd := rio.ReadOnlyCommand(ctx, "rpm", append([]string{"-q", "--qf", "%{NAME}\t%{VERSION}-%{RELEASE}\n"}, names...)...)
+		cmd.Stdout = outbuf
+		cmd.Stderr = errbuf
+		if err := host.Exec(cmd); err != nil && outbuf.Len() == 0 {
+			return nil, &rio.CmdErr{Cmd: cmd, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+		}
+		for _, row := range splitTabs(outbuf.String()) {
+			if len(row) < 2 {
+				continue
+			}
+			r[row[0]] = &rio.Package{Name: row[0], Version: row[1]}
+		}
+
+	case "apk":
+		fh, err := host.Open("/lib/apk/db/installed")
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+
+		want := map[string]bool{}
+		for _, n := range names {
+			want[n] = true
+		}
+
+		var name string
+		bs := bufio.NewScanner(fh)
+		for bs.Scan() {
+			line := bs.Text()
+			if strings.HasPrefix(line, "P:") {
+				name = line[2:]
+			} else if strings.HasPrefix(line, "V:") && want[name] {
+				r[name] = &rio.Package{Name: name, Version: line[2:]}
+			}
+		}
+		if err := bs.Err(); err != nil {
+			return nil, err
+		}
+
+	case "pkg_add":
+		cmd := rio.ReadOnlyCommand(ctx, "pkg_info", "-q")
+		cmd.Stdout = outbuf
+		if err := host.Exec(cmd); err != nil {
+			return nil, err
+		}
+
+		want := map[string]bool{}
+		for _, n := range names {
+			want[n] = true
+		}
+
+		for _, line := range strings.Split(outbuf.String(), "\n") {
+			name, version := splitOpenBSDPackage(strings.TrimSpace(line))
+			if want[name] {
+				r[name] = &rio.Package{Name: name, Version: version}
+			}
+		}
+	}
+
+	return r, nil
+}
+
+func InstallPackages(host rio.Host, pkgs []*rio.Package) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	manager, err := PackageManager(host)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var args []string
+	for _, p := range pkgs {
+		spec := p.Name
+		if p.Version != "" {
+			switch manager {
+			case "apt", "apk":
+				spec += "=" + p.Version
+			default:
+				spec += "-" + p.Version
+			}
+		}
+		args = append(args, spec)
+	}
+
+	var cmd *rio.Cmd
+	switch manager {
+	case "apt":
+		// Setenv over SSH is usually refused by sshd, so use env(1)
+		cmd = rio.Command(ctx, "env", append([]string{"DEBIAN_FRONTEND=noninteractive", "apt-get", "install", "-y", "-q"}, args...)...)
+	case "dnf":
+		cmd = rio.Command(ctx, "dnf", append([]string{"install", "-y"}, args...)...)
+	case "apk":
+		cmd = rio.Command(ctx, "apk", append([]string{"add"}, args...)...)
+	case "pkg_add":
+		cmd = rio.Command(ctx, "pkg_add", append([]string{"-I"}, args...)...)
+	}
+
+	if err := host.Exec(cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func RemovePackages(host rio.Host, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	manager, err := PackageManager(host)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var cmd *rio.Cmd
+	switch manager {
+	case "apt":
+		cmd = rio.Command(ctx, "env", append([]string{"DEBIAN_FRONTEND=noninteractive", "apt-get", "remove", "-y", "-q"}, names...)...)
+	case "dnf":
+		cmd = rio.Command(ctx, "dnf", append([]string{"remove", "-y"}, names...)...)
+	case "apk":
+		cmd = rio.Command(ctx, "apk", append([]string{"del"}, names...)...)
+	case "pkg_add":
+		cmd = rio.Command(ctx, "pkg_delete", names...)
+	}
+
+	if err := host.Exec(cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func splitTabs(s string) [][]string {
+	var rows [][]string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+	return rows
+}
+
+// OpenBSD package names look like "curl-7.73.0" or "vim-8.2.1-no_x11". The
+// version starts at the first dash followed by a digit.
+func splitOpenBSDPackage(s string) (string, string) {
+	for i := 0; i < len(s)-1; i++ {
+		if s[i] == '-' && s[i+1] >= '0' && s[i+1] <= '9' {
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
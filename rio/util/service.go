@@ -0,0 +1,211 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"khan.rip/rio"
+)
+
+func LoadService(host rio.Host, name string) (*rio.Service, error) {
+	info, err := host.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	switch info.OS {
+	case "linux":
+		return loadSystemdService(host, name)
+	case "openbsd":
+		return loadRcctlService(host, name)
+	default:
+		return nil, fmt.Errorf("Service management not supported for OS %#v", info.OS)
+	}
+}
+
+func UpdateService(host rio.Host, old *rio.Service, service *rio.Service) error {
+	info, err := host.Info()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch info.OS {
+	case "linux":
+		var cmds [][]string
+		if service.Masked && !old.Masked {
+			if old.Running {
+				cmds = append(cmds, []string{"stop", service.Name})
+			}
+			cmds = append(cmds, []string{"mask", service.Name})
+		} else if !service.Masked {
+			if old.Masked {
+				cmds = append(cmds, []string{"unmask", service.Name})
+			}
+			if service.Enabled != old.Enabled && !old.Static {
+				if service.Enabled {
+					cmds = append(cmds, []string{"enable", service.Name})
+				} else {
+					cmds = append(cmds, []string{"disable", service.Name})
+				}
+			}
+			if service.Running != old.Running {
+				if service.Running {
+					cmds = append(cmds, []string{"start", service.Name})
+				} else {
+					cmds = append(cmds, []string{"stop", service.Name})
+				}
+			}
+		}
+		for _, args := range cmds {
+			if err := host.Exec(rio.Command(ctx, "systemctl", args...)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "openbsd":
+		if service.Masked {
+			return fmt.Errorf("Services cannot be masked on OS %#v", info.OS)
+		}
+		var cmds [][]string
+		if service.Enabled != old.Enabled {
+			if service.Enabled {
+				cmds = append(cmds, []string{"enable", service.Name})
+			} else {
+				cmds = append(cmds, []string{"disable", service.Name})
+			}
+		}
+		if service.Running != old.Running {
+			if service.Running {
+				cmds = append(cmds, []string{"start", service.Name})
+			} else {
+				cmds = append(cmds, []string{"stop", service.Name})
+			}
+		}
+		for _, args := range cmds {
+			if err := host.Exec(rio.Command(ctx, "rcctl", args...)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("Service management not supported for OS %#v", info.OS)
+	}
+}
+
+func RestartService(host rio.Host, name string) error {
+	return serviceCommand(host, "restart", name)
+}
+
+func ReloadService(host rio.Host, name string) error {
+	return serviceCommand(host, "reload", name)
+}
+
+func serviceCommand(host rio.Host, action, name string) error {
+	info, err := host.Info()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var cmd *rio.Cmd
+	switch info.OS {
+	case "linux":
+		cmd = rio.Command(ctx, "systemctl", action, name)
+	case "openbsd":
+		cmd = rio.Command(ctx, "rcctl", action, name)
+	default:
+		return fmt.Errorf("Service management not supported for OS %#v", info.OS)
+	}
+
+	if err := host.Exec(cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func loadSystemdService(host rio.Host, name string) (*rio.Service, error) {
+	ctx := context.Background()
+
+	// Both of these exit non-zero for perfectly normal answers like
+	// "disabled" or "inactive", so go by what they print instead.
+	enabled, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "systemctl", "is-enabled", name))
+	if err != nil && enabled == "" {
+		if strings.Contains(err.Error(), "No such file or directory") || strings.Contains(err.Error(), "not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	active, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "systemctl", "is-active", name))
+	if err != nil && active == "" {
+		return nil, err
+	}
+
+	service := &rio.Service{
+		Name: name,
+	}
+
+	switch enabled {
+	case "enabled", "enabled-runtime", "alias":
+		service.Enabled = true
+	case "static", "indirect", "generated":
+		service.Static = true
+	case "masked", "masked-runtime":
+		service.Masked = true
+	}
+
+	switch active {
+	case "active", "activating", "reloading":
+		service.Running = true
+	}
+
+	return service, nil
+}
+
+func loadRcctlService(host rio.Host, name string) (*rio.Service, error) {
+	ctx := context.Background()
+
+	all, err := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "rcctl", "ls", "all"))
+	if err != nil {
+		return nil, err
+	}
+	if !containsLine(all, name) {
+		return nil, nil
+	}
+
+	// rcctl ls exits 1 if the list is empty
+	on, _ := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "rcctl", "ls", "on"))
+	started, _ := readOnlyOutput(host, rio.ReadOnlyCommand(ctx, "rcctl", "ls", "started"))
+
+	return &rio.Service{
+		Name:    name,
+		Enabled: containsLine(on, name),
+		Running: containsLine(started, name),
+	}, nil
+}
+
+func readOnlyOutput(host rio.Host, cmd *rio.Cmd) (string, error) {
+	outbuf := &bytes.Buffer{}
+	errbuf := &bytes.Buffer{}
+	cmd.Stdout = outbuf
+	cmd.Stderr = errbuf
+	if err := host.Exec(cmd); err != nil {
+		return strings.TrimSpace(outbuf.String()), &rio.CmdErr{Cmd: cmd, StdErr: strings.TrimSpace(errbuf.String()), ExecErr: err}
+	}
+	return strings.TrimSpace(outbuf.String()), nil
+}
+
+func containsLine(s, line string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
@@ -18,6 +18,7 @@ const (
 	S_ifmt     = 0170000 // type of file mask
 	S_ifdir    = 0040000 // directory
 	S_ifreg    = 0100000 // regular
+	S_iflnk    = 0120000 // symbolic link
 	S_justmode = 0777    // this is me ignoring things like suid for now
 )
 
@@ -27,9 +28,17 @@ type FileInfo struct {
 	Fmode    os.FileMode
 	Fmodtime time.Time
 	Fisdir   bool
+	Fislink  bool
+
+	// Flink is the target of a symlink. It is only filled in by Lstat.
+	Flink string
 
 	Fuid uint32
 	Fgid uint32
+
+	// Device and inode, for telling whether two paths are hard linked
+	Fdev uint64
+	Fino uint64
 }
 
 func (fi *FileInfo) Name() string {
@@ -47,6 +56,9 @@ func (fi *FileInfo) ModTime() time.Time {
 func (fi *FileInfo) IsDir() bool {
 	return fi.Fisdir
 }
+func (fi *FileInfo) IsLink() bool {
+	return fi.Fislink
+}
 func (fi *FileInfo) Sys() interface{} {
 	return fi
 }
@@ -58,8 +70,8 @@ func (fi *FileInfo) Gid() uint32 {
 }
 
 func (fi *FileInfo) String() string {
-	return fmt.Sprintf("%T name %#v size %d mode %o mtime %v isdir %v uid %d gid %d",
-		fi, fi.Fname, fi.Fsize, fi.Fmode, fi.Fmodtime, fi.Fisdir, fi.Fuid, fi.Fgid)
+	return fmt.Sprintf("%T name %#v size %d mode %o mtime %v isdir %v islink %v link %#v uid %d gid %d dev %d ino %d",
+		fi, fi.Fname, fi.Fsize, fi.Fmode, fi.Fmodtime, fi.Fisdir, fi.Fislink, fi.Flink, fi.Fuid, fi.Fgid, fi.Fdev, fi.Fino)
 }
 
 // 10 17547654 drwxr-xr-x 2 joel joel 70100322 512 "Dec 18 19:52:23 2020" "Dec 18 19:52:23 2020" "Dec 18 19:52:23 2020" 32768 8 0 Hi There
@@ -68,13 +80,15 @@ func (fi *FileInfo) String() string {
 
 // st_dev, st_ino, st_mode, st_nlink, st_uid, st_gid, st_rdev, st_size, st_atime, st_mtime, st_ctime, st_blksize, st_blocks, st_flags, file name
 
-// 1 mode (octal)
-// 2 uid
-// 3 gid
-// 4 size
-// 5 mtime
-// 6 name
-var openbsdStatRe = regexp.MustCompile(`^\d+ \d+ (\d+) \d+ (\d+) (\d+) \d+ (\d+) \d+ (\d+) \d+ \d+ \d+ \d+ (.*)$`)
+// 1 device
+// 2 inode
+// 3 mode (octal)
+// 4 uid
+// 5 gid
+// 6 size
+// 7 mtime
+// 8 name
+var openbsdStatRe = regexp.MustCompile(`^(\d+) (\d+) (\d+) \d+ (\d+) (\d+) \d+ (\d+) \d+ (\d+) \d+ \d+ \d+ \d+ (.*)$`)
 
 //  File: file_heyo
 //  Size: 2         	Blocks: 8          IO Block: 4096   regular file
@@ -93,8 +107,10 @@ var openbsdStatRe = regexp.MustCompile(`^\d+ \d+ (\d+) \d+ (\d+) (\d+) \d+ (\d+)
 // 3 mode (hex)
 // 4 uid
 // 5 gid
-// 6 mtime
-var linuxStatRe = regexp.MustCompile(`^(.*) (\d+) \d+ ([a-fA-F0-9]+) (\d+) (\d+) [a-fA-F0-9]+ \d+ \d+ [a-fA-F0-9]+ [a-fA-F0-9]+ (\d+) \d+ \d+ \d+ \d+$`)
+// 6 device (hex)
+// 7 inode
+// 8 mtime
+var linuxStatRe = regexp.MustCompile(`^(.*) (\d+) \d+ ([a-fA-F0-9]+) (\d+) (\d+) ([a-fA-F0-9]+) (\d+) \d+ [a-fA-F0-9]+ [a-fA-F0-9]+ \d+ (\d+) \d+ \d+ \d+$`)
 
 // /tmp/file_duck 9 8 81a4 1000 1000 2d 20963 1 0 0 1608356438 1608356438 1608356438 0 4096
 
@@ -121,33 +137,42 @@ func ParseStat(osname, fpath, stdout, stderr string, execerr error) (*FileInfo,
 		if match == nil {
 			return nil, fmt.Errorf("Cannot parse OS %#v stat output: %#v", osname, stdout)
 		}
-		fi.Fname = match[6]
-		if fi.Fsize, err = strconv.ParseInt(match[4], 10, 64); err != nil {
+		fi.Fname = match[8]
+		if fi.Fsize, err = strconv.ParseInt(match[6], 10, 64); err != nil {
 			return nil, err
 		}
-		mode, err := strconv.ParseUint(match[1], 8, 32)
+		mode, err := strconv.ParseUint(match[3], 8, 32)
 		if err != nil {
 			return nil, err
 		}
 		fi.Fmode = os.FileMode(mode)
-		uid, err := strconv.ParseUint(match[2], 10, 32)
+		uid, err := strconv.ParseUint(match[4], 10, 32)
 		if err != nil {
 			return nil, err
 		}
 		fi.Fuid = uint32(uid)
-		gid, err := strconv.ParseUint(match[3], 10, 32)
+		gid, err := strconv.ParseUint(match[5], 10, 32)
 		if err != nil {
 			return nil, err
 		}
 		fi.Fgid = uint32(gid)
-		mtime, err := strconv.ParseInt(match[5], 10, 64)
+		mtime, err := strconv.ParseInt(match[7], 10, 64)
 		if err != nil {
 			return nil, err
 		}
 		fi.Fmodtime = time.Unix(mtime, 0)
+		if fi.Fdev, err = strconv.ParseUint(match[1], 10, 64); err != nil {
+			return nil, err
+		}
+		if fi.Fino, err = strconv.ParseUint(match[2], 10, 64); err != nil {
+			return nil, err
+		}
 
-		if fi.Fmode&S_ifmt == S_ifdir {
+		switch fi.Fmode & S_ifmt {
+		case S_ifdir:
 			fi.Fisdir = true
+		case S_iflnk:
+			fi.Fislink = true
 		}
 		return fi, nil
 
@@ -175,14 +200,23 @@ func ParseStat(osname, fpath, stdout, stderr string, execerr error) (*FileInfo,
 			return nil, err
 		}
 		fi.Fgid = uint32(gid)
-		mtime, err := strconv.ParseInt(match[6], 10, 64)
+		mtime, err := strconv.ParseInt(match[8], 10, 64)
 		if err != nil {
 			return nil, err
 		}
 		fi.Fmodtime = time.Unix(mtime, 0)
+		if fi.Fdev, err = strconv.ParseUint(match[6], 16, 64); err != nil {
+			return nil, err
+		}
+		if fi.Fino, err = strconv.ParseUint(match[7], 10, 64); err != nil {
+			return nil, err
+		}
 
-		if fi.Fmode&S_ifmt == S_ifdir {
+		switch fi.Fmode & S_ifmt {
+		case S_ifdir:
 			fi.Fisdir = true
+		case S_iflnk:
+			fi.Fislink = true
 		}
 		return fi, nil
 
@@ -206,12 +240,15 @@ func ConvertStat(f os.FileInfo) (*FileInfo, error) {
 		Fmode:    f.Mode(),
 		Fmodtime: f.ModTime(),
 		Fisdir:   f.IsDir(),
+		Fislink:  f.Mode()&os.ModeSymlink != 0,
 	}
 
 	switch st := sys.(type) {
 	case *syscall.Stat_t:
 		info.Fuid = st.Uid
 		info.Fgid = st.Gid
+		info.Fdev = uint64(st.Dev)
+		info.Fino = uint64(st.Ino)
 	default:
 		return nil, fmt.Errorf("Unhandled stat type %T", sys)
 	}
@@ -1,17 +1,19 @@
 package khan
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/desops/sshpool"
-
 	"github.com/flosch/pongo2/v4"
 )
 
@@ -25,10 +27,18 @@ type Run struct {
 	Diff    bool
 	Verbose bool
 
+	// Selection picks part of the configuration to apply (see select.go)
+	Selection Selection
+
+	// Pool, if set, is used for every remote host that isn't behind a jump
+	// host, instead of each getting its own. Its ClientConfig has to check
+	// host keys and authenticate by itself.
 	Pool  *sshpool.Pool
 	Hosts []*Host
 
-	assetfn func(string) (io.ReadCloser, error)
+	assetfn     func(string) (io.ReadCloser, error)
+	assetdirfn  func(string) ([]string, error)
+	assetinfofn func(string) (os.FileInfo, error)
 
 	sourceprefix string
 	describe     string
@@ -36,11 +46,17 @@ type Run struct {
 
 	out *outputter
 
-	pongomu            sync.Mutex
-	pongopackedset     *pongo2.TemplateSet
-	pongopackedcontext pongo2.Context
-	pongocachefiles    map[string]*pongo2.Template
-	pongocachestrings  map[string]*pongo2.Template
+	// agentout is set when running as a push agent, for sending results
+	// back to the controller
+	agentout io.Writer
+
+	// pongomu is for the template caches. Templates run with a context
+	// for each host (see hostcontext).
+	pongomu           sync.Mutex
+	pongopackedset    *pongo2.TemplateSet
+	pongocachefiles   map[string]*pongo2.Template
+	pongocachestrings map[string]*pongo2.Template
+	pongocachewhen    map[string]*pongo2.Template
 
 	itemsmu   sync.Mutex
 	initdone  bool
@@ -50,7 +66,9 @@ type Run struct {
 	nextid    int
 	fences    map[string]*sync.Mutex
 	befores   map[string][]string
+	notifies  map[string][]string
 	errors    map[string]error
+	changed   map[string]bool
 }
 
 type inititem struct {
@@ -80,7 +98,8 @@ func (r *Run) Add(add ...Item) error {
 	return r.AddFromSource(source, add...)
 }
 
-// AddFromSource is like Add but with explicit source code path
+// AddFromSource is like Add but with explicit source code path. Items only go
+// on the hosts they target (see Meta.Hosts).
 func (r *Run) AddFromSource(source string, add ...Item) error {
 	r.itemsmu.Lock()
 	defer r.itemsmu.Unlock()
@@ -100,6 +119,9 @@ func (r *Run) AddFromSource(source string, add ...Item) error {
 			return fmt.Errorf("Item already added: %v", item)
 		}
 		for _, host := range r.Hosts {
+			if host.push || !host.targets(item) {
+				continue
+			}
 			c := item.Clone()
 			if err := r.addHostItem(host, source, c); err != nil {
 				return err
@@ -131,7 +153,7 @@ func (r *Run) addHostItem(host *Host, source string, item Item) error {
 	r.items = append(r.items, item)
 
 	// create fences for things item provides
-	for _, p := range item.Provides() {
+	for _, p := range provides(item) {
 		p = host.Key() + "-" + p
 		if _, ok := r.fences[p]; ok {
 			return im.WrapError(r, fmt.Errorf("Duplicate provider of %#v", p))
@@ -143,11 +165,98 @@ func (r *Run) addHostItem(host *Host, source string, item Item) error {
 			bef = host.Key() + "-" + bef
 			r.befores[bef] = append(r.befores[bef], p)
 		}
+
+		if m, ok := item.(metaer); ok {
+			for _, n := range m.meta().Notify {
+				n = host.Key() + "-" + n
+				r.notifies[n] = append(r.notifies[n], p)
+			}
+		}
 	}
 
 	return nil
 }
 
+// provides lists what item provides, for fences and notifications. An item
+// that provides nothing but notifies something gets a key of its own, so
+// there is still something for the notified items to wait on.
+func provides(item Item) []string {
+	p := item.Provides()
+	if m, ok := item.(metaer); ok && len(p) == 0 && len(m.meta().Notify) > 0 {
+		p = []string{"item:" + strconv.Itoa(item.ID())}
+	}
+	return p
+}
+
+// afters lists what item has to be applied after: its own After, and the
+// Requires it was given
+func afters(item Item) []string {
+	a := item.After()
+	if m, ok := item.(metaer); ok && len(m.meta().Requires) > 0 {
+		a = append(append([]string{}, a...), m.meta().Requires...)
+	}
+	return a
+}
+
+// notifiers lists the (host prefixed) keys of items which will notify item
+// when they change. Always have itemsmu locked before calling this.
+func (r *Run) notifiers(host *Host, item Item) []string {
+	var n []string
+	if m, ok := item.(metaer); ok {
+		for _, s := range m.meta().Subscribe {
+			n = append(n, host.Key()+"-"+s)
+		}
+	}
+	for _, p := range item.Provides() {
+		n = append(n, r.notifies[host.Key()+"-"+p]...)
+	}
+	return n
+}
+
+// waitlist lists the (host prefixed) keys of items which have to finish
+// before item can start. Always have itemsmu locked before calling this.
+func (r *Run) waitlist(host *Host, item Item) []string {
+	var waitlist []string
+	for _, after := range afters(item) {
+		waitlist = append(waitlist, host.Key()+"-"+after)
+	}
+	for _, pr := range item.Provides() {
+		for _, bef := range r.befores[host.Key()+"-"+pr] {
+			waitlist = append(waitlist, bef)
+		}
+	}
+	return append(waitlist, r.notifiers(host, item)...)
+}
+
+// editor is an item that edits part of a file, rather than providing the
+// whole thing
+type editor interface {
+	editpath() string
+}
+
+// managedpaths returns every path with an item managing (or editing) it on
+// host
+func (r *Run) managedpaths(host *Host) map[string]bool {
+	r.itemsmu.Lock()
+	defer r.itemsmu.Unlock()
+
+	paths := map[string]bool{}
+	for _, item := range r.items {
+		if r.meta[item.ID()].host != host {
+			continue
+		}
+		for _, p := range item.Provides() {
+			if strings.HasPrefix(p, "path:") {
+				paths[path.Clean(strings.TrimPrefix(p, "path:"))] = true
+			}
+		}
+		if e, ok := item.(editor); ok {
+			paths[path.Clean(e.editpath())] = true
+		}
+	}
+	return paths
+}
+
 func (r *Run) runinit() error {
 	// Do some initialization for items queued up at init() time.
 	// Now that we have a proper host list, we can clone the items
@@ -162,6 +271,10 @@ func (r *Run) runinit() error {
 			return iitem.WrapError(r, fmt.Errorf("Item already added"))
 		}
 		for _, host := range r.Hosts {
+			// pushed hosts run their own copy of everything
+			if host.push || !host.targets(iitem.item) {
+				continue
+			}
 			c := iitem.item.Clone()
 			if err := r.addHostItem(host, iitem.source, c); err != nil {
 				return err
@@ -180,6 +293,9 @@ func (r *Run) run() error {
 	}
 
 	r.out = &outputter{}
+	if r.agentout != nil {
+		r.out.events = json.NewEncoder(r.agentout)
+	}
 
 	errs := make(chan error)
 
@@ -192,12 +308,26 @@ func (r *Run) run() error {
 		exec     []*iexec
 		running  int
 		executed = map[int]bool{}
+		started  bool // past the items there were to begin with
 
 		errors             int
 		interesting_errors []error
 		skipfailures       int
 	)
 
+	r.itemsmu.Lock()
+	unselected := r.unselected()
+	r.itemsmu.Unlock()
+
+	for _, host := range r.Hosts {
+		if host.push {
+			running++
+			go func(host *Host) {
+				errs <- r.runagent(host)
+			}(host)
+		}
+	}
+
 	for {
 
 		r.itemsmu.Lock()
@@ -213,13 +343,37 @@ func (r *Run) run() error {
 		}
 		r.itemsmu.Unlock()
 
+		// Package items are batched per host, so they all need to be counted
+		// before any of them start. Ones that have to wait for another
+		// Package can't be in the batch, or it would wait for them too.
+		// Ones added while the run is going (by a Func) could turn up after
+		// the batch is done, so they're applied one at a time.
+		r.itemsmu.Lock()
+		for _, ex := range exec {
+			if p, ok := ex.item.(*Package); ok {
+				if started || r.needspackage(ex.im.host, p) {
+					p.alone = true
+				} else {
+					ex.im.host.pkgs.register()
+				}
+			}
+		}
+		r.itemsmu.Unlock()
+		started = true
+
 		for _, ex := range exec {
 			running++
 			go func(ex *iexec) {
 				item := ex.item
 				host := ex.im.host
 
+				applied := false
+
 				err := func() error {
+					if unselected[item.ID()] {
+						return nil
+					}
+
 					// be a little tricky here to allow fences to appear in the future
 					for {
 						var (
@@ -227,16 +381,7 @@ func (r *Run) run() error {
 							waiting string
 						)
 						r.itemsmu.Lock()
-						waitlist := make([]string, 0, len(item.After()))
-						for _, after := range item.After() {
-							waitlist = append(waitlist, host.Key()+"-"+after)
-						}
-						for _, pr := range item.Provides() {
-							for _, bef := range r.befores[host.Key()+"-"+pr] {
-								waitlist = append(waitlist, bef)
-							}
-						}
-						for _, n := range waitlist {
+						for _, n := range r.waitlist(host, item) {
 							m, ok := r.fences[n]
 							if ok {
 								mu = m
@@ -269,18 +414,64 @@ func (r *Run) run() error {
 						}
 					}
 
+					// Everything that could notify us is finished by now
+					r.itemsmu.Lock()
+					notifiers := r.notifiers(host, item)
+					notified := false
+					for _, n := range notifiers {
+						if r.changed[n] {
+							notified = true
+						}
+					}
+					r.itemsmu.Unlock()
+
 					start := time.Now()
-					status, err := item.Apply(host)
+
+					ok, err := host.when(item)
+					if err != nil {
+						err = ex.im.WrapError(r, err)
+						r.out.FinishItem(start, r, item, itemUnchanged, err)
+						return err
+					}
+					if !ok {
+						r.out.FinishItem(start, r, item, itemSkipped, nil)
+						return nil
+					}
+
+					status := itemUnchanged
+					if h, ok := item.(handler); !ok || !h.handler() || len(notifiers) == 0 {
+						applied = true
+						status, err = item.Apply(host)
+					}
+					if n, ok := item.(Notifiable); ok && notified && err == nil {
+						var nstatus itemStatus
+						nstatus, err = n.Notified(host)
+						if nstatus != itemUnchanged {
+							status = nstatus
+						}
+					}
 					if err != nil {
 						err = ex.im.WrapError(r, err)
 					}
 					r.out.FinishItem(start, r, item, status, err)
 
+					if err == nil && status != itemUnchanged {
+						r.itemsmu.Lock()
+						for _, p := range provides(item) {
+							r.changed[host.Key()+"-"+p] = true
+						}
+						r.itemsmu.Unlock()
+					}
+
 					return err
 				}()
 
+				if p, ok := item.(*Package); ok && !applied && !p.alone {
+					host.pkgs.unregister(host)
+				}
+
 				r.itemsmu.Lock()
-				for _, p := range item.Provides() {
+				for _, p := range provides(item) {
 					p = host.Key() + "-" + p
 					r.errors[p] = err
 					mu, ok := r.fences[p]
@@ -301,6 +492,11 @@ func (r *Run) run() error {
 			//if r.Dry {
 			//	fmt.Fprintln(os.Stderr, "No actions actually performed (dry run)")
 			//}
+			if r.agentout != nil {
+				// the controller reports these
+				r.out.Done(errors, skipfailures)
+				return nil
+			}
 			if errors == 0 && skipfailures == 0 {
 				return nil
 			}
@@ -318,6 +514,10 @@ func (r *Run) run() error {
 		if err != nil {
 			if err == errNeededItemFailed {
 				skipfailures++
+			} else if af, ok := err.(*agentfailures); ok {
+				errors += af.failed
+				skipfailures += af.skipped
+				interesting_errors = append(interesting_errors, af.errs...)
 			} else {
 				interesting_errors = append(interesting_errors, err)
 				errors++
@@ -0,0 +1,227 @@
+package khan
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"khan.rip/rio"
+
+	"github.com/flosch/pongo2/v4"
+)
+
+// testhost is a rio.Host that only knows about packages. Anything else it
+// gets asked panics on the nil embedded Host.
+type testhost struct {
+	rio.Host
+
+	mu           sync.Mutex
+	installed    []string
+	transactions int
+}
+
+func (th *testhost) String() string {
+	return "test"
+}
+func (th *testhost) Info() (*rio.Info, error) {
+	return &rio.Info{Hostname: "test", OS: "linux", Arch: "amd64"}, nil
+}
+func (th *testhost) Facts() (*rio.Facts, error) {
+	return &rio.Facts{Distro: "debian", DistroFamily: "debian"}, nil
+}
+func (th *testhost) Packages(names []string) (map[string]*rio.Package, error) {
+	return map[string]*rio.Package{}, nil
+}
+func (th *testhost) InstallPackages(pkgs []*rio.Package) error {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.transactions++
+	for _, p := range pkgs {
+		th.installed = append(th.installed, p.Name)
+	}
+	return nil
+}
+func (th *testhost) RemovePackages(names []string) error {
+	return nil
+}
+
+func newtestrun(rh rio.Host) *Run {
+	r := &Run{
+		out:            &outputter{},
+		meta:           map[int]*imeta{},
+		fences:         map[string]*sync.Mutex{},
+		befores:        map[string][]string{},
+		notifies:       map[string][]string{},
+		errors:         map[string]error{},
+		changed:        map[string]bool{},
+		pongocachewhen: map[string]*pongo2.Template{},
+	}
+	r.Hosts = []*Host{{Run: r, Name: "test", rh: rh}}
+	return r
+}
+
+// runwithin fails the test if the run doesn't finish in time, since the
+// ways this goes wrong are mostly deadlocks
+func runwithin(t *testing.T, r *Run, d time.Duration) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- r.run()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		t.Fatal("Run didn't finish")
+		return nil
+	}
+}
+
+func TestPackageWhenSkipped(t *testing.T) {
+	th := &testhost{}
+	r := newtestrun(th)
+	if err := r.AddFromSource("test:1",
+		&Package{Name: "curl"},
+		&Package{Name: "nginx", Meta: Meta{When: `os == "openbsd"`}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runwithin(t, r, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(th.installed) != 1 || th.installed[0] != "curl" {
+		t.Errorf("Installed %v, want [curl]", th.installed)
+	}
+}
+
+func TestPackageWhenError(t *testing.T) {
+	th := &testhost{}
+	r := newtestrun(th)
+	if err := r.AddFromSource("test:1",
+		&Package{Name: "curl"},
+		&Package{Name: "nginx", Meta: Meta{When: `os ==`}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runwithin(t, r, 5*time.Second); err == nil {
+		t.Error("Bad when didn't fail the run")
+	}
+	if len(th.installed) != 1 || th.installed[0] != "curl" {
+		t.Errorf("Installed %v, want [curl]", th.installed)
+	}
+}
+
+func TestPackageAddedByFunc(t *testing.T) {
+	th := &testhost{}
+	r := newtestrun(th)
+	var added *Package
+	if err := r.AddFromSource("test:1",
+		&Package{Name: "curl"},
+		&Package{Name: "git"},
+		Func(func(host *Host) error {
+			added = &Package{Name: "nginx"}
+			return host.Add(added)
+		}),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runwithin(t, r, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(th.installed) != 3 {
+		t.Errorf("Installed %v, want curl, git and nginx", th.installed)
+	}
+	if !added.alone || th.transactions != 2 {
+		t.Errorf("Package added during the run went in with the batch (%d transactions)", th.transactions)
+	}
+}
+
+// testitem does nothing, but can be put in between other items. Without a
+// name it provides nothing.
+type testitem struct {
+	Name    string
+	Changes bool
+
+	Meta
+
+	id int
+}
+
+func (ti *testitem) SetID(id int) {
+	ti.id = id
+}
+func (ti *testitem) ID() int {
+	return ti.id
+}
+func (ti *testitem) Clone() Item {
+	r := *ti
+	r.id = 0
+	return &r
+}
+func (ti *testitem) String() string {
+	return ti.Name
+}
+func (ti *testitem) Apply(host *Host) (itemStatus, error) {
+	if ti.Changes {
+		return itemModified, nil
+	}
+	return itemUnchanged, nil
+}
+func (ti *testitem) Provides() []string {
+	if ti.Name == "" {
+		return nil
+	}
+	return []string{"test:" + ti.Name}
+}
+func (ti *testitem) After() []string {
+	return nil
+}
+func (ti *testitem) Before() []string {
+	return nil
+}
+
+func TestPackageChain(t *testing.T) {
+	th := &testhost{}
+	r := newtestrun(th)
+	if err := r.AddFromSource("test:1",
+		&Package{Name: "curl"},
+		&Package{Name: "git"},
+		&testitem{Name: "between", Meta: Meta{Requires: []string{"package:curl"}}},
+		&Package{Name: "nginx", Meta: Meta{Subscribe: []string{"test:between"}}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runwithin(t, r, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(th.installed) != 3 || th.installed[2] != "nginx" {
+		t.Errorf("Installed %v, want nginx last", th.installed)
+	}
+}
+
+func TestNotifyFromUnnamedItem(t *testing.T) {
+	for _, changes := range []bool{false, true} {
+		r := newtestrun(&testhost{})
+		notified := false
+		if err := r.AddFromSource("test:1",
+			&testitem{Changes: changes, Meta: Meta{Notify: []string{"func:handler"}}},
+			&Function{Name: "handler", Fn: func(*Host) error {
+				notified = true
+				return nil
+			}},
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := runwithin(t, r, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if notified != changes {
+			t.Errorf("Handler notified = %v when the unnamed item changes = %v", notified, changes)
+		}
+	}
+}
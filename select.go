@@ -0,0 +1,126 @@
+package khan
+
+// Selective runs: --tags, --skip-tags and --only pick out part of the
+// configuration. Items that aren't picked stay in the graph, so ordering and
+// things like managedpaths still see them, but they finish without being
+// applied.
+
+// Selection is which items a run applies. The zero value is everything.
+type Selection struct {
+	// Tags picks items with any of these tags
+	Tags []string
+	// SkipTags leaves out items with any of these tags, even if they were
+	// picked some other way
+	SkipTags []string
+	// Only picks items that provide any of these, like "path:/etc/foo"
+	Only []string
+	// NoDeps doesn't pull in the items that picked items are After, the ones
+	// that are Before them, or the ones they notify
+	NoDeps bool
+}
+
+func (sel *Selection) all() bool {
+	return len(sel.Tags) == 0 && len(sel.SkipTags) == 0 && len(sel.Only) == 0
+}
+
+func (sel *Selection) skips(item Item) bool {
+	m, ok := item.(metaer)
+	return ok && overlaps(m.meta().Tags, sel.SkipTags)
+}
+
+func (sel *Selection) picks(item Item) bool {
+	if sel.skips(item) {
+		return false
+	}
+	if len(sel.Tags) == 0 && len(sel.Only) == 0 {
+		return true
+	}
+	if m, ok := item.(metaer); ok && overlaps(m.meta().Tags, sel.Tags) {
+		return true
+	}
+	return overlaps(item.Provides(), sel.Only)
+}
+
+// unselected works out which items to leave out of the run. Items added
+// while running aren't in it, since whatever added them was picked. Always
+// have itemsmu locked before calling this.
+func (r *Run) unselected() map[int]bool {
+	out := map[int]bool{}
+	if r.Selection.all() {
+		return out
+	}
+
+	providers := map[string]Item{}
+	subscribers := map[string][]Item{}
+	befores := map[string][]Item{}
+	for _, item := range r.items {
+		host := r.meta[item.ID()].host
+		for _, p := range item.Provides() {
+			providers[host.Key()+"-"+p] = item
+		}
+		for _, b := range item.Before() {
+			befores[host.Key()+"-"+b] = append(befores[host.Key()+"-"+b], item)
+		}
+		if m, ok := item.(metaer); ok {
+			for _, s := range m.meta().Subscribe {
+				subscribers[host.Key()+"-"+s] = append(subscribers[host.Key()+"-"+s], item)
+			}
+		}
+	}
+
+	picked := map[int]bool{}
+	var todo []Item
+	for _, item := range r.items {
+		if r.Selection.picks(item) {
+			picked[item.ID()] = true
+			todo = append(todo, item)
+		}
+	}
+	for !r.Selection.NoDeps && len(todo) > 0 {
+		item := todo[0]
+		todo = todo[1:]
+		host := r.meta[item.ID()].host
+
+		// what it needs (including the items that say they go Before it),
+		// and what it would notify if it changed, so a hotfixed config file
+		// still gets its service reloaded
+		var deps []Item
+		keys := afters(item)
+		if m, ok := item.(metaer); ok {
+			keys = append(keys, m.meta().Notify...)
+		}
+		for _, k := range keys {
+			if dep, ok := providers[host.Key()+"-"+k]; ok {
+				deps = append(deps, dep)
+			}
+		}
+		for _, p := range item.Provides() {
+			deps = append(deps, befores[host.Key()+"-"+p]...)
+			deps = append(deps, subscribers[host.Key()+"-"+p]...)
+		}
+
+		for _, dep := range deps {
+			if picked[dep.ID()] || r.Selection.skips(dep) {
+				continue
+			}
+			picked[dep.ID()] = true
+			todo = append(todo, dep)
+		}
+	}
+
+	for _, item := range r.items {
+		if !picked[item.ID()] {
+			out[item.ID()] = true
+		}
+	}
+	return out
+}
+
+func overlaps(a, b []string) bool {
+	for _, s := range a {
+		if contains(b, s) {
+			return true
+		}
+	}
+	return false
+}
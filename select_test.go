@@ -0,0 +1,104 @@
+package khan
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSelection(t *testing.T) {
+	tests := []struct {
+		sel  Selection
+		want string // items that get applied
+	}{
+		{Selection{}, "a base conf debug other sub svc"},
+		{Selection{Tags: []string{"app"}}, "a base"},
+		{Selection{Tags: []string{"app"}, NoDeps: true}, "a"},
+		// notified and subscribed items come along
+		{Selection{Tags: []string{"config"}}, "conf sub svc"},
+		{Selection{Tags: []string{"config"}, NoDeps: true}, "conf"},
+		{Selection{Tags: []string{"app", "config"}}, "a base conf sub svc"},
+		{Selection{Tags: []string{"nope"}}, ""},
+		{Selection{SkipTags: []string{"debug"}}, "a base conf other sub svc"},
+		{Selection{SkipTags: []string{"app", "config"}}, "base debug other sub svc"},
+		{Selection{Tags: []string{"app", "debug"}, SkipTags: []string{"debug"}}, "a base"},
+		// skip-tags wins over dependencies too
+		{Selection{Tags: []string{"app"}, SkipTags: []string{"slow"}}, "a"},
+		{Selection{Only: []string{"test:svc"}}, "svc"},
+		{Selection{Only: []string{"test:debug"}}, "base debug"},
+		{Selection{Only: []string{"test:debug"}, SkipTags: []string{"debug"}}, ""},
+		{Selection{Tags: []string{"app"}, Only: []string{"test:other"}}, "a base other"},
+		{Selection{Only: []string{"test:nope"}}, ""},
+	}
+	for _, test := range tests {
+		r := newtestrun(&testhost{})
+		r.Selection = test.sel
+		if err := r.AddFromSource("test:1",
+			&testitem{Name: "a", Meta: Meta{Requires: []string{"test:base"}, Tags: []string{"app"}}},
+			&testitem{Name: "base", Meta: Meta{Tags: []string{"slow"}}},
+			&testitem{Name: "conf", Meta: Meta{Tags: []string{"config"}, Notify: []string{"test:svc"}}},
+			&testitem{Name: "svc"},
+			&testitem{Name: "sub", Meta: Meta{Subscribe: []string{"test:conf"}}},
+			&testitem{Name: "debug", Meta: Meta{Requires: []string{"test:base"}, Tags: []string{"debug"}}},
+			&testitem{Name: "other"},
+		); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.runinit(); err != nil {
+			t.Fatal(err)
+		}
+
+		r.itemsmu.Lock()
+		unselected := r.unselected()
+		var names []string
+		for _, item := range r.items {
+			if !unselected[item.ID()] {
+				names = append(names, item.String())
+			}
+		}
+		r.itemsmu.Unlock()
+
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != test.want {
+			t.Errorf("%+v: got %#v, want %#v", test.sel, got, test.want)
+		}
+	}
+}
+
+// Items that go Before a picked item are needed by it just the same as the
+// ones it's After
+func TestSelectionBefore(t *testing.T) {
+	for _, nodeps := range []bool{false, true} {
+		r := newtestrun(&testhost{})
+		r.Selection = Selection{Only: []string{"-group:old"}, NoDeps: nodeps}
+		if err := r.AddFromSource("test:1",
+			&User{Name: "old", Delete: true},
+			&Group{Name: "old", Delete: true},
+			&User{Name: "other", Delete: true},
+		); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.runinit(); err != nil {
+			t.Fatal(err)
+		}
+
+		r.itemsmu.Lock()
+		unselected := r.unselected()
+		var names []string
+		for _, item := range r.items {
+			if !unselected[item.ID()] {
+				names = append(names, strings.Join(item.Provides(), ","))
+			}
+		}
+		r.itemsmu.Unlock()
+
+		sort.Strings(names)
+		want := "-group:old -user:old"
+		if nodeps {
+			want = "-group:old"
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("NoDeps %v: got %#v, want %#v", nodeps, got, want)
+		}
+	}
+}
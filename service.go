@@ -0,0 +1,115 @@
+package khan
+
+import (
+	"errors"
+	"fmt"
+
+	"khan.rip/rio"
+)
+
+// Service manages a systemd unit (Linux) or rc.d script (OpenBSD). By default
+// the service is made enabled at boot and running. Static systemd units,
+// which only start when something else wants them, are left alone at boot.
+type Service struct {
+	Name string `khan:"name,shortkey"`
+
+	Disabled bool // Do not start at boot
+	Stopped  bool // Do not leave running
+
+	// Masked services are stopped and cannot be started, even by hand or as
+	// a dependency of another unit. (systemd only)
+	Masked bool
+
+	// Reload instead of restart when notified of changes
+	Reload bool
+
+	Meta
+
+	id      int
+	started bool
+}
+
+func (s *Service) String() string {
+	return s.Name
+}
+
+func (s *Service) SetID(id int) {
+	s.id = id
+}
+func (s *Service) ID() int {
+	return s.id
+}
+func (s *Service) Clone() Item {
+	r := *s
+	r.id = 0
+	return &r
+}
+
+func (s *Service) Validate() error {
+	if s.Name == "" {
+		return errors.New("Service name is required")
+	}
+	return nil
+}
+
+func (s *Service) After() []string {
+	return nil
+}
+func (s *Service) Before() []string {
+	return nil
+}
+func (s *Service) Provides() []string {
+	return []string{"service:" + s.Name}
+}
+
+func (s *Service) Apply(host *Host) (itemStatus, error) {
+	old, err := host.rh.Service(s.Name)
+	if err != nil {
+		return 0, err
+	}
+	if old == nil {
+		return 0, fmt.Errorf("Unknown service %#v", s.Name)
+	}
+
+	v := &rio.Service{
+		Name:    s.Name,
+		Enabled: !s.Disabled && !s.Masked,
+		Running: !s.Stopped && !s.Masked,
+		Masked:  s.Masked,
+	}
+	if old.Static && !s.Masked {
+		// systemctl can't enable or disable these, so whatever they
+		// do at boot is as good as it gets
+		v.Enabled = old.Enabled
+		v.Static = true
+	}
+
+	if old.Enabled == v.Enabled && old.Running == v.Running && old.Masked == v.Masked {
+		return itemUnchanged, nil
+	}
+
+	if err := host.rh.UpdateService(v); err != nil {
+		return 0, err
+	}
+	s.started = v.Running && !old.Running
+	return itemModified, nil
+}
+
+func (s *Service) Notified(host *Host) (itemStatus, error) {
+	// Nothing to do if it isn't supposed to be running, or it was just started
+	// with the new configuration anyway.
+	if s.Stopped || s.Masked || s.started {
+		return itemUnchanged, nil
+	}
+
+	if s.Reload {
+		if err := host.rh.ReloadService(s.Name); err != nil {
+			return 0, err
+		}
+		return itemReloaded, nil
+	}
+	if err := host.rh.RestartService(s.Name); err != nil {
+		return 0, err
+	}
+	return itemRestarted, nil
+}
@@ -0,0 +1,71 @@
+package khan
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"khan.rip/rio"
+)
+
+// servicehost has every service running already
+type servicehost struct {
+	testhost
+	restarted []string
+	reloaded  []string
+}
+
+func (sh *servicehost) Service(name string) (*rio.Service, error) {
+	return &rio.Service{Name: name, Enabled: true, Running: true}, nil
+}
+func (sh *servicehost) RestartService(name string) error {
+	sh.restarted = append(sh.restarted, name)
+	return nil
+}
+func (sh *servicehost) ReloadService(name string) error {
+	sh.reloaded = append(sh.reloaded, name)
+	return nil
+}
+
+func TestServiceNotified(t *testing.T) {
+	sh := &servicehost{}
+	r := newtestrun(sh)
+	events := &bytes.Buffer{}
+	r.agentout = events
+	if err := r.AddFromSource("test:1",
+		&testitem{Name: "conf", Changes: true, Meta: Meta{Notify: []string{"service:web", "service:proxy"}}},
+		&Service{Name: "web"},
+		&Service{Name: "proxy", Reload: true},
+		&Service{Name: "db"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := runwithin(t, r, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sh.restarted) != 1 || sh.restarted[0] != "web" || len(sh.reloaded) != 1 || sh.reloaded[0] != "proxy" {
+		t.Errorf("Restarted %v and reloaded %v", sh.restarted, sh.reloaded)
+	}
+
+	// what gets reported for each one
+	want := map[string]string{"web": "restarted", "proxy": "reloaded", "db": "unchanged"}
+	dec := json.NewDecoder(events)
+	for dec.More() {
+		ev := &agentevent{}
+		if err := dec.Decode(ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != "service" {
+			continue
+		}
+		if ev.Status != want[ev.Item] {
+			t.Errorf("%s was %s, want %s", ev.Item, ev.Status, want[ev.Item])
+		}
+		delete(want, ev.Item)
+	}
+	if len(want) > 0 {
+		t.Errorf("Nothing reported for %v", want)
+	}
+}
@@ -0,0 +1,201 @@
+package khan
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/desops/sshpool"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshsetup has everything needed to connect to remote hosts: keys,
+// known_hosts, ssh_config, and connections to jump hosts.
+type sshsetup struct {
+	auth  *sshauth
+	hk    *hostkeys
+	hosts *sshconfig
+
+	jumpsmu sync.Mutex
+	jumps   map[string]*jumpclient
+}
+
+// jumpclient is a connection to a jump host, shared by everything going
+// through it
+type jumpclient struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+func newsshsetup(configfile string, knownhostsfiles []string, tofu, insecure bool, authmethods, identities []string) (*sshsetup, error) {
+	s := &sshsetup{
+		jumps: map[string]*jumpclient{},
+	}
+	var err error
+	if s.auth, err = newsshauth(authmethods, identities); err != nil {
+		return nil, err
+	}
+	if s.hk, err = newhostkeys(knownhostsfiles, tofu, insecure); err != nil {
+		return nil, err
+	}
+	if s.hosts, err = loadsshconfig(configfile); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// clientconfig makes the ssh config for one host. The host key is checked
+// against the host's real address, even when it's reached through a jump host.
+func (s *sshsetup) clientconfig(sh *sshhost) *ssh.ClientConfig {
+	addr := net.JoinHostPort(sh.hostname, sh.port)
+
+	config := &ssh.ClientConfig{
+		User: sh.user,
+		Auth: s.auth.authmethods(sh),
+		HostKeyCallback: func(_ string, remote net.Addr, key ssh.PublicKey) error {
+			return s.hk.check(addr, remote, key)
+		},
+		// Ask for the kind of host key we know it by
+		HostKeyAlgorithms: s.hk.algorithms(addr),
+		BannerCallback:    ssh.BannerDisplayStderr(),
+	}
+
+	return config
+}
+
+// pool makes an sshpool for a host
+func (s *sshsetup) pool(sh *sshhost) *authpool {
+	return &authpool{
+		Pool: sshpool.New(s.clientconfig(sh), &sshpool.PoolConfig{Debug: false}), //r.Verbose})
+		auth: s.auth,
+		sh:   sh,
+	}
+}
+
+// authpool tells sshauth how getting each session went, which is the only way
+// to find out how logging in went when sshpool does it
+type authpool struct {
+	*sshpool.Pool
+	auth *sshauth
+	sh   *sshhost
+}
+
+func (p *authpool) Get(host string) (*sshpool.Session, error) {
+	session, err := p.Pool.Get(host)
+	p.auth.loggedin(p.sh, err)
+	return session, err
+}
+
+// client is the connect callback for a host behind jump hosts. The host is
+// dialed through the last of them and its connection is shared the same way,
+// so it's dialed again if it goes away.
+func (s *sshsetup) client(connect string, jumps []string) func() (*ssh.Client, error) {
+	chain := append(append([]string{}, jumps...), connect)
+	return func() (*ssh.Client, error) {
+		client, err := s.jump(chain, nil)
+		if err != nil {
+			return nil, fmt.Errorf("via %s: %w", strings.Join(jumps, ","), err)
+		}
+		return client, nil
+	}
+}
+
+// jump returns a connection to the last of a chain of jump hosts, dialing it
+// (and the ones before it) if needed. A jump host on its own can have its own
+// ProxyJump in ssh_config.
+func (s *sshsetup) jump(chain []string, seen map[string]bool) (*ssh.Client, error) {
+	key := strings.Join(chain, ",")
+	if seen[key] {
+		return nil, fmt.Errorf("ProxyJump loop at %s", key)
+	}
+
+	s.jumpsmu.Lock()
+	jc, ok := s.jumps[key]
+	if ok {
+		s.jumpsmu.Unlock()
+		<-jc.done
+		return jc.client, jc.err
+	}
+	jc = &jumpclient{done: make(chan struct{})}
+	s.jumps[key] = jc
+	s.jumpsmu.Unlock()
+
+	jc.client, jc.err = s.dialjump(chain, seen)
+	if jc.err != nil {
+		// the next one through can try again
+		s.forgetjump(key, jc)
+	} else {
+		go func() {
+			_ = jc.client.Wait()
+			s.forgetjump(key, jc)
+		}()
+	}
+	close(jc.done)
+	return jc.client, jc.err
+}
+
+// forgetjump drops a jump host connection that failed or went away, so it
+// gets dialed again the next time it's needed
+func (s *sshsetup) forgetjump(key string, jc *jumpclient) {
+	s.jumpsmu.Lock()
+	defer s.jumpsmu.Unlock()
+	if s.jumps[key] == jc {
+		delete(s.jumps, key)
+	}
+}
+
+func (s *sshsetup) dialjump(chain []string, seen map[string]bool) (*ssh.Client, error) {
+	sh, err := s.hosts.lookup(chain[len(chain)-1])
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(sh.hostname, sh.port)
+	config := s.clientconfig(sh)
+
+	via := chain[:len(chain)-1]
+	if len(via) == 0 && sh.proxyjump != "" {
+		via = strings.Split(sh.proxyjump, ",")
+	}
+	if len(via) == 0 {
+		client, err := ssh.Dial("tcp", addr, config)
+		s.auth.loggedin(sh, err)
+		return client, err
+	}
+
+	if seen == nil {
+		seen = map[string]bool{}
+	}
+	seen[strings.Join(chain, ",")] = true
+
+	parent, err := s.jump(via, seen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := parent.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", sh.alias, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	s.auth.loggedin(sh, err)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %w", sh.alias, err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (s *sshsetup) close() {
+	s.jumpsmu.Lock()
+	defer s.jumpsmu.Unlock()
+	for _, jc := range s.jumps {
+		select {
+		case <-jc.done:
+			if jc.client != nil {
+				jc.client.Close()
+			}
+		default:
+		}
+	}
+}
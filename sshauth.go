@@ -0,0 +1,384 @@
+package khan
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// Passphrases and passwords can come from the environment, for when there's
+// nobody around to type them.
+const (
+	passphraseEnv = "KHAN_SSH_PASSPHRASE"
+	passwordEnv   = "KHAN_SSH_PASSWORD"
+)
+
+// sshauth works out how to log in to hosts. The methods are tried in order:
+// "agent" and "keys" are both public key auth, so they go together as one,
+// and "keyboard-interactive" and "password" prompt for a password.
+type sshauth struct {
+	methods    []string
+	identities []string // from the command line, on top of ssh_config's
+
+	agent agent.ExtendedAgent
+
+	keysmu sync.Mutex
+	keys   map[string]*keyfile
+
+	promptmu sync.Mutex
+
+	// Passwords are remembered once logging in with them works, so every
+	// connection doesn't ask
+	passwordsmu sync.Mutex
+	passwords   map[string]string
+	pending     map[string]string // not known to work yet
+}
+
+func newsshauth(methods, identities []string) (*sshauth, error) {
+	a := &sshauth{
+		methods:    methods,
+		identities: identities,
+		keys:       map[string]*keyfile{},
+		passwords:  map[string]string{},
+		pending:    map[string]string{},
+	}
+	for _, m := range methods {
+		switch m {
+		case "agent":
+			// No agent is fine, there might be other ways in.
+			if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+				conn, err := net.Dial("unix", socket)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Not using SSH agent: %v\n", err)
+					continue
+				}
+				a.agent = agent.NewClient(conn)
+			}
+		case "keys", "keyboard-interactive", "password":
+		default:
+			return nil, fmt.Errorf("Unknown SSH auth method %#v (use agent, keys, keyboard-interactive or password)", m)
+		}
+	}
+	return a, nil
+}
+
+// authmethods returns the ssh auth methods for a host
+func (a *sshauth) authmethods(sh *sshhost) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	publickey := false
+	for _, m := range a.methods {
+		switch m {
+		case "agent", "keys":
+			// ssh only tries each kind of auth once, so these are one
+			if !publickey {
+				publickey = true
+				methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+					return a.signers(sh), nil
+				}))
+			}
+		case "keyboard-interactive":
+			methods = append(methods, ssh.KeyboardInteractive(a.challenge(sh)))
+		case "password":
+			methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+				return a.password(sh)
+			}))
+		}
+	}
+	return methods
+}
+
+func (a *sshauth) signers(sh *sshhost) []ssh.Signer {
+	var signers []ssh.Signer
+	for _, m := range a.methods {
+		switch m {
+		case "agent":
+			if a.agent == nil {
+				continue
+			}
+			agentsigners, err := a.agent.Signers()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "SSH agent: %v\n", err)
+				continue
+			}
+			signers = append(signers, agentsigners...)
+		case "keys":
+			files := append(append([]string{}, a.identities...), sh.identityfiles...)
+			certs := sh.certificatefiles
+			if len(files) == 0 {
+				files = defaultidentities()
+			}
+			for _, fpath := range files {
+				kf, err := a.keyfile(fpath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Skipping identity file %s: %v\n", fpath, err)
+					continue
+				}
+				if kf == nil {
+					continue
+				}
+				// A certificate goes first, since it's what the server is
+				// more likely to want.
+				seen := map[string]bool{}
+				for _, cert := range append([]string{fpath + "-cert.pub"}, certs...) {
+					if seen[cert] {
+						continue
+					}
+					seen[cert] = true
+					if cs, err := certsigner(cert, kf); err == nil && cs != nil {
+						signers = append(signers, cs)
+					} else if err != nil {
+						fmt.Fprintf(os.Stderr, "Skipping certificate %s: %v\n", cert, err)
+					}
+				}
+				signers = append(signers, kf)
+			}
+		}
+	}
+	return signers
+}
+
+// defaultidentities are the keys OpenSSH tries when none are configured
+func defaultidentities() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+		files = append(files, filepath.Join(home, ".ssh", name))
+	}
+	return files
+}
+
+// keyfile is a private key that is only decrypted when it's needed, so
+// nobody gets asked for a passphrase for a key the server won't take.
+type keyfile struct {
+	auth  *sshauth
+	fpath string
+	pub   ssh.PublicKey
+	pem   []byte
+
+	once   sync.Once
+	signer ssh.Signer
+	err    error
+}
+
+// keyfile loads a private key, returning nil if it doesn't exist
+func (a *sshauth) keyfile(fpath string) (*keyfile, error) {
+	a.keysmu.Lock()
+	defer a.keysmu.Unlock()
+
+	if kf, ok := a.keys[fpath]; ok {
+		return kf, nil
+	}
+
+	buf, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	kf := &keyfile{auth: a, fpath: fpath, pem: buf}
+
+	signer, err := ssh.ParsePrivateKey(buf)
+	var passerr *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		kf.signer = signer
+		kf.pub = signer.PublicKey()
+		kf.once.Do(func() {})
+	case errors.As(err, &passerr):
+		kf.pub = passerr.PublicKey
+		if kf.pub == nil {
+			// Older key formats only have the public key next to them
+			if buf, err := ioutil.ReadFile(fpath + ".pub"); err == nil {
+				kf.pub, _, _, _, _ = ssh.ParseAuthorizedKey(buf)
+			}
+		}
+		if kf.pub == nil {
+			if err := kf.decrypt(); err != nil {
+				return nil, err
+			}
+			kf.pub = kf.signer.PublicKey()
+		}
+	default:
+		return nil, err
+	}
+
+	a.keys[fpath] = kf
+	return kf, nil
+}
+
+func (kf *keyfile) decrypt() error {
+	kf.once.Do(func() {
+		passphrase, err := kf.auth.ask("Enter passphrase for key '"+kf.fpath+"': ", false, passphraseEnv)
+		if err != nil {
+			kf.err = err
+			return
+		}
+		kf.signer, kf.err = ssh.ParsePrivateKeyWithPassphrase(kf.pem, []byte(passphrase))
+		if kf.err != nil {
+			kf.err = fmt.Errorf("%s: %w", kf.fpath, kf.err)
+		}
+	})
+	return kf.err
+}
+
+func (kf *keyfile) PublicKey() ssh.PublicKey {
+	return kf.pub
+}
+
+func (kf *keyfile) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	if err := kf.decrypt(); err != nil {
+		return nil, err
+	}
+	return kf.signer.Sign(rand, data)
+}
+
+// certsigner pairs a key with an OpenSSH certificate for it, returning nil if
+// there's no certificate at fpath
+func certsigner(fpath string, kf *keyfile) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("Not a certificate")
+	}
+	if string(cert.Key.Marshal()) != string(kf.pub.Marshal()) {
+		// a CertificateFile for some other key
+		return nil, nil
+	}
+	return ssh.NewCertSigner(cert, kf)
+}
+
+func (a *sshauth) challenge(sh *sshhost) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 0 {
+			return nil, nil
+		}
+		if name != "" || instruction != "" {
+			a.promptmu.Lock()
+			fmt.Fprintln(os.Stderr, strings.TrimSpace(name+"\n"+instruction))
+			a.promptmu.Unlock()
+		}
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			// Only hidden answers are passwords
+			env := ""
+			if !echos[i] {
+				env = passwordEnv
+			}
+			answer, err := a.ask(q, echos[i], env)
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	}
+}
+
+// password gets the password for a host: one that worked already, or a new
+// one from the environment or the person at the terminal. A new one is only
+// remembered once loggedin hears that it worked.
+func (a *sshauth) password(sh *sshhost) (string, error) {
+	key := sh.user + "@" + sh.alias
+
+	a.passwordsmu.Lock()
+	password, ok := a.passwords[key]
+	a.passwordsmu.Unlock()
+	if ok {
+		return password, nil
+	}
+
+	password, err := a.ask(fmt.Sprintf("%s's password: ", key), false, passwordEnv)
+	if err != nil {
+		return "", err
+	}
+
+	a.passwordsmu.Lock()
+	a.pending[key] = password
+	a.passwordsmu.Unlock()
+	return password, nil
+}
+
+// loggedin hears how connecting to a host went. A password that was just
+// asked for is remembered if it worked, and one that stops working is
+// forgotten, so a wrong password isn't tried over and over.
+func (a *sshauth) loggedin(sh *sshhost, err error) {
+	key := sh.user + "@" + sh.alias
+
+	a.passwordsmu.Lock()
+	defer a.passwordsmu.Unlock()
+
+	if password, ok := a.pending[key]; ok {
+		delete(a.pending, key)
+		if err == nil {
+			a.passwords[key] = password
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "unable to authenticate") {
+		delete(a.passwords, key)
+	}
+}
+
+// ask gets an answer from the environment or the person at the terminal.
+// Nothing is remembered here, since answers to challenges are often only
+// good once.
+func (a *sshauth) ask(prompt string, echo bool, env string) (string, error) {
+	if v, ok := os.LookupEnv(env); ok && env != "" {
+		return v, nil
+	}
+
+	a.promptmu.Lock()
+	defer a.promptmu.Unlock()
+
+	answer, err := readtty(prompt, echo)
+	if err != nil {
+		if env != "" {
+			return "", fmt.Errorf("Can't ask %#v (set %s): %w", strings.TrimSpace(prompt), env, err)
+		}
+		return "", fmt.Errorf("Can't ask %#v: %w", strings.TrimSpace(prompt), err)
+	}
+	return answer, nil
+}
+
+// readtty asks the person at the terminal, even if stdin is redirected
+func readtty(prompt string, echo bool) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	if echo {
+		answer, err := bufio.NewReader(tty).ReadString('\n')
+		return strings.TrimRight(answer, "\r\n"), err
+	}
+	buf, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	return string(buf), err
+}
@@ -0,0 +1,56 @@
+package khan
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestPasswordRemembered(t *testing.T) {
+	env, set := os.LookupEnv(passwordEnv)
+	defer func() {
+		if set {
+			os.Setenv(passwordEnv, env)
+		} else {
+			os.Unsetenv(passwordEnv)
+		}
+	}()
+
+	a, err := newsshauth([]string{"password"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := &sshhost{alias: "web", user: "deploy"}
+	denied := errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain")
+
+	os.Setenv(passwordEnv, "wrong")
+	if _, err := a.password(sh); err != nil {
+		t.Fatal(err)
+	}
+	a.loggedin(sh, denied)
+	if len(a.passwords) != 0 {
+		t.Errorf("Remembered a password that didn't work: %v", a.passwords)
+	}
+
+	os.Setenv(passwordEnv, "right")
+	if _, err := a.password(sh); err != nil {
+		t.Fatal(err)
+	}
+	a.loggedin(sh, nil)
+
+	// it doesn't have to be asked for again
+	os.Unsetenv(passwordEnv)
+	if pw, err := a.password(sh); err != nil || pw != "right" {
+		t.Errorf("Got %#v (%v), want the password that worked", pw, err)
+	}
+
+	// other errors don't say anything about the password
+	a.loggedin(sh, errors.New("ssh dial: connection refused"))
+	if a.passwords["deploy@web"] != "right" {
+		t.Error("Forgot the password when the host was down")
+	}
+	a.loggedin(sh, denied)
+	if len(a.passwords) != 0 {
+		t.Errorf("Still remembered a password that stopped working: %v", a.passwords)
+	}
+}
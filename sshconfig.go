@@ -0,0 +1,299 @@
+package khan
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// sshconfig is the part of ssh_config(5) we care about: Host (and Match all
+// / Match host) blocks, Include, and a handful of keywords. Like OpenSSH, the
+// first value found for a keyword wins, except IdentityFile, which adds up.
+type sshconfig struct {
+	blocks []*sshblock
+}
+
+type sshblock struct {
+	patterns []string // nil never matches (a Match we don't understand)
+	options  [][2]string
+}
+
+// sshhost is where and how to connect to a host after looking it up
+type sshhost struct {
+	alias            string
+	user             string
+	hostname         string
+	port             string
+	identityfiles    []string
+	certificatefiles []string
+	proxyjump        string
+}
+
+// connect is the user@host:port for sshpool to dial
+func (sh *sshhost) connect() string {
+	return sh.user + "@" + net.JoinHostPort(sh.hostname, sh.port)
+}
+
+// loadsshconfig reads ~/.ssh/config and /etc/ssh/ssh_config, or just fpath
+// if it isn't blank (like ssh -F).
+func loadsshconfig(fpath string) (*sshconfig, error) {
+	c := &sshconfig{}
+
+	// Relative includes are in ~/.ssh, even with -F
+	dir := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		dir = filepath.Join(home, ".ssh")
+	}
+
+	if fpath != "" {
+		if err := c.parse(fpath, dir, []string{"*"}, 0); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	if dir != "" {
+		if err := c.parse(filepath.Join(dir, "config"), dir, []string{"*"}, 0); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if err := c.parse("/etc/ssh/ssh_config", "/etc/ssh", []string{"*"}, 0); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sshconfig) parse(fpath, dir string, patterns []string, depth int) error {
+	if depth > 16 {
+		return fmt.Errorf("%s: Too many nested includes", fpath)
+	}
+
+	fh, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	// Lines before the first Host in a file belong to whatever block it
+	// was included from.
+	block := &sshblock{patterns: patterns}
+	c.blocks = append(c.blocks, block)
+
+	scanner := bufio.NewScanner(fh)
+	linenum := 0
+	for scanner.Scan() {
+		linenum++
+		key, args, err := sshconfigline(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", fpath, linenum, err)
+		}
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			block = &sshblock{patterns: args}
+			c.blocks = append(c.blocks, block)
+		case "match":
+			block = &sshblock{}
+			if len(args) == 1 && strings.ToLower(args[0]) == "all" {
+				block.patterns = []string{"*"}
+			} else if len(args) == 2 && strings.ToLower(args[0]) == "host" {
+				block.patterns = strings.Split(args[1], ",")
+			}
+			c.blocks = append(c.blocks, block)
+		case "include":
+			for _, arg := range args {
+				arg = expandtilde(arg)
+				if !filepath.IsAbs(arg) {
+					arg = filepath.Join(dir, arg)
+				}
+				matches, err := filepath.Glob(arg)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %w", fpath, linenum, err)
+				}
+				for _, match := range matches {
+					if err := c.parse(match, dir, block.patterns, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+			// carry on with the same patterns after the include
+			block = &sshblock{patterns: block.patterns}
+			c.blocks = append(c.blocks, block)
+		default:
+			if len(args) == 0 {
+				return fmt.Errorf("%s:%d: %s needs a value", fpath, linenum, key)
+			}
+			block.options = append(block.options, [2]string{key, strings.Join(args, " ")})
+		}
+	}
+	return scanner.Err()
+}
+
+// sshconfigline splits a line into a lowercased keyword and its arguments,
+// which may be quoted. "Keyword=value" works too.
+func sshconfigline(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end == -1 {
+		return strings.ToLower(line), nil, nil
+	}
+	key := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	var args []string
+	for rest != "" {
+		if rest[0] == '"' {
+			q := strings.IndexByte(rest[1:], '"')
+			if q == -1 {
+				return "", nil, fmt.Errorf("Unterminated quote")
+			}
+			args = append(args, rest[1:q+1])
+			rest = rest[q+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end == -1 {
+				end = len(rest)
+			}
+			args = append(args, rest[:end])
+			rest = rest[end:]
+		}
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return key, args, nil
+}
+
+func (b *sshblock) matches(host string) bool {
+	matched := false
+	for _, pattern := range b.patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = pattern[1:]
+		}
+		if ok, _ := filepath.Match(pattern, host); ok {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+func (c *sshconfig) get(host, key string) string {
+	for _, b := range c.blocks {
+		if !b.matches(host) {
+			continue
+		}
+		for _, o := range b.options {
+			if o[0] == key {
+				return o[1]
+			}
+		}
+	}
+	return ""
+}
+
+func (c *sshconfig) getall(host, key string) []string {
+	var values []string
+	for _, b := range c.blocks {
+		if !b.matches(host) {
+			continue
+		}
+		for _, o := range b.options {
+			if o[0] == key {
+				values = append(values, o[1])
+			}
+		}
+	}
+	return values
+}
+
+// lookup works out how to connect to a host given as [user@]host[:port] on
+// the command line. Anything given there wins over ssh_config.
+func (c *sshconfig) lookup(connect string) (*sshhost, error) {
+	sh := &sshhost{}
+
+	alias := connect
+	if at := strings.LastIndexByte(alias, '@'); at > -1 {
+		sh.user = alias[:at]
+		alias = alias[at+1:]
+	}
+	if host, port, err := net.SplitHostPort(alias); err == nil {
+		alias = host
+		sh.port = port
+	}
+	sh.alias = alias
+
+	localuser := ""
+	if u, err := user.Current(); err == nil {
+		localuser = u.Username
+	}
+	home, _ := os.UserHomeDir()
+
+	if sh.user == "" {
+		sh.user = c.get(alias, "user")
+	}
+	if sh.user == "" {
+		sh.user = localuser
+	}
+	if sh.user == "" {
+		return nil, fmt.Errorf("No user to SSH to %#v as", connect)
+	}
+
+	if sh.port == "" {
+		sh.port = c.get(alias, "port")
+	}
+	if sh.port == "" {
+		sh.port = "22"
+	}
+
+	sh.hostname = alias
+	if hostname := c.get(alias, "hostname"); hostname != "" {
+		sh.hostname = strings.NewReplacer("%%", "%", "%h", alias).Replace(hostname)
+	}
+
+	tokens := strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", sh.hostname,
+		"%n", alias,
+		"%p", sh.port,
+		"%r", sh.user,
+		"%u", localuser,
+	)
+	for _, idfile := range c.getall(alias, "identityfile") {
+		sh.identityfiles = append(sh.identityfiles, expandtilde(tokens.Replace(idfile)))
+	}
+	for _, certfile := range c.getall(alias, "certificatefile") {
+		sh.certificatefiles = append(sh.certificatefiles, expandtilde(tokens.Replace(certfile)))
+	}
+
+	if proxyjump := c.get(alias, "proxyjump"); proxyjump != "none" {
+		sh.proxyjump = proxyjump
+	}
+
+	return sh, nil
+}
+
+func expandtilde(fpath string) string {
+	if fpath == "~" || strings.HasPrefix(fpath, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home + fpath[1:]
+		}
+	}
+	return fpath
+}
@@ -0,0 +1,158 @@
+package khan
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line string
+		key  string
+		args []string
+		err  bool
+	}{
+		{"", "", nil, false},
+		{"  # comment", "", nil, false},
+		{"Host web*", "host", []string{"web*"}, false},
+		{"  HostName\tweb.example.com", "hostname", []string{"web.example.com"}, false},
+		{"Port=2222", "port", []string{"2222"}, false},
+		{"Port = 2222", "port", []string{"2222"}, false},
+		{`IdentityFile "~/my keys/id"`, "identityfile", []string{"~/my keys/id"}, false},
+		{`Host a "b c" d`, "host", []string{"a", "b c", "d"}, false},
+		{`IdentityFile "~/id`, "", nil, true},
+		{"Compression", "compression", nil, false},
+	}
+	for _, test := range tests {
+		key, args, err := sshconfigline(test.line)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%#v: no error", test.line)
+		case !test.err && err != nil:
+			t.Errorf("%#v: %v", test.line, err)
+		case key != test.key || strings.Join(args, "|") != strings.Join(test.args, "|"):
+			t.Errorf("%#v: got %#v %#v, want %#v %#v", test.line, key, args, test.key, test.args)
+		}
+	}
+}
+
+func TestSSHConfigLookup(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "khan_sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", tmp)
+
+	if err := os.Mkdir(filepath.Join(tmp, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	included := `Host included
+    User inc
+`
+	if err := ioutil.WriteFile(filepath.Join(tmp, ".ssh", "more.conf"), []byte(included), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `Include more.conf
+
+Host web
+    HostName web.example.com
+    Port 2222
+
+Host web db
+    User admin
+    IdentityFile ~/.ssh/id_%h
+    IdentityFile ~/.ssh/id_%r
+
+Host *.internal !bastion.internal
+    ProxyJump bastion.internal
+    User ops
+
+Host private
+    ProxyJump bastion1,bastion2
+
+Host direct
+    ProxyJump none
+
+Match host "matched,other"
+    Port 2200
+
+Match exec "true"
+    User never
+
+Match all
+    User fallback
+    IdentityFile ~/.ssh/id_all
+`
+	fpath := filepath.Join(tmp, "config")
+	if err := ioutil.WriteFile(fpath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadsshconfig(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ssh := filepath.Join(tmp, ".ssh")
+	tests := []struct {
+		connect string
+		want    sshhost
+	}{
+		{"web", sshhost{alias: "web", user: "admin", hostname: "web.example.com", port: "2222",
+			identityfiles: []string{ssh + "/id_web.example.com", ssh + "/id_admin", ssh + "/id_all"}}},
+		{"root@web:22", sshhost{alias: "web", user: "root", hostname: "web.example.com", port: "22",
+			identityfiles: []string{ssh + "/id_web.example.com", ssh + "/id_root", ssh + "/id_all"}}},
+		{"db", sshhost{alias: "db", user: "admin", hostname: "db", port: "22",
+			identityfiles: []string{ssh + "/id_db", ssh + "/id_admin", ssh + "/id_all"}}},
+		{"app.internal", sshhost{alias: "app.internal", user: "ops", hostname: "app.internal", port: "22",
+			identityfiles: []string{ssh + "/id_all"}, proxyjump: "bastion.internal"}},
+		{"bastion.internal", sshhost{alias: "bastion.internal", user: "fallback", hostname: "bastion.internal", port: "22",
+			identityfiles: []string{ssh + "/id_all"}}},
+		{"private", sshhost{alias: "private", user: "fallback", hostname: "private", port: "22",
+			identityfiles: []string{ssh + "/id_all"}, proxyjump: "bastion1,bastion2"}},
+		{"direct", sshhost{alias: "direct", user: "fallback", hostname: "direct", port: "22",
+			identityfiles: []string{ssh + "/id_all"}}},
+		{"matched", sshhost{alias: "matched", user: "fallback", hostname: "matched", port: "2200",
+			identityfiles: []string{ssh + "/id_all"}}},
+		{"included", sshhost{alias: "included", user: "inc", hostname: "included", port: "22",
+			identityfiles: []string{ssh + "/id_all"}}},
+		{"[::1]:2022", sshhost{alias: "::1", user: "fallback", hostname: "::1", port: "2022",
+			identityfiles: []string{ssh + "/id_all"}}},
+	}
+	for _, test := range tests {
+		sh, err := c.lookup(test.connect)
+		if err != nil {
+			t.Errorf("%s: %v", test.connect, err)
+			continue
+		}
+		got, want := *sh, test.want
+		if got.alias != want.alias || got.user != want.user || got.hostname != want.hostname || got.port != want.port ||
+			strings.Join(got.identityfiles, " ") != strings.Join(want.identityfiles, " ") || got.proxyjump != want.proxyjump {
+			t.Errorf("%s: got %+v, want %+v", test.connect, got, want)
+		}
+	}
+
+	// without a User anywhere, it's whoever we are
+	empty := filepath.Join(tmp, "empty")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = loadsshconfig(empty); err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	if sh, err := c.lookup("web"); err != nil || sh.connect() != u.Username+"@web:22" {
+		t.Errorf("Got %+v (%v), want %s@web:22", sh, err, u.Username)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"path/filepath"
 
 	"khan.rip/rio"
+
+	"github.com/flosch/pongo2/v4"
 )
 
 type VaultResponse struct {
@@ -29,9 +31,94 @@ func (bdl *bindataloader) Get(path string) (io.Reader, error) {
 	return bdl.run.assetfn(path)
 }
 
-func setContextHostTools(pcontext map[string]interface{}, host *Host) {
-	kh := pcontext["khan"].(map[string]interface{})
-	kh["secret"] = func(path string) (map[string]string, error) {
+// hostcontext makes the context templates run with for a host. Each
+// execution gets its own, so hosts can render at the same time.
+func hostcontext(host *Host) (pongo2.Context, error) {
+	kh, err := host.templatehost()
+	if err != nil {
+		return nil, err
+	}
+	return pongo2.Context{
+		"khan": map[string]interface{}{
+			"host":   kh,
+			"secret": hostsecret(host),
+		},
+	}, nil
+}
+
+// templatehost is khan.host in templates. It only needs working out once.
+func (host *Host) templatehost() (map[string]interface{}, error) {
+	host.tplmu.Lock()
+	defer host.tplmu.Unlock()
+
+	if host.tplhost != nil {
+		return host.tplhost, nil
+	}
+
+	info, err := host.rh.Info()
+	if err != nil {
+		return nil, err
+	}
+	facts, err := host.rh.Facts()
+	if err != nil {
+		return nil, err
+	}
+	groups := host.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	host.tplhost = map[string]interface{}{
+		"name":     host.Name,
+		"groups":   groups,
+		"vars":     host.Vars,
+		"hostname": info.Hostname,
+		"os":       info.OS,
+		"arch":     info.Arch,
+		"kernel":   info.Kernel,
+		"uname":    info.Uname,
+		"facts":    templatefacts(facts),
+	}
+	return host.tplhost, nil
+}
+
+// templatefacts gives the facts lowercase names, like the rest of khan.host
+func templatefacts(facts *rio.Facts) map[string]interface{} {
+	interfaces := []map[string]interface{}{}
+	for _, iface := range facts.Interfaces {
+		interfaces = append(interfaces, map[string]interface{}{
+			"name":  iface.Name,
+			"addrs": iface.Addrs,
+		})
+	}
+	mounts := []map[string]interface{}{}
+	for _, m := range facts.Mounts {
+		mounts = append(mounts, map[string]interface{}{
+			"device": m.Device,
+			"path":   m.Path,
+			"type":   m.Type,
+		})
+	}
+	ips := facts.IPs()
+	if ips == nil {
+		ips = []string{}
+	}
+	return map[string]interface{}{
+		"distro":         facts.Distro,
+		"distro_version": facts.DistroVersion,
+		"distro_name":    facts.DistroName,
+		"distro_family":  facts.DistroFamily,
+		"cpus":           facts.CPUs,
+		"memory":         facts.Memory,
+		"interfaces":     interfaces,
+		"mounts":         mounts,
+		"ips":            ips,
+		"virtualization": facts.Virtualization,
+	}
+}
+
+// hostsecret is khan.secret in templates, for reading from vault on the host
+func hostsecret(host *Host) func(path string) (map[string]string, error) {
+	return func(path string) (map[string]string, error) {
 		ctx := context.Background()
 
 		buf := &bytes.Buffer{}
@@ -52,45 +139,44 @@ func setContextHostTools(pcontext map[string]interface{}, host *Host) {
 
 func executePackedTemplateFile(host *Host, tfile string) (string, error) {
 	host.Run.pongomu.Lock()
-	defer host.Run.pongomu.Unlock()
-
 	v, ok := host.Run.pongocachefiles[tfile]
-
 	if !ok {
 		tpl, err := host.Run.pongopackedset.FromFile(tfile)
 		if err != nil {
+			host.Run.pongomu.Unlock()
 			return "", err
 		}
 		host.Run.pongocachefiles[tfile] = tpl
 		v = tpl
 	}
+	host.Run.pongomu.Unlock()
 
-	setContextHostTools(host.Run.pongopackedcontext, host)
-
-	buf, err := v.ExecuteBytes(host.Run.pongopackedcontext)
-	if err != nil {
-		return "", err
-	}
-	return string(buf), nil
+	return executetemplate(host, v)
 }
 
 func executePackedTemplateString(host *Host, s string) (string, error) {
 	host.Run.pongomu.Lock()
-	defer host.Run.pongomu.Unlock()
-
 	v, ok := host.Run.pongocachestrings[s]
 	if !ok {
 		tpl, err := host.Run.pongopackedset.FromString(s)
 		if err != nil {
+			host.Run.pongomu.Unlock()
 			return "", err
 		}
 		host.Run.pongocachestrings[s] = tpl
 		v = tpl
 	}
+	host.Run.pongomu.Unlock()
 
-	setContextHostTools(host.Run.pongopackedcontext, host)
+	return executetemplate(host, v)
+}
 
-	buf, err := v.ExecuteBytes(host.Run.pongopackedcontext)
+func executetemplate(host *Host, tpl *pongo2.Template) (string, error) {
+	pcontext, err := hostcontext(host)
+	if err != nil {
+		return "", err
+	}
+	buf, err := tpl.ExecuteBytes(pcontext)
 	if err != nil {
 		return "", err
 	}
@@ -34,6 +34,8 @@ type User struct {
 
 	Delete bool
 
+	Meta
+
 	id int
 }
 
@@ -0,0 +1,72 @@
+package khan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flosch/pongo2/v4"
+)
+
+// When is a pongo2 expression, like in a template's {% if %}, that an item
+// only gets applied if it holds. It can use everything templates have under
+// khan.host, without the khan.host:
+//
+//	when: facts.distro_family == "debian" and vars.port == 8080
+//
+// Items that don't apply show up as skipped.
+
+// compilewhen makes a template out of a When that renders "true" if it holds
+func compilewhen(expr string) (*pongo2.Template, error) {
+	if strings.Contains(expr, "{%") || strings.Contains(expr, "%}") {
+		return nil, fmt.Errorf("Bad when %#v: It's an expression, not a template", expr)
+	}
+	tpl, err := pongo2.FromString("{% if " + expr + " %}true{% endif %}")
+	if err != nil {
+		return nil, fmt.Errorf("Bad when %#v: %w", expr, err)
+	}
+	return tpl, nil
+}
+
+// CheckWhen makes sure an item's When compiles. khan build calls it, so
+// mistakes in yaml are caught then.
+func CheckWhen(item Item) error {
+	m, ok := item.(metaer)
+	if !ok || m.meta().When == "" {
+		return nil
+	}
+	_, err := compilewhen(m.meta().When)
+	return err
+}
+
+// when is whether an item should be applied on this host
+func (host *Host) when(item Item) (bool, error) {
+	m, ok := item.(metaer)
+	if !ok || m.meta().When == "" {
+		return true, nil
+	}
+	expr := m.meta().When
+
+	r := host.Run
+	r.pongomu.Lock()
+	tpl, ok := r.pongocachewhen[expr]
+	if !ok {
+		var err error
+		tpl, err = compilewhen(expr)
+		if err != nil {
+			r.pongomu.Unlock()
+			return false, err
+		}
+		r.pongocachewhen[expr] = tpl
+	}
+	r.pongomu.Unlock()
+
+	kh, err := host.templatehost()
+	if err != nil {
+		return false, err
+	}
+	out, err := tpl.Execute(pongo2.Context(kh))
+	if err != nil {
+		return false, fmt.Errorf("When %#v: %w", expr, err)
+	}
+	return out == "true", nil
+}
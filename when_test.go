@@ -0,0 +1,53 @@
+package khan
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWhen(t *testing.T) {
+	tests := []struct {
+		when string
+		want string // "true", "false", or part of the error
+	}{
+		{"", "true"},
+		{"true", "true"},
+		{"false", "false"},
+		{`os == "linux"`, "true"},
+		{`os == "openbsd"`, "false"},
+		{`facts.distro_family == "debian" and arch == "amd64"`, "true"},
+		{`facts.distro == "ubuntu" or facts.distro == "debian"`, "true"},
+		{`not (facts.distro == "debian")`, "false"},
+		{`vars.port == 8080`, "true"},
+		{`vars.port > 9000`, "false"},
+		{`vars.missing`, "false"},
+		{`"web" in groups`, "true"},
+		{`"db" in groups`, "false"},
+		{`name == "test" and hostname == "test"`, "true"},
+		{`{% if true %}`, "It's an expression, not a template"},
+		{`os ==`, "Bad when"},
+	}
+	for _, test := range tests {
+		r := newtestrun(&testhost{})
+		host := r.Hosts[0]
+		host.Groups = []string{"all", "web"}
+		host.Vars = map[string]interface{}{"port": 8080}
+
+		item := &testitem{Name: "x", Meta: Meta{When: test.when}}
+		ok, err := host.when(item)
+		got := "false"
+		if err != nil {
+			got = err.Error()
+		} else if ok {
+			got = "true"
+		}
+		if !strings.Contains(got, test.want) {
+			t.Errorf("%#v: got %s, want %s", test.when, got, test.want)
+		}
+
+		// khan build finds the same mistakes
+		if err := CheckWhen(item); (err != nil) != (test.want != "true" && test.want != "false") {
+			t.Errorf("%#v: CheckWhen got %v", test.when, err)
+		}
+	}
+}